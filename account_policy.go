@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// AccountPolicy holds the rules accounts have to meet to use parts of the API
+type AccountPolicy struct {
+	// RequireVerifiedEmail blocks posting chirps until the email is verified
+	RequireVerifiedEmail bool
+	// Require2FAForRed blocks Chirpy Red users until they enable two-factor authentication
+	Require2FAForRed bool
+}
+
+// LoadAccountPolicy reads the account rules from the environment
+func LoadAccountPolicy() (AccountPolicy, error) {
+	policy := AccountPolicy{}
+	if v := os.Getenv("REQUIRE_VERIFIED_EMAIL"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return AccountPolicy{}, fmt.Errorf("invalid REQUIRE_VERIFIED_EMAIL %q", v)
+		}
+		policy.RequireVerifiedEmail = b
+	}
+	if v := os.Getenv("REQUIRE_2FA_FOR_RED"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return AccountPolicy{}, fmt.Errorf("invalid REQUIRE_2FA_FOR_RED %q", v)
+		}
+		policy.Require2FAForRed = b
+	}
+	return policy, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+// maxRestoreSize caps the snapshots AdminRestore reads into memory
+const maxRestoreSize = 256 << 20
+
+func (cfg *Config) AdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.Buffer{}
+	err := cfg.db.Snapshot(&buf)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	filename := fmt.Sprintf("chirpy-%s.snapshot", time.Now().UTC().Format(snapshotTimeFormat))
+	w.Header().Set("Content-type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
+func (cfg *Config) AdminRestore(w http.ResponseWriter, r *http.Request) {
+	err := cfg.db.Restore(http.MaxBytesReader(w, r.Body, maxRestoreSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		RespondWithError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("snapshots larger than %d bytes can't be restored", tooLarge.Limit))
+		return
+	}
+	if errors.Is(err, database.ErrInvalidSnapshot) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// AdminSetUserRole changes the role of a user, admins can't change
+// their own role so that they can't lock everyone out of the admin routes
+func (cfg *Config) AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+	admin, _ := AuthUser(r.Context())
+
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	type requestParameters struct {
+		Role string `json:"role"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validRole(rqParams.Role) {
+		RespondWithError(w, http.StatusBadRequest, fmt.Errorf("unknown role %q", rqParams.Role).Error())
+		return
+	}
+	if userID == admin.Id {
+		RespondWithError(w, http.StatusForbidden, errors.New("admins can't change their own role").Error())
+		return
+	}
+
+	user, err := cfg.db.ModifyUser(userID, func(user *database.User) error {
+		user.Role = rqParams.Role
+		return nil
+	})
+	if errors.Is(err, database.ErrUserNotFound) {
+		RespondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("admin %d set the role of user %d to %s", admin.Id, user.Id, user.Role)
+
+	type responseParameters struct {
+		Id    int    `json:"id"`
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	respParams := responseParameters{Id: user.Id, Email: user.Email, Role: user.Role}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
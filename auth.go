@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/dimadudin/web-server-go/internal/keys"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	issuerAccess  = "chirpy-access"
+	issuerRefresh = "chirpy-refresh"
+
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 24 * 60 * time.Hour
+)
+
+// LoadTokenKeys builds the JWT key set from the environment,
+// JWT_KEY_DIR holds the signing keys and JWT_SECRET, if set,
+// keeps HS256 tokens issued before the keys were introduced valid.
+// That is before JWT_SECRET_CUTOFF (RFC 3339) or else before the oldest
+// key file was written, JWT_SECRET can be removed once refreshTokenTTL
+// has passed since then, which is logged at startup
+func LoadTokenKeys() (*keys.Set, error) {
+	var legacy []byte
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		legacy = []byte(secret)
+	}
+	var cutoff time.Time
+	if v := os.Getenv("JWT_SECRET_CUTOFF"); v != "" {
+		var err error
+		cutoff, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_SECRET_CUTOFF %q", v)
+		}
+	}
+	set, err := keys.NewSet(os.Getenv("JWT_KEY_DIR"), os.Getenv("JWT_SIGNING_KEY"), legacy, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("loading JWT keys: %w", err)
+	}
+	if retired := set.LegacyCutoff(); !retired.IsZero() && time.Since(retired) > refreshTokenTTL {
+		log.Print("JWT_SECRET no longer verifies any unexpired token and can be removed")
+	}
+	return set, nil
+}
+
+// TokenClaims are the claims of chirpy tokens
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	// SessionId is the refresh token family an access token was issued for
+	SessionId string `json:"sid,omitempty"`
+	// Role is the role of the user when an access token was issued
+	Role string `json:"role,omitempty"`
+	// ClientId is the OAuth client a token was issued to,
+	// such tokens are limited to the space separated scopes in Scope
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// scopes returns the scopes an OAuth client token is limited to
+func (claims *TokenClaims) scopes() []string {
+	return strings.Fields(claims.Scope)
+}
+
+// AuthToken is a validated bearer token
+type AuthToken struct {
+	Raw    string
+	Claims *TokenClaims
+	// Personal is set when the token is a personal access token,
+	// Claims are then made up from it
+	Personal *database.PersonalToken
+}
+
+type authContextKey int
+
+const (
+	authUserKey authContextKey = iota
+	authTokenKey
+)
+
+// withAuth returns a copy of ctx carrying the authenticated user and token
+func withAuth(ctx context.Context, user database.User, token AuthToken) context.Context {
+	ctx = context.WithValue(ctx, authUserKey, user)
+	return context.WithValue(ctx, authTokenKey, token)
+}
+
+// AuthUser returns the user authenticated by MwRequireAuth
+func AuthUser(ctx context.Context) (database.User, bool) {
+	user, ok := ctx.Value(authUserKey).(database.User)
+	return user, ok
+}
+
+// AuthTokenFrom returns the bearer token validated by MwRequireAuth
+func AuthTokenFrom(ctx context.Context) (AuthToken, bool) {
+	token, ok := ctx.Value(authTokenKey).(AuthToken)
+	return token, ok
+}
+
+// bearerToken extracts the token from the Authorization header
+func bearerToken(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", errors.New("no auth")
+	}
+	return strings.TrimPrefix(auth, "Bearer "), nil
+}
+
+// parseToken checks the signature, expiry and issuer of tokenStr
+func (cfg *Config) parseToken(tokenStr string, issuer string) (AuthToken, error) {
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, cfg.tokenKeys.Keyfunc,
+		jwt.WithValidMethods(cfg.tokenKeys.Methods()))
+	if err != nil {
+		return AuthToken{}, err
+	}
+	if claims.Issuer != issuer {
+		return AuthToken{}, errors.New("invalid token issuer")
+	}
+	return AuthToken{Raw: tokenStr, Claims: claims}, nil
+}
+
+// randomToken returns a new unguessable token for links sent to users
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueToken signs a new token for user in the session sid, which may be empty,
+// a random jti keeps tokens issued in the same second distinct
+// and access tokens carry the role of the user
+func (cfg *Config) issueToken(issuer string, user database.User, ttl time.Duration, sid string) (string, *TokenClaims, error) {
+	return cfg.issueClientToken(issuer, user, ttl, sid, "", nil)
+}
+
+// issueClientToken is issueToken for a token the user granted the OAuth client
+// clientID, unless clientID is empty, the token is limited to scopes
+// and carries no role so it never grants the permissions of one
+func (cfg *Config) issueClientToken(issuer string, user database.User, ttl time.Duration, sid string,
+	clientID string, scopes []string) (string, *TokenClaims, error) {
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	claims := &TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			Issuer:    issuer,
+			Subject:   strconv.Itoa(user.Id),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		SessionId: sid,
+		ClientId:  clientID,
+		Scope:     strings.Join(scopes, " "),
+	}
+	if issuer == issuerAccess && clientID == "" {
+		claims.Role = userRole(user)
+	}
+	tokenStr, err := cfg.tokenKeys.Sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return tokenStr, claims, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+// Permission is something a role allows its users to do
+type Permission string
+
+const (
+	PermViewMetrics     Permission = "metrics:view"
+	PermResetMetrics    Permission = "metrics:reset"
+	PermManageSnapshots Permission = "snapshots:manage"
+	PermManageRoles     Permission = "users:manage_roles"
+	// PermDeleteAnyChirp allows deleting chirps of other users
+	PermDeleteAnyChirp Permission = "chirps:delete_any"
+)
+
+// rolePermissions lists what each role may do, unknown roles may do nothing
+var rolePermissions = map[string][]Permission{
+	database.RoleUser:      {},
+	database.RoleModerator: {PermDeleteAnyChirp},
+	database.RoleAdmin: {
+		PermViewMetrics,
+		PermResetMetrics,
+		PermManageSnapshots,
+		PermManageRoles,
+		PermDeleteAnyChirp,
+	},
+}
+
+// userRole returns the role of user, users stored before roles existed are users
+func userRole(user database.User) string {
+	if user.Role == "" {
+		return database.RoleUser
+	}
+	return user.Role
+}
+
+// validRole reports whether role is one of the known roles
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// roleAllows reports whether role grants perm
+func roleAllows(role string, perm Permission) bool {
+	return slices.Contains(rolePermissions[role], perm)
+}
+
+// authAllows reports whether the authenticated request may do perm:
+// the role in its access token and the stored role of the user both have to
+// grant it, so a demoted user loses the permission before their token expires
+func authAllows(r *http.Request, perm Permission) bool {
+	user, ok := AuthUser(r.Context())
+	if !ok {
+		return false
+	}
+	token, ok := AuthTokenFrom(r.Context())
+	if !ok {
+		return false
+	}
+	return roleAllows(token.Claims.Role, perm) && roleAllows(userRole(user), perm)
+}
+
+// MwRequirePermission only lets requests through that may do perm,
+// it must run after MwRequireAuth
+func (cfg *Config) MwRequirePermission(perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !authAllows(r, perm) {
+				RespondWithError(w, http.StatusForbidden, errors.New("permission denied").Error())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
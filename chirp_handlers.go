@@ -5,56 +5,17 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
-	"strings"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 func (cfg *Config) ApiPostChirp(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("no auth").Error())
-		return
-	}
-
-	tokenStr := strings.TrimPrefix(auth, "Bearer ")
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.jwtSecret), nil
-		})
-	if err != nil {
-		RespondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	if issuer != "chirpy-access" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("invalid token issuer").Error())
-		return
-	}
-
-	userIDStr, err := token.Claims.GetSubject()
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
+	user, _ := AuthUser(r.Context())
 
 	type requestParameters struct {
 		Body string `json:"body"`
 	}
 	rqParams := requestParameters{}
 	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&rqParams)
+	err := decoder.Decode(&rqParams)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -64,7 +25,7 @@ func (cfg *Config) ApiPostChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	censored := CensorChirp(rqParams.Body)
-	newChirp, err := cfg.db.CreateChirp(censored, userID)
+	newChirp, err := cfg.db.CreateChirp(censored, user.Id)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -115,43 +76,7 @@ func (cfg *Config) ApiGetChirpByID(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *Config) ApiDeleteChirpByID(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("no auth").Error())
-		return
-	}
-
-	tokenStr := strings.TrimPrefix(auth, "Bearer ")
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.jwtSecret), nil
-		})
-	if err != nil {
-		RespondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	if issuer != "chirpy-access" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("invalid token issuer").Error())
-		return
-	}
-
-	userIDStr, err := token.Claims.GetSubject()
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
+	user, _ := AuthUser(r.Context())
 
 	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
 	if err != nil {
@@ -164,7 +89,7 @@ func (cfg *Config) ApiDeleteChirpByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if chirp.AuthorId != userID {
+	if chirp.AuthorId != user.Id && !authAllows(r, PermDeleteAnyChirp) {
 		RespondWithError(w, http.StatusForbidden, errors.New("chirp deletion forbidden").Error())
 		return
 	}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/dimadudin/web-server-go/internal/keys"
+	"github.com/dimadudin/web-server-go/internal/oidc"
+)
+
+// runCommand runs the named subcommand instead of the server
+// and reports whether such a command exists
+func runCommand(name string, args []string) bool {
+	switch name {
+	case "migrate":
+		cmdMigrate(args)
+	case "snapshot":
+		cmdSnapshot(args)
+	case "restore":
+		cmdRestore(args)
+	case "keygen":
+		cmdKeygen(args)
+	case "retire-key":
+		cmdRetireKey(args)
+	case "create-admin":
+		cmdCreateAdmin(args)
+	case "mock-oidc":
+		cmdMockOIDC(args)
+	default:
+		return false
+	}
+	return true
+}
+
+// cmdMigrate lists pending schema migrations and applies them with -apply
+func cmdMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	apply := fs.Bool("apply", false, "Apply the pending migrations instead of only listing them")
+	fs.Parse(args)
+
+	storeCfg, err := LoadStoreConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pending, err := storeCfg.PendingMigrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pending) == 0 {
+		fmt.Printf("%s is up to date\n", storeCfg.Path)
+		return
+	}
+	fmt.Printf("%s has %d pending migration(s):\n", storeCfg.Path, len(pending))
+	for _, m := range pending {
+		fmt.Printf("  %d: %s\n", m.Version, m.Description)
+	}
+	if !*apply {
+		fmt.Println("dry run, rerun with -apply to upgrade")
+		return
+	}
+
+	db, err := storeCfg.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s migrated to schema version %d\n", storeCfg.Path, pending[len(pending)-1].Version)
+}
+
+// cmdSnapshot writes a snapshot of a stopped server's store,
+// a running server is backed up through GET /admin/snapshot instead
+func cmdSnapshot(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	out := fs.String("o", "", "Write the snapshot to this file (- for stdout) instead of SNAPSHOT_DIR")
+	fs.Parse(args)
+
+	storeCfg, err := LoadStoreConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	snapshotCfg, err := LoadSnapshotConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" && snapshotCfg.Dir == "" {
+		log.Fatal("either -o or SNAPSHOT_DIR is required")
+	}
+
+	db, err := storeCfg.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if *out == "" {
+		path, err := NewSnapshotScheduler(db, snapshotCfg).TakeSnapshot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "snapshot written to %s\n", path)
+		return
+	}
+	if *out == "-" {
+		err = db.Snapshot(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	// a snapshot that didn't reach the disk is no snapshot
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// cmdRestore validates a snapshot and replaces a stopped server's store with it,
+// a running server is restored through POST /admin/restore instead
+func cmdRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("i", "", "Snapshot file to restore")
+	fs.Parse(args)
+	if *in == "" {
+		log.Fatal("-i is required")
+	}
+
+	storeCfg, err := LoadStoreConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	db, err := storeCfg.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.Restore(f)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s restored from %s\n", storeCfg.Path, *in)
+}
+
+// cmdKeygen adds a new signing key to JWT_KEY_DIR, the server signs
+// with it after a restart while tokens signed by older keys stay valid
+func cmdKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	alg := fs.String("alg", "EdDSA", "Key algorithm, EdDSA or RS256")
+	fs.Parse(args)
+
+	dir := os.Getenv("JWT_KEY_DIR")
+	if dir == "" {
+		log.Fatal("JWT_KEY_DIR is required")
+	}
+	kid, err := keys.Generate(dir, *alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("generated key %s in %s\n", kid, dir)
+}
+
+// cmdRetireKey keeps only the public half of a key in JWT_KEY_DIR,
+// so it still verifies the tokens it signed but signs no new ones
+func cmdRetireKey(args []string) {
+	fs := flag.NewFlagSet("retire-key", flag.ExitOnError)
+	kid := fs.String("kid", "", "Id of the key to retire")
+	fs.Parse(args)
+
+	dir := os.Getenv("JWT_KEY_DIR")
+	if dir == "" || *kid == "" {
+		log.Fatal("JWT_KEY_DIR and -kid are required")
+	}
+	err := keys.Retire(dir, *kid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("retired key %s\n", *kid)
+}
+
+// cmdCreateAdmin bootstraps an admin in a stopped server's store: an existing
+// user is promoted, otherwise a new one is created with a password read from stdin
+func cmdCreateAdmin(args []string) {
+	fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	email := fs.String("email", "", "Email of the admin")
+	fs.Parse(args)
+	if *email == "" {
+		log.Fatal("-email is required")
+	}
+	addr, err := validateEmail(*email)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storeCfg, err := LoadStoreConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	passwordCfg, err := LoadPasswordConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := storeCfg.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	user, err := db.GetUserByEmail(addr)
+	created := errors.Is(err, database.ErrEmailNotFound)
+	if created {
+		fmt.Fprintf(os.Stderr, "password for %s: ", addr)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatal("reading the password: ", err)
+		}
+		plain := strings.TrimRight(line, "\r\n")
+		err = passwordCfg.Policy.Check(plain)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hashedPassword, err := passwordCfg.Hasher.Hash(plain)
+		if err != nil {
+			log.Fatal(err)
+		}
+		user, err = db.CreateUser(addr, hashedPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	user, err = db.ModifyUser(user.Id, func(user *database.User) error {
+		user.Role = database.RoleAdmin
+		// the operator vouches for the address of an admin they create
+		if created {
+			user.EmailVerified = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("user %d (%s) is an admin\n", user.Id, user.Email)
+}
+
+// cmdMockOIDC serves a mock OpenID Connect provider to sign in with locally,
+// it signs in anyone as the login_hint email, or -email without one
+func cmdMockOIDC(args []string) {
+	fs := flag.NewFlagSet("mock-oidc", flag.ExitOnError)
+	addr := fs.String("addr", ":9090", "Address to listen on")
+	issuer := fs.String("issuer", "http://localhost:9090", "Issuer URL, set OIDC_ISSUER of the server to it")
+	clientID := fs.String("client-id", "chirpy", "Client ID the server has to use")
+	clientSecret := fs.String("client-secret", "", "Client secret the server has to use, none if empty")
+	email := fs.String("email", "", "Email to sign in as when the request has no login_hint")
+	fs.Parse(args)
+
+	provider, err := oidc.NewMockProvider(*issuer, *clientID, *clientSecret, *email)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("mock OpenID Connect provider %s listening on %s", provider.Issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, provider.Handler()))
+}
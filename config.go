@@ -1,16 +1,33 @@
 package main
 
-import "github.com/dimadudin/web-server-go/internal/database"
+import (
+	"sync"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/dimadudin/web-server-go/internal/keys"
+)
 
 type Config struct {
-	db          *database.DB
-	jwtSecret   string
+	db          database.Store
+	tokenKeys   *keys.Set
 	polkaApiKey string
-	fsHits      int
+	janitor     *TokenJanitor
+	mail        MailConfig
+	policy      AccountPolicy
+	throttle    LoginThrottleConfig
+	passwords   PasswordConfig
+	oidc        OIDCConfig
+	// outgoing tracks emails still being sent
+	outgoing *sync.WaitGroup
+	fsHits   int
 }
 
-func NewApiConfig(db *database.DB, jwtSecret string, polkaApiKey string) Config {
-	return Config{db: db, jwtSecret: jwtSecret, polkaApiKey: polkaApiKey, fsHits: 0}
+func NewApiConfig(db database.Store, tokenKeys *keys.Set, polkaApiKey string,
+	janitor *TokenJanitor, mail MailConfig, policy AccountPolicy, throttle LoginThrottleConfig,
+	passwords PasswordConfig, oidc OIDCConfig) Config {
+	return Config{db: db, tokenKeys: tokenKeys, polkaApiKey: polkaApiKey,
+		janitor: janitor, mail: mail, policy: policy, throttle: throttle,
+		passwords: passwords, oidc: oidc, outgoing: &sync.WaitGroup{}, fsHits: 0}
 }
 
 func (cfg *Config) RegisterHit() {
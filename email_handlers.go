@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	purposeVerifyEmail = "verify_email"
+	verifyEmailTTL     = 24 * time.Hour
+	maxEmailLength     = 254
+)
+
+var errInvalidEmail = errors.New("invalid email address")
+
+// validateEmail checks that email is a bare address like user@example.com
+// and returns it without surrounding whitespace
+func validateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if len(email) > maxEmailLength {
+		return "", errInvalidEmail
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", errInvalidEmail
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", errInvalidEmail
+	}
+	return email, nil
+}
+
+// sendVerificationEmail emails a link that proves the user owns email,
+// which is either their address or the one they are changing to
+func (cfg *Config) sendVerificationEmail(user database.User, email string) error {
+	tokenStr, err := randomToken()
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.CreateOneTimeToken(tokenStr, database.OneTimeToken{
+		Purpose:   purposeVerifyEmail,
+		UserId:    user.Id,
+		Email:     email,
+		ExpiresAt: time.Now().UTC().Add(verifyEmailTTL),
+	})
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/app/verify_email.html?token=%s", cfg.mail.PublicURL, url.QueryEscape(tokenStr))
+	cfg.sendMail(email, "Verify your email address for Chirpy", fmt.Sprintf(`Please confirm that %s is your email address by opening this link within %d hours:
+
+%s
+
+If you didn't sign up for Chirpy or change your email address, ignore this email.
+`, email, int(verifyEmailTTL.Hours()), link))
+	return nil
+}
+
+// claimEmail marks the email of the user as verified once its owner proved they
+// receive mail there. Whoever registered the address without ever proving it may
+// have set the password, so such an account loses it along with its sessions
+// and personal access tokens.
+// Accounts from before verification existed were marked verified by a migration
+// and keep their password, like an account verified with ApiVerifyEmail does
+func (cfg *Config) claimEmail(userID int) (database.User, error) {
+	squatted := false
+	user, err := cfg.db.ModifyUser(userID, func(user *database.User) error {
+		squatted = !user.EmailVerified && user.Password != ""
+		if squatted {
+			user.Password = ""
+		}
+		user.EmailVerified = true
+		return nil
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+	if squatted {
+		revoked, err := cfg.db.RevokeUserTokens(user.Id)
+		if err != nil {
+			return database.User{}, err
+		}
+		deleted, err := cfg.db.DeletePersonalTokensByUser(user.Id)
+		if err != nil {
+			return database.User{}, err
+		}
+		log.Printf("email of user %d claimed, password dropped, %d sessions revoked and %d personal access tokens deleted",
+			user.Id, revoked, deleted)
+	}
+	return user, nil
+}
+
+// ApiVerifyEmail marks an email address as verified with a verification token,
+// a pending email change takes effect at this point
+func (cfg *Config) ApiVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Token string `json:"token"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, err := cfg.db.UseOneTimeToken(rqParams.Token, purposeVerifyEmail)
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenUsed) ||
+		errors.Is(err, database.ErrTokenExpired) {
+		RespondWithError(w, http.StatusBadRequest, errors.New("invalid or expired verification token").Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	errStale := errors.New("this address is no longer the one to verify")
+	user, err := cfg.db.ModifyUser(token.UserId, func(user *database.User) error {
+		switch {
+		case user.PendingEmail != "" && strings.EqualFold(user.PendingEmail, token.Email):
+			user.Email = user.PendingEmail
+			user.PendingEmail = ""
+		case user.PendingEmail == "" && strings.EqualFold(user.Email, token.Email):
+		default:
+			return errStale
+		}
+		user.EmailVerified = true
+		return nil
+	})
+	if errors.Is(err, errStale) {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct {
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	respParams := responseParameters{Id: user.Id, Email: user.Email, EmailVerified: user.EmailVerified}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// ApiResendVerificationEmail sends a new verification link for the pending email
+// of the caller, or for their current email if it is not verified yet
+func (cfg *Config) ApiResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	email := user.PendingEmail
+	if email == "" {
+		if user.EmailVerified {
+			RespondWithError(w, http.StatusConflict, errors.New("email address is already verified").Error())
+			return
+		}
+		email = user.Email
+	}
+	err := cfg.sendVerificationEmail(user, email)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusAccepted, respParams)
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// encryptedPrefix marks data sealed by a keyring,
+// it is followed by the key id, a colon and base64 of nonce and ciphertext
+const encryptedPrefix = "chirpy-enc:v1:"
+
+var ErrEncrypted = errors.New("database is encrypted with a key that is not configured")
+
+// dbKey is one AES-256-GCM key and the id it is recognised by
+type dbKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// keyring seals data with its current key and opens data sealed
+// with the current or any previous key, a nil keyring stores plaintext
+type keyring struct {
+	current *dbKey
+	keys    map[string]*dbKey
+}
+
+// newKeyring builds a keyring from 32 byte keys, previous keys are only used for reading
+func newKeyring(current []byte, previous ...[]byte) (*keyring, error) {
+	ring := keyring{keys: make(map[string]*dbKey)}
+	for i, raw := range append([][]byte{current}, previous...) {
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("encryption key %d is %d bytes, want 32", i, len(raw))
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		key := &dbKey{id: hex.EncodeToString(sum[:8]), aead: aead}
+		ring.keys[key.id] = key
+		if i == 0 {
+			ring.current = key
+		}
+	}
+	return &ring, nil
+}
+
+// seal encrypts plain with the current key
+func (ring *keyring) seal(plain []byte) ([]byte, error) {
+	if ring == nil {
+		return plain, nil
+	}
+	nonce := make([]byte, ring.current.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed := ring.current.aead.Seal(nonce, nonce, plain, nil)
+	out := []byte(encryptedPrefix + ring.current.id + ":")
+	return base64.RawURLEncoding.AppendEncode(out, sealed), nil
+}
+
+// open decrypts data sealed by seal and passes plaintext through,
+// stale reports that data should be rewritten with the current key
+func (ring *keyring) open(data []byte) (plain []byte, stale bool, err error) {
+	if !bytes.HasPrefix(data, []byte(encryptedPrefix)) {
+		return data, ring != nil, nil
+	}
+	if ring == nil {
+		return nil, false, ErrEncrypted
+	}
+	rest := data[len(encryptedPrefix):]
+	id, encoded, ok := bytes.Cut(rest, []byte(":"))
+	if !ok {
+		return nil, false, errors.New("malformed encrypted data")
+	}
+	key, ok := ring.keys[string(id)]
+	if !ok {
+		return nil, false, fmt.Errorf("%w: key id %s", ErrEncrypted, id)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return nil, false, err
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, false, errors.New("malformed encrypted data")
+	}
+	plain, err = key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return plain, key != ring.current, nil
+}
+
+// WithEncryptionKeys encrypts the database file, its log and its snapshots
+// with AES-256-GCM using current, data written with one of the previous keys
+// is still readable and gets re-encrypted with current on the next write
+func WithEncryptionKeys(current []byte, previous ...[]byte) Option {
+	return func(db *DB) {
+		db.keys = append([][]byte{current}, previous...)
+	}
+}
+
+// resealKeptFiles brings the copies kept next to the database file at path,
+// its generations and a moved aside corrupt file, under the current key:
+// plaintext and data sealed with a previous key are sealed again, copies no
+// configured key opens are left for inspection and only logged
+func resealKeptFiles(path string, ring *keyring) error {
+	if ring == nil {
+		return nil
+	}
+	kept := []string{path + ".corrupt"}
+	for n := 1; n <= dbGenerations; n++ {
+		kept = append(kept, generationPath(path, n))
+	}
+	for _, keptPath := range kept {
+		dat, err := os.ReadFile(keptPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("database: skipping %s, it can't be read to seal it again: %s", keptPath, err)
+			continue
+		}
+		plain, stale, err := ring.open(dat)
+		if err != nil {
+			log.Printf("database: skipping %s, it can't be opened to seal it again: %s", keptPath, err)
+			continue
+		}
+		if !stale {
+			continue
+		}
+		sealed, err := ring.seal(plain)
+		if err != nil {
+			return err
+		}
+		// kept generations may be hard links, the atomic write replaces
+		// the link instead of writing through it
+		err = writeFileAtomic(keptPath, sealed)
+		if err != nil {
+			return err
+		}
+		log.Printf("database: sealed %s with the current key", keptPath)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sealedWith returns the id of the key the file at path is sealed with,
+// or "" for plaintext
+func sealedWith(t *testing.T, path string) string {
+	t.Helper()
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(dat, []byte(encryptedPrefix)) {
+		return ""
+	}
+	id, _, _ := strings.Cut(string(dat[len(encryptedPrefix):]), ":")
+	return id
+}
+
+// keptFiles returns the database file and every copy kept next to it
+func keptFiles(path string) []string {
+	files := []string{path}
+	for _, candidate := range []string{generationPath(path, 1), generationPath(path, 2), path + ".corrupt"} {
+		if _, err := os.Stat(candidate); err == nil {
+			files = append(files, candidate)
+		}
+	}
+	return files
+}
+
+func TestEncryptionSealsKeptFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	oldRing, err := newKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRing, err := newKeyring(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, newID := oldRing.current.id, newRing.current.id
+
+	// a plaintext database with generations and a corrupt file moved aside
+	db := openTestDB(t, path)
+	for _, email := range []string{"a@x.com", "b@x.com", "c@x.com"} {
+		_, err := db.CreateUser(email, "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.mu.Lock()
+		err = db.snapshot()
+		db.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	err = os.WriteFile(path+".corrupt", []byte(`{"users": {"1": {"email": "a@x.com"`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keptFiles(path)) != 4 {
+		t.Fatalf("kept files are %v, want the file, two generations and the corrupt one", keptFiles(path))
+	}
+
+	// turning encryption on seals every copy
+	db = openTestDB(t, path, WithEncryptionKeys(oldKey))
+	_, err = db.CreateUser("d@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	for _, f := range keptFiles(path) {
+		if id := sealedWith(t, f); id != oldID {
+			t.Errorf("%s is sealed with %q after encryption was turned on, want %q", f, id, oldID)
+		}
+	}
+
+	// rotating the key seals them again, a copy no key opens is left for inspection
+	unknown, err := newKeyring(bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := unknown.seal([]byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".corrupt", sealed, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, path, WithEncryptionKeys(newKey, oldKey))
+	_, err = db.CreateUser("e@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if dat, err := os.ReadFile(path + ".corrupt"); err != nil || !bytes.Equal(dat, sealed) {
+		t.Errorf("a copy sealed with an unknown key was not left as it was: %v", err)
+	}
+	for _, f := range keptFiles(path) {
+		if f == path+".corrupt" {
+			continue
+		}
+		if id := sealedWith(t, f); id != newID {
+			t.Errorf("%s is sealed with %q after rotation, want %q", f, id, newID)
+		}
+	}
+
+	// the retired key is no longer needed for anything on disk
+	db = openTestDB(t, path, WithEncryptionKeys(newKey))
+	defer db.Close()
+	if _, err := db.GetUserByEmail("e@x.com"); err != nil {
+		t.Fatal(err)
+	}
+}
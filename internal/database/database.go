@@ -3,115 +3,375 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"log"
 	"os"
+	"slices"
 	"sort"
 	"sync"
 	"time"
 )
 
+var _ Store = (*DB)(nil)
+
+const (
+	// defaultCompactInterval is how often the write-ahead log is folded into the snapshot
+	defaultCompactInterval = 5 * time.Minute
+	// compactThreshold is the number of log records that triggers an early compaction
+	compactThreshold = 1000
+)
+
+// DB is a Store that serves reads from memory,
+// appends every change to a write-ahead log and periodically
+// compacts the log into a JSON snapshot file
 type DB struct {
-	path string
-	mu   *sync.RWMutex
+	path  string
+	mu    *sync.RWMutex
+	state DBStructure
+	idx   indexes
+	wal   *os.File
+	lsn   int64
+	// pending is the number of log records not yet in the snapshot
+	pending int
+	// keys are the raw encryption keys, ring is built from them
+	keys [][]byte
+	ring *keyring
+	// stale is set when data on disk is not sealed with the current key
+	stale bool
+
+	compactInterval time.Duration
+	stop            chan struct{}
+	done            chan struct{}
+	// closeOnce makes Close safe to call again, later calls return closeErr
+	closeOnce sync.Once
+	closeErr  error
 }
 
 type DBStructure struct {
-	Users         map[int]User            `json:"users"`
-	Chirps        map[int]Chirp           `json:"chirps"`
-	RefreshTokens map[string]RefreshToken `json:"revocations"`
+	SchemaVersion int `json:"schema_version"`
+	// Lsn is the last log record folded into this snapshot
+	Lsn int64 `json:"lsn"`
+	// Sequences holds the last id handed out per table
+	Sequences      table[string, int]           `json:"sequences"`
+	Users          table[int, User]             `json:"users"`
+	Chirps         table[int, Chirp]            `json:"chirps"`
+	RefreshTokens  table[string, RefreshToken]  `json:"refresh_tokens"`
+	OneTimeTokens  table[string, OneTimeToken]  `json:"one_time_tokens"`
+	LoginThrottles table[string, LoginThrottle] `json:"login_throttles"`
+	PersonalTokens table[string, PersonalToken] `json:"personal_tokens"`
+	OAuthClients   table[string, OAuthClient]   `json:"oauth_clients"`
+	OAuthCodes     table[string, OAuthCode]     `json:"oauth_codes"`
+	// ExternalIdentities are keyed by externalIdentityKey
+	ExternalIdentities table[string, ExternalIdentity] `json:"external_identities"`
+}
+
+// Option configures a DB
+type Option func(*DB)
+
+// WithCompactInterval sets how often the write-ahead log is compacted,
+// intervals that aren't positive keep the default
+func WithCompactInterval(d time.Duration) Option {
+	return func(db *DB) {
+		if d > 0 {
+			db.compactInterval = d
+		}
+	}
+}
+
+// NewDB creates a new database connection,
+// creates the database file if it doesn't exist
+// and replays the write-ahead log on top of it
+func NewDB(path string, opts ...Option) (*DB, error) {
+	db := DB{
+		path:            path,
+		mu:              &sync.RWMutex{},
+		compactInterval: defaultCompactInterval,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	err := db.applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = db.ensureDB()
+	if err != nil {
+		return nil, err
+	}
+	dat, stale, err := db.readDBFile(db.path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseDocument(dat)
+	if err != nil {
+		return nil, err
+	}
+	wal, lsn, replayed, staleWAL, err := openWAL(db.path, doc, db.ring)
+	if err != nil {
+		return nil, err
+	}
+	db.wal, db.lsn, db.pending = wal, lsn, replayed
+	db.stale = stale || staleWAL
+	applied, err := doc.migrate()
+	if err == nil {
+		db.state, err = doc.decode()
+		db.idx = buildIndexes(&db.state)
+	}
+	if err == nil && (replayed > 0 || len(applied) > 0) {
+		err = db.snapshot()
+	}
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	for _, m := range applied {
+		log.Printf("database: applied migration %d: %s", m.Version, m.Description)
+	}
+	err = db.Update(func(dbs *DBStructure) error {
+		for _, issue := range repairIDs(dbs) {
+			log.Printf("database: %s", issue)
+		}
+		return nil
+	})
+	if err == nil {
+		// copies kept before the current key was configured
+		err = resealKeptFiles(db.path, db.ring)
+	}
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	go db.compactLoop()
+	return &db, nil
+}
+
+// applyOptions configures db and sets up its encryption keys
+func (db *DB) applyOptions(opts []Option) error {
+	for _, opt := range opts {
+		opt(db)
+	}
+	if len(db.keys) == 0 {
+		return nil
+	}
+	ring, err := newKeyring(db.keys[0], db.keys[1:]...)
+	if err != nil {
+		return err
+	}
+	db.ring = ring
+	return nil
 }
 
-type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+// Close stops background compaction, folds the log into the snapshot
+// and closes the log file
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.stop)
+		<-db.done
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.closeErr = db.compact()
+		if err := db.wal.Close(); db.closeErr == nil {
+			db.closeErr = err
+		}
+	})
+	return db.closeErr
 }
 
-type Chirp struct {
-	Id       int    `json:"id"`
-	AuthorId int    `json:"author_id"`
-	Body     string `json:"body"`
+// compactLoop compacts the log every compactInterval until Close is called
+func (db *DB) compactLoop() {
+	defer close(db.done)
+	ticker := time.NewTicker(db.compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.mu.Lock()
+			err := db.compact()
+			db.mu.Unlock()
+			if err != nil {
+				log.Printf("database: compaction failed: %s", err)
+			}
+		}
+	}
 }
 
-type RefreshToken struct {
-	Id        string    `json:"id"`
-	RevokedAt time.Time `json:"revoked_at"`
+// compact folds the log into the snapshot if it has any records
+// or if data on disk still has to be re-encrypted,
+// the caller must hold the write lock
+func (db *DB) compact() error {
+	if db.pending == 0 && !db.stale {
+		return nil
+	}
+	return db.snapshot()
 }
 
-// NewDB creates a new database connection
-// and creates the database file if it doesn't exist
-func NewDB(path string) (*DB, error) {
-	db := DB{path: path, mu: &sync.RWMutex{}}
-	err := db.ensureDB()
+// snapshot writes the in-memory state as the new snapshot and empties the log,
+// the copies kept next to the file are sealed again too if they were stale.
+// The caller must hold the write lock
+func (db *DB) snapshot() error {
+	db.state.Lsn = db.lsn
+	err := db.writeDB(db.state)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &db, nil
+	err = resetWAL(db.wal)
+	if err != nil {
+		return err
+	}
+	db.pending = 0
+	if db.stale {
+		err = resealKeptFiles(db.path, db.ring)
+		if err != nil {
+			return err
+		}
+	}
+	db.stale = false
+	return nil
 }
 
 // ensureDB creates a new database file if it doesn't exist
+// and recovers it from a kept generation if it is corrupt
 func (db *DB) ensureDB() error {
-	_, err := os.Stat(db.path)
-	if errors.Is(err, os.ErrNotExist) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	removeTempFiles(db.path)
+	dat, err := os.ReadFile(db.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		// the file may be fine, rolling it back over an I/O or permission error would lose data
+		return err
+	}
+	if err == nil {
+		var plain []byte
+		plain, _, err = db.ring.open(dat)
+		if err == nil {
+			_, err = decodeDB(plain)
+			if err == nil {
+				return nil
+			}
+		}
+		if errors.Is(err, ErrEncrypted) || errors.Is(err, errNewerSchema) {
+			return err
+		}
+		log.Printf("database: %s can't be decoded: %s", db.path, err)
+	} else if !hasGenerations(db.path) {
 		newDBStructure := DBStructure{
-			Users:         make(map[int]User),
-			Chirps:        make(map[int]Chirp),
-			RefreshTokens: make(map[string]RefreshToken),
+			SchemaVersion:      currentSchemaVersion,
+			Sequences:          newTable[string, int](),
+			Users:              newTable[int, User](),
+			Chirps:             newTable[int, Chirp](),
+			RefreshTokens:      newTable[string, RefreshToken](),
+			OneTimeTokens:      newTable[string, OneTimeToken](),
+			LoginThrottles:     newTable[string, LoginThrottle](),
+			PersonalTokens:     newTable[string, PersonalToken](),
+			OAuthClients:       newTable[string, OAuthClient](),
+			OAuthCodes:         newTable[string, OAuthCode](),
+			ExternalIdentities: newTable[string, ExternalIdentity](),
 		}
-		err := db.writeDB(newDBStructure)
-		return err
-	} else {
-		return err
+		return db.writeDB(newDBStructure)
 	}
+	return recoverFile(db.path, func(dat []byte) error {
+		plain, _, err := db.ring.open(dat)
+		if err != nil {
+			return err
+		}
+		_, err = decodeDB(plain)
+		return err
+	})
 }
 
-// writeDB writes the database file to disk
+// writeDB durably replaces the database file on disk,
+// the caller must hold the write lock
 func (db *DB) writeDB(dbStructure DBStructure) error {
 	dat, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
-	db.mu.Lock()
-	err = os.WriteFile(db.path, dat, 0666)
-	db.mu.Unlock()
-	return err
+	dat, err = db.ring.seal(dat)
+	if err != nil {
+		return err
+	}
+	err = keepGeneration(db.path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.path, dat)
+}
+
+// readDBFile reads and decrypts the database file,
+// stale reports that it is not sealed with the current key
+func (db *DB) readDBFile(path string) ([]byte, bool, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return db.ring.open(dat)
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
+// View runs fn against a consistent read-only view of the in-memory state,
+// fn must not modify the structure
+func (db *DB) View(fn func(*DBStructure) error) error {
 	db.mu.RLock()
-	dat, err := os.ReadFile(db.path)
-	db.mu.RUnlock()
+	defer db.mu.RUnlock()
+	return fn(&db.state)
+}
+
+// Update runs fn as a single transaction against the state, the rows it
+// changes are journaled and only those are appended to the write-ahead log,
+// nothing is changed if fn returns an error or the log can't be written.
+// Readers are locked out until then so they never see the changes early
+func (db *DB) Update(fn func(*DBStructure) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	beginTx(&db.state)
+	rollback := true
+	defer func() {
+		endTx(&db.state, rollback)
+	}()
+	err := fn(&db.state)
 	if err != nil {
-		return DBStructure{}, err
+		return err
 	}
-	dbs := DBStructure{}
-	err = json.Unmarshal(dat, &dbs)
+	ops, err := txOps(&db.state)
 	if err != nil {
-		return DBStructure{}, err
+		return err
 	}
-	return dbs, err
+	if len(ops) == 0 {
+		return nil
+	}
+	err = appendWAL(db.wal, walRecord{Lsn: db.lsn + 1, Ops: ops}, db.ring)
+	if err != nil {
+		return err
+	}
+	rollback = false
+	db.idx.update(&db.state)
+	db.lsn++
+	db.pending++
+	if db.pending >= compactThreshold || db.stale {
+		err := db.compact()
+		if err != nil {
+			log.Printf("database: compaction failed: %s", err)
+		}
+	}
+	return nil
 }
 
 // CreateUser creates a new user and saves it to disk
 func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-	newUser := User{
-		Id:          len(dbs.Users) + 1,
-		Email:       email,
-		Password:    password,
-		IsChirpyRed: false,
-	}
-	for _, v := range dbs.Users {
-		if newUser.Email == v.Email {
-			return User{}, errors.New("a user with this email already exists")
+	var newUser User
+	err := db.Update(func(dbs *DBStructure) error {
+		if _, ok := db.idx.emails[normalizeEmail(email)]; ok {
+			return ErrEmailTaken
 		}
-	}
-	dbs.Users[newUser.Id] = newUser
-	err = db.writeDB(dbs)
+		newUser = User{
+			Id:          nextID(dbs, "users"),
+			Email:       email,
+			Password:    password,
+			IsChirpyRed: false,
+			Role:        RoleUser,
+		}
+		dbs.Users.set(newUser.Id, newUser)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -120,60 +380,73 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 
 // GetUsers returns all users in the database
 func (db *DB) GetUsers() ([]User, error) {
-	dbs, err := db.loadDB()
+	var users []User
+	err := db.View(func(dbs *DBStructure) error {
+		users = make([]User, 0, len(dbs.Users.rows))
+		for _, v := range dbs.Users.rows {
+			users = append(users, v)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	users := make([]User, 0, len(dbs.Chirps))
-	for _, v := range dbs.Users {
-		users = append(users, v)
-	}
 	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
 	return users, nil
 }
 
 // GetUserByID returns a user with the specified ID
 func (db *DB) GetUserByID(id int) (User, error) {
-	dbs, err := db.loadDB()
+	var user User
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		user, ok = dbs.Users.rows[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	user, ok := dbs.Users[id]
-	if !ok {
-		return User{}, errors.New("no user with such id")
-	}
 	return user, nil
 }
 
-// GetUserByEmail returns a user with the specified email
+// GetUserByEmail returns a user with the specified email, ignoring case
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	dbs, err := db.loadDB()
+	var user User
+	err := db.View(func(dbs *DBStructure) error {
+		id, ok := db.idx.emails[normalizeEmail(email)]
+		if !ok {
+			return ErrEmailNotFound
+		}
+		user = dbs.Users.rows[id]
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	for _, user := range dbs.Users {
-		if user.Email == email {
-			return user, nil
-		}
-	}
-	return User{}, errors.New("no user with such email")
+	return user, nil
 }
 
 // UpdateUser updates the user with the specified id to contain the new email and password
 // returns the updated user
 func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-	updatedUser := User{
-		Id:          id,
-		Email:       email,
-		Password:    password,
-		IsChirpyRed: dbs.Users[id].IsChirpyRed,
-	}
-	dbs.Users[id] = updatedUser
-	err = db.writeDB(dbs)
+	var updatedUser User
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		updatedUser, ok = dbs.Users.rows[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if other, ok := db.idx.emails[normalizeEmail(email)]; ok && other != id {
+			return ErrEmailTaken
+		}
+		updatedUser.Email = email
+		updatedUser.Password = password
+		dbs.Users.set(id, updatedUser)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -183,37 +456,64 @@ func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
 // UpgradeUser sets the IsChirpyRed to true
 // returns the updated user
 func (db *DB) UpgradeUser(id int) (User, error) {
-	dbs, err := db.loadDB()
+	var upgradedUser User
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		upgradedUser, ok = dbs.Users.rows[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		upgradedUser.IsChirpyRed = true
+		dbs.Users.set(id, upgradedUser)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	upgradedUser := User{
-		Id:          id,
-		Email:       dbs.Users[id].Email,
-		Password:    dbs.Users[id].Password,
-		IsChirpyRed: true,
-	}
-	dbs.Users[id] = upgradedUser
-	err = db.writeDB(dbs)
+	return upgradedUser, nil
+}
+
+// ModifyUser applies fn to the user inside a transaction and saves the result,
+// nothing is saved if fn fails or the new email belongs to another user
+func (db *DB) ModifyUser(id int, fn func(user *User) error) (User, error) {
+	var modifiedUser User
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		modifiedUser, ok = dbs.Users.rows[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		// the state is cloned shallowly, fn must not write through to the old slice
+		modifiedUser.RecoveryCodes = slices.Clone(modifiedUser.RecoveryCodes)
+		err := fn(&modifiedUser)
+		if err != nil {
+			return err
+		}
+		modifiedUser.Id = id
+		if other, ok := db.idx.emails[normalizeEmail(modifiedUser.Email)]; ok && other != id {
+			return ErrEmailTaken
+		}
+		dbs.Users.set(id, modifiedUser)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	return upgradedUser, nil
+	return modifiedUser, nil
 }
 
 // CreateChirp creates a new chirp and saves it to disk
 func (db *DB) CreateChirp(body string, author_id int) (Chirp, error) {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-	newChirp := Chirp{
-		Id:       len(dbs.Chirps) + 1,
-		AuthorId: author_id,
-		Body:     body,
-	}
-	dbs.Chirps[newChirp.Id] = newChirp
-	err = db.writeDB(dbs)
+	var newChirp Chirp
+	err := db.Update(func(dbs *DBStructure) error {
+		newChirp = Chirp{
+			Id:       nextID(dbs, "chirps"),
+			AuthorId: author_id,
+			Body:     body,
+		}
+		dbs.Chirps.set(newChirp.Id, newChirp)
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -222,14 +522,17 @@ func (db *DB) CreateChirp(body string, author_id int) (Chirp, error) {
 
 // GetChirps returns all chirps in the database
 func (db *DB) GetChirps(sortInAscendingOrder bool) ([]Chirp, error) {
-	dbs, err := db.loadDB()
+	var chirps []Chirp
+	err := db.View(func(dbs *DBStructure) error {
+		chirps = make([]Chirp, 0, len(dbs.Chirps.rows))
+		for _, v := range dbs.Chirps.rows {
+			chirps = append(chirps, v)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	chirps := make([]Chirp, 0, len(dbs.Chirps))
-	for _, v := range dbs.Chirps {
-		chirps = append(chirps, v)
-	}
 	if sortInAscendingOrder {
 		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id < chirps[j].Id })
 	} else {
@@ -240,95 +543,599 @@ func (db *DB) GetChirps(sortInAscendingOrder bool) ([]Chirp, error) {
 
 // GetChirpsByAuthor returns all chirps with the specified author_id in the database
 func (db *DB) GetChirpsByAuthor(author_id int, sortInAscendingOrder bool) ([]Chirp, error) {
-	dbs, err := db.loadDB()
+	var chirps []Chirp
+	err := db.View(func(dbs *DBStructure) error {
+		ids := db.idx.timelines[author_id]
+		chirps = make([]Chirp, 0, len(ids))
+		for i := range ids {
+			if !sortInAscendingOrder {
+				i = len(ids) - 1 - i
+			}
+			chirps = append(chirps, dbs.Chirps.rows[ids[i]])
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	chirps := make([]Chirp, 0, len(dbs.Chirps))
-	for _, v := range dbs.Chirps {
-		if v.AuthorId == author_id {
-			chirps = append(chirps, v)
-		}
-	}
-	if sortInAscendingOrder {
-		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id < chirps[j].Id })
-	} else {
-		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id > chirps[j].Id })
-	}
 	return chirps, nil
 }
 
 // GetChirpByID returns a chirp with the specified id
 func (db *DB) GetChirpByID(id int) (Chirp, error) {
-	dbs, err := db.loadDB()
+	var chirp Chirp
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		chirp, ok = dbs.Chirps.rows[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
-	chirp, ok := dbs.Chirps[id]
-	if !ok {
-		return Chirp{}, errors.New("no chirp with such ID")
-	}
 	return chirp, nil
 }
 
 // DeleteChirp deletes a chirp
 func (db *DB) DeleteChirp(id int) (Chirp, error) {
-	dbs, err := db.loadDB()
+	var deletedChirp Chirp
+	err := db.Update(func(dbs *DBStructure) error {
+		deletedChirp = dbs.Chirps.rows[id]
+		dbs.Chirps.delete(id)
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
-	deletedChirp := dbs.Chirps[id]
-	delete(dbs.Chirps, id)
-	err = db.writeDB(dbs)
+	return deletedChirp, nil
+}
+
+// CreateToken stores the digest of a new refresh token
+// together with the metadata in token and saves it to disk
+func (db *DB) CreateToken(tokenStr string, token RefreshToken) (RefreshToken, error) {
+	newToken := newRefreshToken(tokenStr, token)
+	err := db.Update(func(dbs *DBStructure) error {
+		dbs.RefreshTokens.set(newToken.Id, newToken)
+		return nil
+	})
 	if err != nil {
-		return Chirp{}, err
+		return RefreshToken{}, err
 	}
-	return deletedChirp, nil
+	return newToken, nil
 }
 
-// CreateToken creates a new refresh token  and saves it to disk
-func (db *DB) CreateToken(tokenStr string) (RefreshToken, error) {
-	dbs, err := db.loadDB()
+// GetToken returns the refresh token record of tokenStr, looked up by digest
+func (db *DB) GetToken(tokenStr string) (RefreshToken, error) {
+	var token RefreshToken
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		token, ok = dbs.RefreshTokens.rows[HashToken(tokenStr)]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		return nil
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
-	newToken := RefreshToken{Id: tokenStr, RevokedAt: time.Time{}.UTC()}
-	dbs.RefreshTokens[newToken.Id] = newToken
-	err = db.writeDB(dbs)
+	return token, nil
+}
+
+// RevokeToken sets the revoked at time of tokenStr, looked up by digest
+func (db *DB) RevokeToken(tokenStr string) (RefreshToken, error) {
+	var token RefreshToken
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		token, ok = dbs.RefreshTokens.rows[HashToken(tokenStr)]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		token.RevokedAt = time.Now().UTC()
+		dbs.RefreshTokens.set(token.Id, token)
+		return nil
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
-	return newToken, nil
+	return token, nil
 }
 
-// GetToken returns a refresh token with the specified id
-func (db *DB) GetToken(tokenStr string) (RefreshToken, error) {
-	dbs, err := db.loadDB()
+// RotateToken revokes the token oldTokenStr in favour of newTokenStr,
+// which joins its family, presenting an already revoked token
+// revokes its whole family and returns ErrTokenReused
+func (db *DB) RotateToken(oldTokenStr string, newTokenStr string, token RefreshToken) (RefreshToken, error) {
+	var newToken RefreshToken
+	reused := false
+	err := db.Update(func(dbs *DBStructure) error {
+		oldToken, ok := dbs.RefreshTokens.rows[HashToken(oldTokenStr)]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		now := time.Now().UTC()
+		if !oldToken.RevokedAt.IsZero() {
+			reused = true
+			for id, member := range dbs.RefreshTokens.rows {
+				if member.FamilyId == oldToken.FamilyId && member.RevokedAt.IsZero() {
+					member.RevokedAt = now
+					dbs.RefreshTokens.set(id, member)
+				}
+			}
+			return nil
+		}
+		token.FamilyId = oldToken.FamilyId
+		token.UserId = oldToken.UserId
+		newToken = newRefreshToken(newTokenStr, token)
+		oldToken.RevokedAt = now
+		oldToken.ReplacedBy = newToken.Id
+		dbs.RefreshTokens.set(oldToken.Id, oldToken)
+		dbs.RefreshTokens.set(newToken.Id, newToken)
+		return nil
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
-	token, ok := dbs.RefreshTokens[tokenStr]
-	if !ok {
-		return RefreshToken{}, errors.New("no such token")
+	if reused {
+		return RefreshToken{}, ErrTokenReused
+	}
+	return newToken, nil
+}
+
+// GetTokensByUser returns every refresh token of the user, revoked ones included
+func (db *DB) GetTokensByUser(userID int) ([]RefreshToken, error) {
+	tokens := []RefreshToken{}
+	err := db.View(func(dbs *DBStructure) error {
+		for id := range db.idx.tokens[userID] {
+			tokens = append(tokens, dbs.RefreshTokens.rows[id])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+// RevokeTokenFamily revokes the active tokens of one family of the user,
+// it returns ErrTokenNotFound if the family has none
+func (db *DB) RevokeTokenFamily(userID int, familyID string) error {
+	return db.Update(func(dbs *DBStructure) error {
+		revoked := db.revokeUserTokens(dbs, userID, func(token RefreshToken) bool {
+			return token.FamilyId == familyID
+		})
+		if revoked == 0 {
+			return ErrTokenNotFound
+		}
+		return nil
+	})
+}
+
+// RevokeUserTokens revokes every active token of the user
+// and returns how many it revoked
+func (db *DB) RevokeUserTokens(userID int) (int, error) {
+	revoked := 0
+	err := db.Update(func(dbs *DBStructure) error {
+		revoked = db.revokeUserTokens(dbs, userID, func(RefreshToken) bool {
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// revokeUserTokens revokes the unrevoked tokens of the user that match
+// and returns how many it revoked, the caller must be inside Update
+func (db *DB) revokeUserTokens(dbs *DBStructure, userID int, match func(RefreshToken) bool) int {
+	now := time.Now().UTC()
+	revoked := 0
+	for id := range db.idx.tokens[userID] {
+		token := dbs.RefreshTokens.rows[id]
+		if !token.RevokedAt.IsZero() || !match(token) {
+			continue
+		}
+		token.RevokedAt = now
+		dbs.RefreshTokens.set(id, token)
+		revoked++
+	}
+	return revoked
+}
+
+// CreateOneTimeToken stores the digest of a new single-use token
+// together with the metadata in token and saves it to disk
+func (db *DB) CreateOneTimeToken(tokenStr string, token OneTimeToken) (OneTimeToken, error) {
+	newToken := newOneTimeToken(tokenStr, token)
+	err := db.Update(func(dbs *DBStructure) error {
+		dbs.OneTimeTokens.set(newToken.Id, newToken)
+		return nil
+	})
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	return newToken, nil
+}
+
+// UseOneTimeToken marks the token tokenStr issued for purpose as used
+// and returns it, a token can only be used once and before it expires
+func (db *DB) UseOneTimeToken(tokenStr string, purpose string) (OneTimeToken, error) {
+	var token OneTimeToken
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		token, ok = dbs.OneTimeTokens.rows[HashToken(tokenStr)]
+		if !ok || token.Purpose != purpose {
+			return ErrTokenNotFound
+		}
+		now := time.Now().UTC()
+		err := token.usable(now)
+		if err != nil {
+			return err
+		}
+		token.UsedAt = now
+		dbs.OneTimeTokens.set(token.Id, token)
+		return nil
+	})
+	if err != nil {
+		return OneTimeToken{}, err
 	}
 	return token, nil
 }
 
-// RevokeToken sets the revoked at time
-func (db *DB) RevokeToken(tokenStr string) (RefreshToken, error) {
-	dbs, err := db.loadDB()
+// PurgeTokens deletes tokens that expired before now and tokens
+// revoked or used before revokedBefore, rotated tokens are kept
+// until they expire so that their reuse is still detected
+func (db *DB) PurgeTokens(now time.Time, revokedBefore time.Time) (TokenPurge, error) {
+	var purge TokenPurge
+	err := db.Update(func(dbs *DBStructure) error {
+		purge = TokenPurge{}
+		for id, token := range dbs.OneTimeTokens.rows {
+			if token.ExpiresAt.Before(now) || (!token.UsedAt.IsZero() && token.UsedAt.Before(revokedBefore)) {
+				dbs.OneTimeTokens.delete(id)
+				purge.OneTime++
+			}
+		}
+		for id, code := range dbs.OAuthCodes.rows {
+			if code.ExpiresAt.Before(now) {
+				dbs.OAuthCodes.delete(id)
+				purge.OAuthCodes++
+			}
+		}
+		for id, token := range dbs.PersonalTokens.rows {
+			if !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(now) {
+				dbs.PersonalTokens.delete(id)
+				purge.Personal++
+			}
+		}
+		for id, token := range dbs.RefreshTokens.rows {
+			switch {
+			case !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(now):
+				purge.Expired++
+			case token.ReplacedBy == "" && !token.RevokedAt.IsZero() && token.RevokedAt.Before(revokedBefore):
+				purge.Revoked++
+			default:
+				continue
+			}
+			dbs.RefreshTokens.delete(id)
+		}
+		return nil
+	})
 	if err != nil {
-		return RefreshToken{}, err
+		return TokenPurge{}, err
 	}
-	token, ok := dbs.RefreshTokens[tokenStr]
-	if !ok {
-		return RefreshToken{}, errors.New("no such token")
+	return purge, nil
+}
+
+// CreatePersonalToken stores the digest of a new personal access token
+// together with the metadata in token and saves it to disk
+func (db *DB) CreatePersonalToken(tokenStr string, token PersonalToken) (PersonalToken, error) {
+	newToken := newPersonalToken(tokenStr, token)
+	err := db.Update(func(dbs *DBStructure) error {
+		dbs.PersonalTokens.set(newToken.Id, newToken)
+		return nil
+	})
+	if err != nil {
+		return PersonalToken{}, err
 	}
-	token.RevokedAt = time.Now().UTC()
-	dbs.RefreshTokens[tokenStr] = token
-	err = db.writeDB(dbs)
+	return newToken, nil
+}
+
+// GetPersonalToken returns the personal access token tokenStr, expired ones included
+func (db *DB) GetPersonalToken(tokenStr string) (PersonalToken, error) {
+	var token PersonalToken
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		token, ok = dbs.PersonalTokens.rows[HashToken(tokenStr)]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		return nil
+	})
 	if err != nil {
-		return RefreshToken{}, err
+		return PersonalToken{}, err
 	}
 	return token, nil
 }
+
+// GetPersonalTokensByUser returns the personal access tokens of the user, newest first
+func (db *DB) GetPersonalTokensByUser(userID int) ([]PersonalToken, error) {
+	tokens := []PersonalToken{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, token := range dbs.PersonalTokens.rows {
+			if token.UserId == userID {
+				tokens = append(tokens, token)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortPersonalTokens(tokens)
+	return tokens, nil
+}
+
+// TouchPersonalToken records that the token with the digest id was used at usedAt
+func (db *DB) TouchPersonalToken(id string, usedAt time.Time) error {
+	return db.Update(func(dbs *DBStructure) error {
+		token, ok := dbs.PersonalTokens.rows[id]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		token.LastUsedAt = usedAt
+		dbs.PersonalTokens.set(id, token)
+		return nil
+	})
+}
+
+// DeletePersonalToken deletes a personal access token of the user,
+// it returns ErrTokenNotFound if the user has no token with the digest id
+func (db *DB) DeletePersonalToken(userID int, id string) error {
+	return db.Update(func(dbs *DBStructure) error {
+		token, ok := dbs.PersonalTokens.rows[id]
+		if !ok || token.UserId != userID {
+			return ErrTokenNotFound
+		}
+		dbs.PersonalTokens.delete(id)
+		return nil
+	})
+}
+
+// DeletePersonalTokensByUser deletes every personal access token of the user
+// and returns how many it deleted
+func (db *DB) DeletePersonalTokensByUser(userID int) (int, error) {
+	deleted := 0
+	err := db.Update(func(dbs *DBStructure) error {
+		for id, token := range dbs.PersonalTokens.rows {
+			if token.UserId == userID {
+				dbs.PersonalTokens.delete(id)
+				deleted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// CreateOAuthClient stores a new OAuth client registration and saves it to disk
+func (db *DB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	newClient := newOAuthClient(client)
+	err := db.Update(func(dbs *DBStructure) error {
+		dbs.OAuthClients.set(newClient.Id, newClient)
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return newClient, nil
+}
+
+// GetOAuthClient returns the client with the client id id, or ErrClientNotFound
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	var client OAuthClient
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		client, ok = dbs.OAuthClients.rows[id]
+		if !ok {
+			return ErrClientNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return client, nil
+}
+
+// GetOAuthClientsByOwner returns the clients the user registered, newest first
+func (db *DB) GetOAuthClientsByOwner(ownerID int) ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, client := range dbs.OAuthClients.rows {
+			if client.OwnerId == ownerID {
+				clients = append(clients, client)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortOAuthClients(clients)
+	return clients, nil
+}
+
+// DeleteOAuthClient deletes a client the user registered,
+// it returns ErrClientNotFound if the user has no client with the client id id
+func (db *DB) DeleteOAuthClient(ownerID int, id string) error {
+	return db.Update(func(dbs *DBStructure) error {
+		client, ok := dbs.OAuthClients.rows[id]
+		if !ok || client.OwnerId != ownerID {
+			return ErrClientNotFound
+		}
+		dbs.OAuthClients.delete(id)
+		return nil
+	})
+}
+
+// CreateOAuthCode stores the digest of a new authorization code
+// together with the grant in code and saves it to disk
+func (db *DB) CreateOAuthCode(codeStr string, code OAuthCode) (OAuthCode, error) {
+	newCode := newOAuthCode(codeStr, code)
+	err := db.Update(func(dbs *DBStructure) error {
+		dbs.OAuthCodes.set(newCode.Id, newCode)
+		return nil
+	})
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	return newCode, nil
+}
+
+// UseOAuthCode marks the authorization code codeStr as exchanged for the
+// refresh token family familyID and returns it, a code can only be
+// exchanged once and before it expires, and only if check accepts it
+func (db *DB) UseOAuthCode(codeStr string, familyID string, check func(code OAuthCode) error) (OAuthCode, error) {
+	var code OAuthCode
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		code, ok = dbs.OAuthCodes.rows[HashToken(codeStr)]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		now := time.Now().UTC()
+		err := code.usable(now)
+		if err != nil {
+			return err
+		}
+		err = check(code)
+		if err != nil {
+			return err
+		}
+		code.UsedAt = now
+		code.FamilyId = familyID
+		dbs.OAuthCodes.set(code.Id, code)
+		return nil
+	})
+	if errors.Is(err, ErrTokenUsed) {
+		return code, err
+	}
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	return code, nil
+}
+
+// GetExternalIdentity returns the account subject at the identity provider
+// issuer is linked to, or ErrIdentityNotFound
+func (db *DB) GetExternalIdentity(issuer string, subject string) (ExternalIdentity, error) {
+	var identity ExternalIdentity
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		identity, ok = dbs.ExternalIdentities.rows[externalIdentityKey(issuer, subject)]
+		if !ok {
+			return ErrIdentityNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	return identity, nil
+}
+
+// SaveExternalIdentity links an account at an identity provider to a user,
+// or updates the link, keeping when it was made
+func (db *DB) SaveExternalIdentity(identity ExternalIdentity) (ExternalIdentity, error) {
+	err := db.Update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Users.rows[identity.UserId]; !ok {
+			return ErrUserNotFound
+		}
+		key := externalIdentityKey(identity.Issuer, identity.Subject)
+		if old, ok := dbs.ExternalIdentities.rows[key]; ok {
+			identity.CreatedAt = old.CreatedAt
+		} else if identity.CreatedAt.IsZero() {
+			identity.CreatedAt = time.Now().UTC()
+		}
+		dbs.ExternalIdentities.set(key, identity)
+		return nil
+	})
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	return identity, nil
+}
+
+// GetLoginThrottle returns the failed logins counted under key,
+// a key without failures has an empty record
+func (db *DB) GetLoginThrottle(key string) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		throttle, ok = dbs.LoginThrottles.rows[key]
+		if !ok {
+			throttle = LoginThrottle{Key: key}
+		}
+		return nil
+	})
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+	return throttle, nil
+}
+
+// ModifyLoginThrottle applies fn to the record of key inside a transaction and saves the result
+func (db *DB) ModifyLoginThrottle(key string, fn func(throttle *LoginThrottle) error) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := db.Update(func(dbs *DBStructure) error {
+		var ok bool
+		throttle, ok = dbs.LoginThrottles.rows[key]
+		if !ok {
+			throttle = LoginThrottle{Key: key}
+		}
+		err := fn(&throttle)
+		if err != nil {
+			return err
+		}
+		throttle.Key = key
+		dbs.LoginThrottles.set(key, throttle)
+		return nil
+	})
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+	return throttle, nil
+}
+
+// DeleteLoginThrottle forgets the failed logins counted under key
+func (db *DB) DeleteLoginThrottle(key string) error {
+	return db.Update(func(dbs *DBStructure) error {
+		dbs.LoginThrottles.delete(key)
+		return nil
+	})
+}
+
+// PurgeLoginThrottles deletes the records whose last failure
+// and lockout both ended before before and returns how many
+func (db *DB) PurgeLoginThrottles(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(dbs *DBStructure) error {
+		purged = 0
+		for key, throttle := range dbs.LoginThrottles.rows {
+			if throttle.LastFailedAt.Before(before) && throttle.LockedUntil.Before(before) {
+				dbs.LoginThrottles.delete(key)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
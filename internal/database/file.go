@@ -0,0 +1,156 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// dbGenerations is how many previous versions of the database file are kept
+// next to it as <path>.1 (newest) to <path>.N (oldest)
+const dbGenerations = 2
+
+// writeFileAtomic replaces path with data so that a crash leaves either
+// the old or the new contents on disk, never a partial file
+func writeFileAtomic(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes directory entries so a rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// generationPath returns the path of the n-th previous version of path
+func generationPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// keepGeneration shifts the kept versions by one
+// and saves the current file as the newest of them
+func keepGeneration(path string) error {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for n := dbGenerations; n > 1; n-- {
+		err := os.Rename(generationPath(path, n-1), generationPath(path, n))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	newest := generationPath(path, 1)
+	err = os.Link(path, newest)
+	if err != nil {
+		err = copyFile(path, newest)
+	}
+	return err
+}
+
+// copyFile copies src to dst and syncs it, used where hard links are not supported
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeTempFiles deletes leftovers of writes interrupted by a crash
+func removeTempFiles(path string) {
+	matches, err := filepath.Glob(path + ".tmp-*")
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		os.Remove(match)
+	}
+}
+
+// recoverFile is called when path is missing or can't be decoded,
+// it restores the newest kept version that decode accepts
+// and moves the broken file aside for inspection
+func recoverFile(path string, decode func([]byte) error) error {
+	for n := 1; n <= dbGenerations; n++ {
+		genPath := generationPath(path, n)
+		dat, err := os.ReadFile(genPath)
+		if err != nil {
+			continue
+		}
+		if err := decode(dat); err != nil {
+			log.Printf("database: skipping corrupt generation %s: %s", genPath, err)
+			continue
+		}
+		_, err = os.Stat(path)
+		if err == nil {
+			corruptPath := path + ".corrupt"
+			log.Printf("database: moving corrupt %s to %s", path, corruptPath)
+			err := os.Rename(path, corruptPath)
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("database: recovering %s from %s", path, genPath)
+		return writeFileAtomic(path, dat)
+	}
+	return fmt.Errorf("%s is corrupt and no good generation is left to recover from", path)
+}
+
+// hasGenerations reports whether any previous version of path is kept
+func hasGenerations(path string) bool {
+	for n := 1; n <= dbGenerations; n++ {
+		_, err := os.Stat(generationPath(path, n))
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
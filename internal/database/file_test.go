@@ -0,0 +1,65 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// databaseWithGeneration returns the path of a closed database whose
+// previous version is kept as a generation
+func databaseWithGeneration(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	_, err := db.CreateUser("a@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasGenerations(path) {
+		t.Fatal("closing the database kept no generation")
+	}
+	return path
+}
+
+func TestCorruptFileIsRecovered(t *testing.T) {
+	path := databaseWithGeneration(t)
+	err := os.WriteFile(path, []byte(`{"users": {`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, path)
+	defer db.Close()
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Fatalf("the corrupt file was not kept: %s", err)
+	}
+	if _, err := db.GetUsers(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnreadableFileIsNotRecovered(t *testing.T) {
+	path := databaseWithGeneration(t)
+	// reading a directory fails like an I/O error would, the data behind it may be intact
+	err := os.Rename(path, path+".moved")
+	if err == nil {
+		err = os.Mkdir(path, 0700)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDB(path)
+	if err == nil {
+		t.Fatal("a database that can't be read was opened")
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Fatalf("the unreadable file was replaced: %v", err)
+	}
+	if _, err := os.Stat(path + ".corrupt"); !os.IsNotExist(err) {
+		t.Fatalf("the unreadable file was moved aside: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+)
+
+// nextID advances the sequence of table and returns the new value,
+// ids are never reused even after the entry holding them is deleted
+func nextID(dbs *DBStructure, table string) int {
+	id := dbs.Sequences.rows[table] + 1
+	dbs.Sequences.set(table, id)
+	return id
+}
+
+// repairIDs fixes id problems left behind by older versions that
+// assigned len(map)+1 as the next id, and describes every fix it made
+func repairIDs(dbs *DBStructure) []string {
+	issues := []string{}
+
+	for key, user := range dbs.Users.rows {
+		if user.Id != key {
+			issues = append(issues, fmt.Sprintf("user stored under id %d claimed id %d, reset to %d", key, user.Id, key))
+			user.Id = key
+			dbs.Users.set(key, user)
+		}
+	}
+	for key, chirp := range dbs.Chirps.rows {
+		if chirp.Id != key {
+			issues = append(issues, fmt.Sprintf("chirp stored under id %d claimed id %d, reset to %d", key, chirp.Id, key))
+			chirp.Id = key
+			dbs.Chirps.set(key, chirp)
+		}
+	}
+
+	byEmail := make(map[string][]int)
+	for _, user := range dbs.Users.rows {
+		email := normalizeEmail(user.Email)
+		byEmail[email] = append(byEmail[email], user.Id)
+	}
+	for email, ids := range byEmail {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			issues = append(issues, fmt.Sprintf("users %v share the email %q and need manual review", ids, email))
+		}
+	}
+
+	issues = append(issues, repairSequence(dbs, "users", maxKey(dbs.Users.rows))...)
+	issues = append(issues, repairSequence(dbs, "chirps", maxKey(dbs.Chirps.rows))...)
+	sort.Strings(issues)
+	return issues
+}
+
+// repairSequence moves the sequence of table past the highest id in use
+func repairSequence(dbs *DBStructure, table string, highest int) []string {
+	seq, ok := dbs.Sequences.rows[table]
+	if ok && seq >= highest {
+		return nil
+	}
+	dbs.Sequences.set(table, highest)
+	if !ok {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s sequence was %d but id %d is in use, moved to %d", table, seq, highest, highest)}
+}
+
+func maxKey[V any](m map[int]V) int {
+	highest := 0
+	for k := range m {
+		highest = max(highest, k)
+	}
+	return highest
+}
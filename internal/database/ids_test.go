@@ -0,0 +1,24 @@
+package database
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRepairIDsReportsEmailsDifferingInCase(t *testing.T) {
+	dbs := DBStructure{
+		Users:     newTable[int, User](),
+		Chirps:    newTable[int, Chirp](),
+		Sequences: newTable[string, int](),
+	}
+	dbs.Users.set(1, User{Id: 1, Email: "a@x.com"})
+	dbs.Users.set(2, User{Id: 2, Email: " A@X.com"})
+	dbs.Users.set(3, User{Id: 3, Email: "b@x.com"})
+	dbs.Sequences.set("users", 3)
+
+	issues := repairIDs(&dbs)
+	want := []string{`users [1 2] share the email "a@x.com" and need manual review`}
+	if !slices.Equal(issues, want) {
+		t.Errorf("issues are %q, want %q", issues, want)
+	}
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// indexes are lookup tables derived from DBStructure,
+// they are never persisted and are rebuilt whenever the state is loaded
+type indexes struct {
+	// emails maps a lower-cased email to the id of its user
+	emails map[string]int
+	// timelines maps an author id to the ids of their chirps in ascending order
+	timelines map[int][]int
+	// tokens maps a user id to the ids of their refresh tokens
+	tokens map[int]map[string]struct{}
+}
+
+// normalizeEmail is the form emails are compared in
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// buildIndexes derives every index from dbs
+func buildIndexes(dbs *DBStructure) indexes {
+	idx := indexes{
+		emails:    make(map[string]int, len(dbs.Users.rows)),
+		timelines: make(map[int][]int),
+		tokens:    make(map[int]map[string]struct{}),
+	}
+	for id, user := range dbs.Users.rows {
+		email := normalizeEmail(user.Email)
+		if other, ok := idx.emails[email]; ok && other < id {
+			continue
+		}
+		idx.emails[email] = id
+	}
+	for id, chirp := range dbs.Chirps.rows {
+		idx.timelines[chirp.AuthorId] = append(idx.timelines[chirp.AuthorId], id)
+	}
+	for _, ids := range idx.timelines {
+		sort.Ints(ids)
+	}
+	for _, token := range dbs.RefreshTokens.rows {
+		idx.addToken(token)
+	}
+	return idx
+}
+
+// update brings the indexes in line with the rows changed
+// by the transaction that is being committed on dbs
+func (idx *indexes) update(dbs *DBStructure) {
+	for id, c := range dbs.Users.changes {
+		if c.existed {
+			idx.removeEmail(c.prev.Email, id)
+		}
+		if user, ok := dbs.Users.rows[id]; ok {
+			idx.emails[normalizeEmail(user.Email)] = id
+		}
+	}
+	for id, c := range dbs.Chirps.changes {
+		if c.existed {
+			idx.removeChirp(c.prev)
+		}
+		if chirp, ok := dbs.Chirps.rows[id]; ok {
+			idx.addChirp(chirp)
+		}
+	}
+	for id, c := range dbs.RefreshTokens.changes {
+		if c.existed {
+			idx.removeToken(c.prev)
+		}
+		if token, ok := dbs.RefreshTokens.rows[id]; ok {
+			idx.addToken(token)
+		}
+	}
+}
+
+func (idx *indexes) removeEmail(email string, id int) {
+	email = normalizeEmail(email)
+	if idx.emails[email] == id {
+		delete(idx.emails, email)
+	}
+}
+
+func (idx *indexes) addChirp(chirp Chirp) {
+	ids := idx.timelines[chirp.AuthorId]
+	i, found := slices.BinarySearch(ids, chirp.Id)
+	if !found {
+		idx.timelines[chirp.AuthorId] = slices.Insert(ids, i, chirp.Id)
+	}
+}
+
+func (idx *indexes) removeChirp(chirp Chirp) {
+	ids := idx.timelines[chirp.AuthorId]
+	i, found := slices.BinarySearch(ids, chirp.Id)
+	if !found {
+		return
+	}
+	ids = slices.Delete(ids, i, i+1)
+	if len(ids) == 0 {
+		delete(idx.timelines, chirp.AuthorId)
+		return
+	}
+	idx.timelines[chirp.AuthorId] = ids
+}
+
+func (idx *indexes) addToken(token RefreshToken) {
+	ids, ok := idx.tokens[token.UserId]
+	if !ok {
+		ids = make(map[string]struct{})
+		idx.tokens[token.UserId] = ids
+	}
+	ids[token.Id] = struct{}{}
+}
+
+func (idx *indexes) removeToken(token RefreshToken) {
+	ids := idx.tokens[token.UserId]
+	delete(ids, token.Id)
+	if len(ids) == 0 {
+		delete(idx.tokens, token.UserId)
+	}
+}
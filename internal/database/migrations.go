@@ -0,0 +1,426 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Migration upgrades a database file by exactly one schema version
+type Migration struct {
+	Version     int
+	Description string
+	apply       func(doc document) error
+}
+
+// migrations is the ordered registry of schema upgrades for the JSON store,
+// files written before schema_version existed are version 0
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "rename the refresh token table from revocations to refresh_tokens",
+		apply:       renameTable("revocations", "refresh_tokens"),
+	},
+	{
+		Version:     2,
+		Description: "store refresh tokens as SHA-256 digests with user and expiry",
+		apply:       hashRefreshTokens,
+	},
+	{
+		Version:     3,
+		Description: "start a refresh token family for every existing refresh token",
+		apply:       startTokenFamilies,
+	},
+	{
+		Version:     4,
+		Description: "add the one_time_tokens table",
+		apply:       createTable("one_time_tokens"),
+	},
+	{
+		Version:     5,
+		Description: "add the login_throttles table",
+		apply:       createTable("login_throttles"),
+	},
+	{
+		Version:     6,
+		Description: "give every user a role",
+		apply:       assignUserRoles,
+	},
+	{
+		Version:     7,
+		Description: "add the personal_tokens table",
+		apply:       createTable("personal_tokens"),
+	},
+	{
+		Version:     8,
+		Description: "add the oauth_clients and oauth_codes tables",
+		apply:       createTable("oauth_clients", "oauth_codes"),
+	},
+	{
+		Version:     9,
+		Description: "add the external_identities table",
+		apply:       createTable("external_identities"),
+	},
+	{
+		Version:     10,
+		Description: "mark the emails of users registered before email verification as verified",
+		apply:       verifyExistingEmails,
+	},
+}
+
+// currentSchemaVersion is the version written by this build
+var currentSchemaVersion = len(migrations)
+
+var errNewerSchema = errors.New("database schema is newer than this build supports")
+
+// document is a database file decoded only one level deep,
+// migrations and log replay work on it before it is turned into a DBStructure
+type document map[string]json.RawMessage
+
+// legacyTableKeys maps log table names to the keys used by version 0 files
+var legacyTableKeys = map[string]string{"refresh_tokens": "revocations"}
+
+func parseDocument(dat []byte) (document, error) {
+	doc := document{}
+	err := json.Unmarshal(dat, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.New("database file is empty")
+	}
+	version, err := doc.version()
+	if err != nil {
+		return nil, err
+	}
+	if version > currentSchemaVersion {
+		return nil, fmt.Errorf("%w: version %d, supported %d", errNewerSchema, version, currentSchemaVersion)
+	}
+	return doc, nil
+}
+
+func (doc document) version() (int, error) {
+	raw, ok := doc["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	err := json.Unmarshal(raw, &version)
+	return version, err
+}
+
+func (doc document) lsn() (int64, error) {
+	raw, ok := doc["lsn"]
+	if !ok {
+		return 0, nil
+	}
+	var lsn int64
+	err := json.Unmarshal(raw, &lsn)
+	return lsn, err
+}
+
+// table decodes the entries of the table stored under key
+func (doc document) table(key string) (map[string]json.RawMessage, error) {
+	entries := map[string]json.RawMessage{}
+	raw, ok := doc[key]
+	if !ok {
+		return entries, nil
+	}
+	err := json.Unmarshal(raw, &entries)
+	if entries == nil {
+		entries = map[string]json.RawMessage{}
+	}
+	return entries, err
+}
+
+func (doc document) setTable(key string, entries map[string]json.RawMessage) error {
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	doc[key] = raw
+	return nil
+}
+
+// applyRecord patches the document with every operation of rec
+func (doc document) applyRecord(rec walRecord) error {
+	version, err := doc.version()
+	if err != nil {
+		return err
+	}
+	for _, op := range rec.Ops {
+		key := op.Table
+		if legacy, ok := legacyTableKeys[key]; ok && version == 0 {
+			key = legacy
+		}
+		entries, err := doc.table(key)
+		if err != nil {
+			return err
+		}
+		if op.Delete {
+			delete(entries, op.Key)
+		} else {
+			entries[op.Key] = op.Value
+		}
+		err = doc.setTable(key, entries)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingMigrations returns the migrations the document still needs
+func (doc document) pendingMigrations() ([]Migration, error) {
+	version, err := doc.version()
+	if err != nil {
+		return nil, err
+	}
+	return migrations[version:], nil
+}
+
+// migrate runs every pending migration in order and returns the ones applied
+func (doc document) migrate() ([]Migration, error) {
+	pending, err := doc.pendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range pending {
+		err := m.apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		doc["schema_version"] = json.RawMessage(fmt.Sprint(m.Version))
+	}
+	return pending, nil
+}
+
+// decode turns a fully migrated document into a DBStructure
+func (doc document) decode() (DBStructure, error) {
+	dat, err := json.Marshal(doc)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	dbs := DBStructure{}
+	err = json.Unmarshal(dat, &dbs)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	if dbs.Users.rows == nil || dbs.Chirps.rows == nil || dbs.RefreshTokens.rows == nil || dbs.OneTimeTokens.rows == nil ||
+		dbs.LoginThrottles.rows == nil || dbs.PersonalTokens.rows == nil || dbs.OAuthClients.rows == nil || dbs.OAuthCodes.rows == nil ||
+		dbs.ExternalIdentities.rows == nil {
+		return DBStructure{}, errors.New("database file is missing tables")
+	}
+	if dbs.Sequences.rows == nil {
+		dbs.Sequences = newTable[string, int]()
+	}
+	return dbs, nil
+}
+
+// decodeDB parses, migrates and decodes the contents of a database file
+func decodeDB(dat []byte) (DBStructure, error) {
+	doc, err := parseDocument(dat)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	_, err = doc.migrate()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return doc.decode()
+}
+
+// renameTable moves a table to a new key
+func renameTable(from string, to string) func(doc document) error {
+	return func(doc document) error {
+		raw, ok := doc[from]
+		if !ok {
+			return nil
+		}
+		if _, exists := doc[to]; exists {
+			return fmt.Errorf("both %s and %s exist", from, to)
+		}
+		doc[to] = raw
+		delete(doc, from)
+		return nil
+	}
+}
+
+// createTable adds empty tables unless log replay already created them
+func createTable(names ...string) func(doc document) error {
+	return func(doc document) error {
+		for _, name := range names {
+			if _, exists := doc[name]; exists {
+				continue
+			}
+			err := doc.setTable(name, map[string]json.RawMessage{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// hashRefreshTokens rekeys refresh tokens stored as raw JWTs by their digest
+// and copies the user and times out of the unverified claims,
+// keys that are not JWTs could never be presented again and are dropped
+func hashRefreshTokens(doc document) error {
+	tokens, err := doc.table("refresh_tokens")
+	if err != nil {
+		return err
+	}
+	hashed := make(map[string]json.RawMessage, len(tokens))
+	for tokenStr, raw := range tokens {
+		old := struct {
+			RevokedAt time.Time `json:"revoked_at"`
+		}{}
+		err := json.Unmarshal(raw, &old)
+		if err != nil {
+			return err
+		}
+		token, err := legacyRefreshToken(tokenStr)
+		if err != nil {
+			continue
+		}
+		token.RevokedAt = old.RevokedAt
+		hashed[token.Id], err = json.Marshal(token)
+		if err != nil {
+			return err
+		}
+	}
+	return doc.setTable("refresh_tokens", hashed)
+}
+
+// legacyRefreshToken builds the record of a refresh token that used to be
+// stored in full, its signature was checked when it was issued
+func legacyRefreshToken(tokenStr string) (RefreshToken, error) {
+	claims := jwt.RegisteredClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(tokenStr, &claims)
+	if err != nil {
+		return RefreshToken{}, fmt.Errorf("refresh token %s: %w", HashToken(tokenStr), err)
+	}
+	token := RefreshToken{Id: HashToken(tokenStr)}
+	token.UserId, err = strconv.Atoi(claims.Subject)
+	if err != nil {
+		return RefreshToken{}, fmt.Errorf("refresh token %s: %w", token.Id, err)
+	}
+	if claims.IssuedAt != nil {
+		token.IssuedAt = claims.IssuedAt.UTC()
+	}
+	if claims.ExpiresAt != nil {
+		token.ExpiresAt = claims.ExpiresAt.UTC()
+	}
+	return token, nil
+}
+
+// startTokenFamilies makes every refresh token the first of its own family
+func startTokenFamilies(doc document) error {
+	tokens, err := doc.table("refresh_tokens")
+	if err != nil {
+		return err
+	}
+	for id, raw := range tokens {
+		token := RefreshToken{}
+		err := json.Unmarshal(raw, &token)
+		if err != nil {
+			return err
+		}
+		token.FamilyId = id
+		tokens[id], err = json.Marshal(token)
+		if err != nil {
+			return err
+		}
+	}
+	return doc.setTable("refresh_tokens", tokens)
+}
+
+// assignUserRoles gives users without a role the user role
+func assignUserRoles(doc document) error {
+	users, err := doc.table("users")
+	if err != nil {
+		return err
+	}
+	for id, raw := range users {
+		fields := map[string]json.RawMessage{}
+		err := json.Unmarshal(raw, &fields)
+		if err != nil {
+			return err
+		}
+		if _, ok := fields["role"]; ok {
+			continue
+		}
+		fields["role"], err = json.Marshal(RoleUser)
+		if err != nil {
+			return err
+		}
+		users[id], err = json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+	}
+	return doc.setTable("users", users)
+}
+
+// verifyExistingEmails marks users without an email_verified field as verified,
+// they registered before email verification existed and never had a way to prove
+// their address, users registered since keep what they proved
+func verifyExistingEmails(doc document) error {
+	users, err := doc.table("users")
+	if err != nil {
+		return err
+	}
+	for id, raw := range users {
+		fields := map[string]json.RawMessage{}
+		err := json.Unmarshal(raw, &fields)
+		if err != nil {
+			return err
+		}
+		if _, ok := fields["email_verified"]; ok {
+			continue
+		}
+		fields["email_verified"] = json.RawMessage("true")
+		users[id], err = json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+	}
+	return doc.setTable("users", users)
+}
+
+// PendingMigration describes a schema upgrade that has not been applied yet
+type PendingMigration struct {
+	Version     int
+	Description string
+}
+
+// PendingMigrations reports the migrations NewDB would run on the database file at path
+// without changing anything on disk, opts must carry the encryption keys if any
+func PendingMigrations(path string, opts ...Option) ([]PendingMigration, error) {
+	db := DB{}
+	err := db.applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	dat, _, err := db.readDBFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseDocument(dat)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := doc.pendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]PendingMigration, 0, len(pending))
+	for _, m := range pending {
+		steps = append(steps, PendingMigration{Version: m.Version, Description: m.Description})
+	}
+	return steps, nil
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyJWT signs a refresh token like the ones version 0 files stored in full
+func legacyJWT(t *testing.T, subject string, expiresAt time.Time) string {
+	t.Helper()
+	tokenStr, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   subject,
+		IssuedAt:  jwt.NewNumericDate(expiresAt.Add(-time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenStr
+}
+
+func mustParseDocument(t *testing.T, dat string) document {
+	t.Helper()
+	doc := document{}
+	err := json.Unmarshal([]byte(dat), &doc)
+	if err != nil {
+		t.Fatalf("parsing %s: %s", dat, err)
+	}
+	return doc
+}
+
+// tableEntry decodes one entry of a table of doc into v
+func tableEntry(t *testing.T, doc document, table string, key string, v any) {
+	t.Helper()
+	entries, err := doc.table(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, ok := entries[key]
+	if !ok {
+		t.Fatalf("%s has no entry %s", table, key)
+	}
+	err = json.Unmarshal(raw, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationSteps(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	tokenStr := legacyJWT(t, "1", expires)
+	tests := map[int]struct {
+		before string
+		check  func(t *testing.T, doc document)
+	}{
+		1: {
+			before: `{"revocations": {"a": {}}}`,
+			check: func(t *testing.T, doc document) {
+				if _, ok := doc["revocations"]; ok {
+					t.Error("revocations is still there")
+				}
+				tableEntry(t, doc, "refresh_tokens", "a", &struct{}{})
+			},
+		},
+		2: {
+			before: `{"refresh_tokens": {"` + tokenStr + `": {"revoked_at": "2024-01-02T03:04:05Z"}, "not-a-jwt": {}}}`,
+			check: func(t *testing.T, doc document) {
+				tokens, _ := doc.table("refresh_tokens")
+				if len(tokens) != 1 {
+					t.Fatalf("refresh_tokens has %d entries, want only the JWT", len(tokens))
+				}
+				token := RefreshToken{}
+				tableEntry(t, doc, "refresh_tokens", HashToken(tokenStr), &token)
+				if token.Id != HashToken(tokenStr) || token.UserId != 1 || !token.ExpiresAt.Equal(expires) ||
+					token.RevokedAt.IsZero() {
+					t.Errorf("hashed token is %+v", token)
+				}
+			},
+		},
+		3: {
+			before: `{"refresh_tokens": {"abc": {"id": "abc", "user_id": 1}}}`,
+			check: func(t *testing.T, doc document) {
+				token := RefreshToken{}
+				tableEntry(t, doc, "refresh_tokens", "abc", &token)
+				if token.FamilyId != "abc" {
+					t.Errorf("family of the token is %q, want its own id", token.FamilyId)
+				}
+			},
+		},
+		4: {
+			before: `{}`,
+			check: func(t *testing.T, doc document) {
+				if _, ok := doc["one_time_tokens"]; !ok {
+					t.Error("one_time_tokens was not added")
+				}
+			},
+		},
+		5: {
+			// log replay may have created the table already
+			before: `{"login_throttles": {"ip:1": {"failures": 2}}}`,
+			check: func(t *testing.T, doc document) {
+				throttle := LoginThrottle{}
+				tableEntry(t, doc, "login_throttles", "ip:1", &throttle)
+				if throttle.Failures != 2 {
+					t.Errorf("replayed throttle is %+v", throttle)
+				}
+			},
+		},
+		6: {
+			before: `{"users": {"1": {"id": 1}, "2": {"id": 2, "role": "admin"}}}`,
+			check: func(t *testing.T, doc document) {
+				for key, role := range map[string]string{"1": RoleUser, "2": RoleAdmin} {
+					user := User{}
+					tableEntry(t, doc, "users", key, &user)
+					if user.Role != role {
+						t.Errorf("user %s has role %q, want %q", key, user.Role, role)
+					}
+				}
+			},
+		},
+		7: {
+			before: `{}`,
+			check: func(t *testing.T, doc document) {
+				if _, ok := doc["personal_tokens"]; !ok {
+					t.Error("personal_tokens was not added")
+				}
+			},
+		},
+		8: {
+			before: `{}`,
+			check: func(t *testing.T, doc document) {
+				for _, name := range []string{"oauth_clients", "oauth_codes"} {
+					if _, ok := doc[name]; !ok {
+						t.Errorf("%s was not added", name)
+					}
+				}
+			},
+		},
+		9: {
+			before: `{}`,
+			check: func(t *testing.T, doc document) {
+				if _, ok := doc["external_identities"]; !ok {
+					t.Error("external_identities was not added")
+				}
+			},
+		},
+		10: {
+			// user 2 signed up after email verification was added and never verified
+			before: `{"users": {"1": {"id": 1, "email": "a@x.com"}, "2": {"id": 2, "email_verified": false}}}`,
+			check: func(t *testing.T, doc document) {
+				for key, verified := range map[string]bool{"1": true, "2": false} {
+					user := User{}
+					tableEntry(t, doc, "users", key, &user)
+					if user.EmailVerified != verified {
+						t.Errorf("user %s has email_verified %v, want %v", key, user.EmailVerified, verified)
+					}
+				}
+				user := User{}
+				tableEntry(t, doc, "users", "1", &user)
+				if user.Email != "a@x.com" {
+					t.Errorf("the other fields of user 1 changed: %+v", user)
+				}
+			},
+		},
+	}
+
+	for _, m := range migrations {
+		test, ok := tests[m.Version]
+		if !ok {
+			t.Errorf("migration %d (%s) has no test", m.Version, m.Description)
+			continue
+		}
+		t.Run(m.Description, func(t *testing.T) {
+			doc := mustParseDocument(t, test.before)
+			err := m.apply(doc)
+			if err != nil {
+				t.Fatalf("migration %d: %s", m.Version, err)
+			}
+			test.check(t, doc)
+		})
+	}
+}
+
+func TestRenameTableRefusesToOverwrite(t *testing.T) {
+	doc := mustParseDocument(t, `{"revocations": {}, "refresh_tokens": {}}`)
+	err := renameTable("revocations", "refresh_tokens")(doc)
+	if err == nil {
+		t.Fatal("renaming onto an existing table succeeded")
+	}
+}
+
+func TestOpenVersion0File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	tokenStr := legacyJWT(t, "1", time.Now().Add(time.Hour))
+	err := os.WriteFile(path, []byte(`{
+		"users": {"1": {"id": 1, "email": "a@x.com", "password": "hash", "is_chirpy_red": false}},
+		"chirps": {"1": {"id": 1, "author_id": 1, "body": "hello"}},
+		"revocations": {"`+tokenStr+`": {"id": "`+tokenStr+`", "revoked_at": "0001-01-01T00:00:00Z"}}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := PendingMigrations(path)
+	if err != nil || len(pending) != len(migrations) {
+		t.Fatalf("pending migrations are %+v (%v), want all %d", pending, err, len(migrations))
+	}
+
+	db := openTestDB(t, path)
+	defer db.Close()
+	user, err := db.GetUserByEmail("A@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleUser || !user.EmailVerified {
+		t.Fatalf("migrated user is %+v", user)
+	}
+	token, err := db.GetToken(tokenStr)
+	if err != nil || token.UserId != 1 || token.FamilyId != token.Id {
+		t.Fatalf("migrated token is %+v (%v)", token, err)
+	}
+	// ids continue after the existing rows
+	chirp, err := db.CreateChirp("again", user.Id)
+	if err != nil || chirp.Id != 2 {
+		t.Fatalf("new chirp is %+v (%v), want id 2", chirp, err)
+	}
+	_, err = db.CreatePersonalToken("pat", PersonalToken{UserId: user.Id, Name: "pat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err = PendingMigrations(path)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("pending migrations after opening are %+v (%v)", pending, err)
+	}
+}
+
+func TestNewerSchemaIsRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(`{"schema_version": 999}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDB(path)
+	if !errors.Is(err, errNewerSchema) {
+		t.Fatalf("NewDB returned %v, want errNewerSchema", err)
+	}
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Snapshot writes a consistent copy of the database to w,
+// the copy is a complete database file that Restore accepts
+// and is encrypted like the database file itself
+func (db *DB) Snapshot(w io.Writer) error {
+	db.mu.RLock()
+	dbs := db.state
+	dbs.Lsn = db.lsn
+	dat, err := json.Marshal(dbs)
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	dat, err = db.ring.seal(dat)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(dat)
+	return err
+}
+
+// Restore validates the snapshot read from r and, only if it is sound,
+// replaces the whole database with it. The snapshot is written to disk first
+// and only then served, so a failed write leaves the database as it was
+func (db *DB) Restore(r io.Reader) error {
+	dat, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dat, _, err = db.ring.open(dat)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	restored, err := validateSnapshot(dat)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// the log is older than the restored file, keeping the lsn makes replay skip it
+	// even if it can't be emptied below
+	restored.Lsn = db.lsn
+	err = db.writeDB(restored)
+	if err != nil {
+		return err
+	}
+	db.state = restored
+	db.idx = buildIndexes(&db.state)
+	db.pending = 0
+	db.stale = false
+	return resetWAL(db.wal)
+}
+
+// validateSnapshot decodes and migrates a snapshot
+// and rejects it if it has any integrity problem
+func validateSnapshot(dat []byte) (DBStructure, error) {
+	dbs, err := decodeDB(dat)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	problems := repairIDs(&dbs)
+	for id, chirp := range dbs.Chirps.rows {
+		if _, ok := dbs.Users.rows[chirp.AuthorId]; !ok {
+			problems = append(problems, fmt.Sprintf("chirp %d belongs to missing user %d", id, chirp.AuthorId))
+		}
+	}
+	if len(problems) > 0 {
+		return DBStructure{}, fmt.Errorf("%w: %s", ErrInvalidSnapshot, strings.Join(problems, "; "))
+	}
+	return dbs, nil
+}
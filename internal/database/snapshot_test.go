@@ -0,0 +1,104 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	defer db.Close()
+	user, err := db.CreateUser("a@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("kept", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := bytes.Buffer{}
+	err = db.Snapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("dropped by the restore", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Restore(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := db.GetChirpsByAuthor(user.Id, true)
+	if err != nil || len(chirps) != 1 || chirps[0].Body != "kept" {
+		t.Fatalf("chirps after restore are %+v (%v)", chirps, err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := openTestDB(t, path)
+	defer reopened.Close()
+	chirps, err = reopened.GetChirps(true)
+	if err != nil || len(chirps) != 1 {
+		t.Fatalf("chirps after reopening are %+v (%v)", chirps, err)
+	}
+}
+
+func TestRestoreRejectsInvalidSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	defer db.Close()
+	for name, snapshot := range map[string]string{
+		"not json":       "{",
+		"missing tables": `{"schema_version": 9}`,
+		"orphaned chirp": `{"schema_version": 9, "users": {}, "chirps": {"1": {"id": 1, "author_id": 7}},
+			"refresh_tokens": {}, "one_time_tokens": {}, "login_throttles": {}, "personal_tokens": {},
+			"oauth_clients": {}, "oauth_codes": {}, "external_identities": {}}`,
+	} {
+		err := db.Restore(strings.NewReader(snapshot))
+		if !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("%s: Restore returned %v, want ErrInvalidSnapshot", name, err)
+		}
+	}
+}
+
+func TestFailedRestoreKeepsState(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, filepath.Join(dir, "database.json"))
+	snapshot := bytes.Buffer{}
+	err := db.Snapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser("a@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the database file can't be written in a directory that doesn't exist
+	path := db.path
+	db.path = filepath.Join(dir, "missing", "database.json")
+	err = db.Restore(bytes.NewReader(snapshot.Bytes()))
+	db.path = path
+	if err == nil {
+		t.Fatal("Restore succeeded without writing the database file")
+	}
+	if _, err := db.GetUserByEmail("a@x.com"); err != nil {
+		t.Fatalf("a failed restore changed the served state: %s", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := openTestDB(t, path)
+	defer reopened.Close()
+	if _, err := reopened.GetUserByEmail("a@x.com"); err != nil {
+		t.Fatalf("a failed restore changed the database file: %s", err)
+	}
+}
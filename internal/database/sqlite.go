@@ -0,0 +1,1373 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var _ Store = (*SQLiteDB)(nil)
+
+// SQLiteDB is a Store backed by a SQLite database file
+type SQLiteDB struct {
+	sql *sql.DB
+}
+
+// sqliteMigration upgrades the schema by exactly one version
+type sqliteMigration struct {
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// sqliteMigrations is the ordered list of schema upgrades,
+// the schema version is the number of migrations applied
+var sqliteMigrations = []sqliteMigration{
+	{
+		description: "create users, chirps and refresh_tokens",
+		up: execSQL(
+			`CREATE TABLE users (
+				id            INTEGER PRIMARY KEY AUTOINCREMENT,
+				email         TEXT    NOT NULL UNIQUE,
+				password      TEXT    NOT NULL,
+				is_chirpy_red INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE chirps (
+				id        INTEGER PRIMARY KEY AUTOINCREMENT,
+				author_id INTEGER NOT NULL,
+				body      TEXT    NOT NULL
+			)`,
+			`CREATE TABLE refresh_tokens (
+				id         TEXT PRIMARY KEY,
+				revoked_at INTEGER
+			)`,
+		),
+	},
+	{
+		description: "index users by case-insensitive email and chirps by author",
+		up: execSQL(
+			`CREATE INDEX users_email_nocase ON users (email COLLATE NOCASE)`,
+			`CREATE INDEX chirps_author ON chirps (author_id, id)`,
+		),
+	},
+	{
+		description: "store refresh tokens as SHA-256 digests with user and expiry",
+		up:          hashSQLiteRefreshTokens,
+	},
+	{
+		description: "start a refresh token family for every existing refresh token",
+		up: execSQL(
+			`ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE refresh_tokens ADD COLUMN replaced_by TEXT NOT NULL DEFAULT ''`,
+			`UPDATE refresh_tokens SET family_id = id`,
+			`CREATE INDEX refresh_tokens_family ON refresh_tokens (family_id)`,
+		),
+	},
+	{
+		description: "add the one_time_tokens table",
+		up: execSQL(
+			`CREATE TABLE one_time_tokens (
+				id         TEXT    PRIMARY KEY,
+				purpose    TEXT    NOT NULL,
+				user_id    INTEGER NOT NULL,
+				created_at INTEGER,
+				expires_at INTEGER,
+				used_at    INTEGER
+			)`,
+		),
+	},
+	{
+		description: "track email verification of users",
+		up: execSQL(
+			`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0`,
+			// users registered until now never had a way to prove their address
+			`UPDATE users SET email_verified = 1`,
+			`ALTER TABLE users ADD COLUMN pending_email TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE one_time_tokens ADD COLUMN email TEXT NOT NULL DEFAULT ''`,
+		),
+	},
+	{
+		description: "add two-factor authentication to users",
+		up: execSQL(
+			`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '[]'`,
+		),
+	},
+	{
+		description: "add the login_throttles table",
+		up: execSQL(
+			`CREATE TABLE login_throttles (
+				key            TEXT    PRIMARY KEY,
+				failures       INTEGER NOT NULL,
+				last_failed_at INTEGER,
+				lockouts       INTEGER NOT NULL,
+				locked_until   INTEGER
+			)`,
+		),
+	},
+	{
+		description: "give every user a role",
+		up: execSQL(
+			`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'`,
+		),
+	},
+	{
+		description: "add the personal_tokens table",
+		up: execSQL(
+			`CREATE TABLE personal_tokens (
+				id           TEXT    PRIMARY KEY,
+				user_id      INTEGER NOT NULL,
+				name         TEXT    NOT NULL,
+				scopes       TEXT    NOT NULL,
+				expires_at   INTEGER,
+				created_at   INTEGER,
+				last_used_at INTEGER
+			)`,
+			`CREATE INDEX personal_tokens_user ON personal_tokens (user_id)`,
+		),
+	},
+	{
+		description: "add the oauth_clients and oauth_codes tables",
+		up: execSQL(
+			`CREATE TABLE oauth_clients (
+				id            TEXT    PRIMARY KEY,
+				secret_hash   TEXT    NOT NULL,
+				owner_id      INTEGER NOT NULL,
+				name          TEXT    NOT NULL,
+				redirect_uris TEXT    NOT NULL,
+				scopes        TEXT    NOT NULL,
+				created_at    INTEGER
+			)`,
+			`CREATE INDEX oauth_clients_owner ON oauth_clients (owner_id)`,
+			`CREATE TABLE oauth_codes (
+				id             TEXT    PRIMARY KEY,
+				client_id      TEXT    NOT NULL,
+				user_id        INTEGER NOT NULL,
+				redirect_uri   TEXT    NOT NULL,
+				scopes         TEXT    NOT NULL,
+				code_challenge TEXT    NOT NULL,
+				created_at     INTEGER,
+				expires_at     INTEGER,
+				used_at        INTEGER,
+				family_id      TEXT    NOT NULL DEFAULT ''
+			)`,
+		),
+	},
+	{
+		description: "add the external_identities table",
+		up: execSQL(
+			`CREATE TABLE external_identities (
+				issuer        TEXT    NOT NULL,
+				subject       TEXT    NOT NULL,
+				user_id       INTEGER NOT NULL,
+				email         TEXT    NOT NULL,
+				created_at    INTEGER,
+				last_login_at INTEGER,
+				PRIMARY KEY (issuer, subject)
+			)`,
+			`CREATE INDEX external_identities_user ON external_identities (user_id)`,
+		),
+	},
+	{
+		description: "enforce unique emails in the form the JSON store compares them in",
+		up:          addSQLiteEmailKeys,
+	},
+}
+
+// execSQL returns a migration step that runs the statements in order
+func execSQL(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// hashSQLiteRefreshTokens rebuilds refresh_tokens keyed by token digest,
+// the user and times of existing tokens are read from their claims
+func hashSQLiteRefreshTokens(tx *sql.Tx) error {
+	err := execSQL(
+		`ALTER TABLE refresh_tokens RENAME TO refresh_tokens_legacy`,
+		`CREATE TABLE refresh_tokens (
+			id         TEXT    PRIMARY KEY,
+			user_id    INTEGER NOT NULL,
+			issued_at  INTEGER,
+			expires_at INTEGER,
+			user_agent TEXT    NOT NULL DEFAULT '',
+			ip         TEXT    NOT NULL DEFAULT '',
+			revoked_at INTEGER
+		)`,
+		`CREATE INDEX refresh_tokens_user ON refresh_tokens (user_id)`,
+	)(tx)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT id, revoked_at FROM refresh_tokens_legacy`)
+	if err != nil {
+		return err
+	}
+	tokens := []RefreshToken{}
+	for rows.Next() {
+		var tokenStr string
+		var revokedAt sql.NullInt64
+		err := rows.Scan(&tokenStr, &revokedAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		token, err := legacyRefreshToken(tokenStr)
+		if err != nil {
+			continue
+		}
+		token.RevokedAt = fromUnixNano(revokedAt)
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		_, err := tx.Exec(`INSERT INTO refresh_tokens (id, user_id, issued_at, expires_at, revoked_at)
+			VALUES (?, ?, ?, ?, ?)`,
+			token.Id, token.UserId, toUnixNano(token.IssuedAt), toUnixNano(token.ExpiresAt), toUnixNano(token.RevokedAt))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`DROP TABLE refresh_tokens_legacy`)
+	return err
+}
+
+// addSQLiteEmailKeys stores the normalised email of every user in email_key under
+// a unique index, NOCASE only folds ASCII and didn't make emails unique. Like in
+// the JSON store the oldest of several users sharing an address keeps it
+func addSQLiteEmailKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE users ADD COLUMN email_key TEXT`)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT id, email FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	keys := map[string]int{}
+	for rows.Next() {
+		var id int
+		var email string
+		err := rows.Scan(&id, &email)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := keys[normalizeEmail(email)]; !ok {
+			keys[normalizeEmail(email)] = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for key, id := range keys {
+		_, err := tx.Exec(`UPDATE users SET email_key = ? WHERE id = ?`, key, id)
+		if err != nil {
+			return err
+		}
+	}
+	return execSQL(
+		`DROP INDEX users_email_nocase`,
+		`CREATE UNIQUE INDEX users_email_key ON users (email_key)`,
+	)(tx)
+}
+
+// emailTaken turns a violation of the unique email index into ErrEmailTaken
+func emailTaken(err error) error {
+	sqliteErr := &sqlite.Error{}
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// NewSQLiteDB opens the SQLite database at path, creating it if needed,
+// and brings its schema up to date
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	dsn := "file:" + path +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := SQLiteDB{sql: conn}
+	err = db.migrate()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &db, nil
+}
+
+// PendingSQLiteMigrations reports the migrations NewSQLiteDB would run
+// on the database at path without changing it
+func PendingSQLiteMigrations(path string) ([]PendingMigration, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	version, err := sqliteSchemaVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	steps := []PendingMigration{}
+	for i := version; i < len(sqliteMigrations); i++ {
+		steps = append(steps, PendingMigration{Version: i + 1, Description: sqliteMigrations[i].description})
+	}
+	return steps, nil
+}
+
+// migrate applies every migration newer than the stored schema version
+func (db *SQLiteDB) migrate() error {
+	version, err := sqliteSchemaVersion(db.sql)
+	if err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		err := db.withTx(func(tx *sql.Tx) error {
+			err := sqliteMigrations[i].up(tx)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %w", i+1, sqliteMigrations[i].description, err)
+			}
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteSchemaVersion reads the number of applied migrations
+// and refuses databases written by a newer build
+func sqliteSchemaVersion(conn *sql.DB) (int, error) {
+	var version int
+	err := conn.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if version > len(sqliteMigrations) {
+		return 0, fmt.Errorf("database schema version %d is newer than supported version %d",
+			version, len(sqliteMigrations))
+	}
+	return version, nil
+}
+
+// withTx runs fn inside a transaction, rolling back if it fails
+func (db *SQLiteDB) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the underlying database connection
+func (db *SQLiteDB) Close() error {
+	return db.sql.Close()
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// toUnixNano stores zero times as NULL
+func toUnixNano(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+// fromUnixNano turns NULL back into the zero time
+func fromUnixNano(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}.UTC()
+	}
+	return time.Unix(0, n.Int64).UTC()
+}
+
+const userColumns = `id, email, password, is_chirpy_red, email_verified, pending_email,
+	totp_secret, totp_enabled, totp_last_step, recovery_codes, role`
+
+// scanUser reads a row of userColumns, the recovery codes are stored as a JSON array
+func scanUser(row scanner) (User, error) {
+	user := User{}
+	var recoveryCodes string
+	err := row.Scan(&user.Id, &user.Email, &user.Password, &user.IsChirpyRed, &user.EmailVerified, &user.PendingEmail,
+		&user.TotpSecret, &user.TotpEnabled, &user.TotpLastStep, &recoveryCodes, &user.Role)
+	if err != nil {
+		return User{}, err
+	}
+	err = json.Unmarshal([]byte(recoveryCodes), &user.RecoveryCodes)
+	if err != nil {
+		return User{}, fmt.Errorf("invalid recovery codes of user %d: %w", user.Id, err)
+	}
+	return user, nil
+}
+
+// CreateUser creates a new user and saves it to disk
+func (db *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	newUser := User{Email: email, Password: password, IsChirpyRed: false, Role: RoleUser}
+	err := db.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`INSERT INTO users (email, email_key, password, is_chirpy_red, role) VALUES (?, ?, ?, ?, ?)`,
+			newUser.Email, normalizeEmail(newUser.Email), newUser.Password, newUser.IsChirpyRed, newUser.Role)
+		if err != nil {
+			return emailTaken(err)
+		}
+		id, err := res.LastInsertId()
+		newUser.Id = int(id)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return newUser, nil
+}
+
+// GetUsers returns all users in the database
+func (db *SQLiteDB) GetUsers() ([]User, error) {
+	rows, err := db.sql.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetUserByID returns a user with the specified ID
+func (db *SQLiteDB) GetUserByID(id int) (User, error) {
+	row := db.sql.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// GetUserByEmail returns a user with the specified email, ignoring case
+func (db *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	row := db.sql.QueryRow(`SELECT `+userColumns+` FROM users WHERE email_key = ?`, normalizeEmail(email))
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrEmailNotFound
+	}
+	return user, err
+}
+
+// UpdateUser updates the user with the specified id to contain the new email and password
+// returns the updated user
+func (db *SQLiteDB) UpdateUser(id int, email string, password string) (User, error) {
+	var updatedUser User
+	err := db.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE users SET email = ?, email_key = ?, password = ? WHERE id = ?`,
+			email, normalizeEmail(email), password, id)
+		if err != nil {
+			return emailTaken(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrUserNotFound
+		}
+		updatedUser, err = scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updatedUser, nil
+}
+
+// UpgradeUser sets the IsChirpyRed to true
+// returns the updated user
+func (db *SQLiteDB) UpgradeUser(id int) (User, error) {
+	var upgradedUser User
+	err := db.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE users SET is_chirpy_red = 1 WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrUserNotFound
+		}
+		upgradedUser, err = scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return upgradedUser, nil
+}
+
+// ModifyUser applies fn to the user inside a transaction and saves the result,
+// nothing is saved if fn fails or the new email belongs to another user
+func (db *SQLiteDB) ModifyUser(id int, fn func(user *User) error) (User, error) {
+	var modifiedUser User
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		modifiedUser, err = scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(&modifiedUser)
+		if err != nil {
+			return err
+		}
+		modifiedUser.Id = id
+		recoveryCodes, err := json.Marshal(append([]string{}, modifiedUser.RecoveryCodes...))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE users SET email = ?, email_key = ?, password = ?, is_chirpy_red = ?, email_verified = ?,
+			pending_email = ?, totp_secret = ?, totp_enabled = ?, totp_last_step = ?, recovery_codes = ?, role = ?
+			WHERE id = ?`,
+			modifiedUser.Email, normalizeEmail(modifiedUser.Email), modifiedUser.Password, modifiedUser.IsChirpyRed,
+			modifiedUser.EmailVerified, modifiedUser.PendingEmail, modifiedUser.TotpSecret, modifiedUser.TotpEnabled,
+			modifiedUser.TotpLastStep, string(recoveryCodes), modifiedUser.Role, id)
+		return emailTaken(err)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return modifiedUser, nil
+}
+
+const chirpColumns = `id, author_id, body`
+
+func scanChirp(row scanner) (Chirp, error) {
+	chirp := Chirp{}
+	err := row.Scan(&chirp.Id, &chirp.AuthorId, &chirp.Body)
+	return chirp, err
+}
+
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+// CreateChirp creates a new chirp and saves it to disk
+func (db *SQLiteDB) CreateChirp(body string, author_id int) (Chirp, error) {
+	res, err := db.sql.Exec(`INSERT INTO chirps (author_id, body) VALUES (?, ?)`, author_id, body)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return Chirp{Id: int(id), AuthorId: author_id, Body: body}, nil
+}
+
+// GetChirps returns all chirps in the database
+func (db *SQLiteDB) GetChirps(sortInAscendingOrder bool) ([]Chirp, error) {
+	return db.queryChirps(`SELECT ` + chirpColumns + ` FROM chirps ORDER BY id ` + sqlOrder(sortInAscendingOrder))
+}
+
+// GetChirpsByAuthor returns all chirps with the specified author_id in the database
+func (db *SQLiteDB) GetChirpsByAuthor(author_id int, sortInAscendingOrder bool) ([]Chirp, error) {
+	return db.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? ORDER BY id `+
+		sqlOrder(sortInAscendingOrder), author_id)
+}
+
+func sqlOrder(ascending bool) string {
+	if ascending {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// GetChirpByID returns a chirp with the specified id
+func (db *SQLiteDB) GetChirpByID(id int) (Chirp, error) {
+	row := db.sql.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id)
+	chirp, err := scanChirp(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	return chirp, err
+}
+
+// DeleteChirp deletes a chirp
+func (db *SQLiteDB) DeleteChirp(id int) (Chirp, error) {
+	var deletedChirp Chirp
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		deletedChirp, err = scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			deletedChirp = Chirp{}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM chirps WHERE id = ?`, id)
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return deletedChirp, nil
+}
+
+const tokenColumns = `id, family_id, replaced_by, user_id, issued_at, expires_at, user_agent, ip, revoked_at`
+
+func scanToken(row scanner) (RefreshToken, error) {
+	token := RefreshToken{}
+	var issuedAt, expiresAt, revokedAt sql.NullInt64
+	err := row.Scan(&token.Id, &token.FamilyId, &token.ReplacedBy, &token.UserId,
+		&issuedAt, &expiresAt, &token.UserAgent, &token.Ip, &revokedAt)
+	token.IssuedAt = fromUnixNano(issuedAt)
+	token.ExpiresAt = fromUnixNano(expiresAt)
+	token.RevokedAt = fromUnixNano(revokedAt)
+	return token, err
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertToken(conn execer, token RefreshToken) error {
+	_, err := conn.Exec(`INSERT INTO refresh_tokens (`+tokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		token.Id, token.FamilyId, token.ReplacedBy, token.UserId, toUnixNano(token.IssuedAt), toUnixNano(token.ExpiresAt),
+		token.UserAgent, token.Ip, toUnixNano(token.RevokedAt))
+	return err
+}
+
+// CreateToken stores the digest of a new refresh token
+// together with the metadata in token and saves it to disk
+func (db *SQLiteDB) CreateToken(tokenStr string, token RefreshToken) (RefreshToken, error) {
+	newToken := newRefreshToken(tokenStr, token)
+	err := insertToken(db.sql, newToken)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return newToken, nil
+}
+
+// GetToken returns the refresh token record of tokenStr, looked up by digest
+func (db *SQLiteDB) GetToken(tokenStr string) (RefreshToken, error) {
+	row := db.sql.QueryRow(`SELECT `+tokenColumns+` FROM refresh_tokens WHERE id = ?`, HashToken(tokenStr))
+	token, err := scanToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrTokenNotFound
+	}
+	return token, err
+}
+
+// RevokeToken sets the revoked at time of tokenStr, looked up by digest
+func (db *SQLiteDB) RevokeToken(tokenStr string) (RefreshToken, error) {
+	row := db.sql.QueryRow(`UPDATE refresh_tokens SET revoked_at = ? WHERE id = ? RETURNING `+tokenColumns,
+		toUnixNano(time.Now().UTC()), HashToken(tokenStr))
+	token, err := scanToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrTokenNotFound
+	}
+	return token, err
+}
+
+// RotateToken revokes the token oldTokenStr in favour of newTokenStr,
+// which joins its family, presenting an already revoked token
+// revokes its whole family and returns ErrTokenReused
+func (db *SQLiteDB) RotateToken(oldTokenStr string, newTokenStr string, token RefreshToken) (RefreshToken, error) {
+	var newToken RefreshToken
+	reused := false
+	err := db.withTx(func(tx *sql.Tx) error {
+		row := tx.QueryRow(`SELECT `+tokenColumns+` FROM refresh_tokens WHERE id = ?`, HashToken(oldTokenStr))
+		oldToken, err := scanToken(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTokenNotFound
+		}
+		if err != nil {
+			return err
+		}
+		now := toUnixNano(time.Now().UTC())
+		if !oldToken.RevokedAt.IsZero() {
+			reused = true
+			_, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`,
+				now, oldToken.FamilyId)
+			return err
+		}
+		token.FamilyId = oldToken.FamilyId
+		token.UserId = oldToken.UserId
+		newToken = newRefreshToken(newTokenStr, token)
+		_, err = tx.Exec(`UPDATE refresh_tokens SET revoked_at = ?, replaced_by = ? WHERE id = ?`,
+			now, newToken.Id, oldToken.Id)
+		if err != nil {
+			return err
+		}
+		return insertToken(tx, newToken)
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrTokenReused
+	}
+	return newToken, nil
+}
+
+// GetTokensByUser returns every refresh token of the user, revoked ones included
+func (db *SQLiteDB) GetTokensByUser(userID int) ([]RefreshToken, error) {
+	rows, err := db.sql.Query(`SELECT `+tokenColumns+` FROM refresh_tokens WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []RefreshToken{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+// RevokeTokenFamily revokes the active tokens of one family of the user,
+// it returns ErrTokenNotFound if the family has none
+func (db *SQLiteDB) RevokeTokenFamily(userID int, familyID string) error {
+	res, err := db.sql.Exec(
+		`UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND family_id = ? AND revoked_at IS NULL`,
+		toUnixNano(time.Now().UTC()), userID, familyID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// RevokeUserTokens revokes every active token of the user
+// and returns how many it revoked
+func (db *SQLiteDB) RevokeUserTokens(userID int) (int, error) {
+	res, err := db.sql.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		toUnixNano(time.Now().UTC()), userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+const oneTimeTokenColumns = `id, purpose, user_id, email, created_at, expires_at, used_at`
+
+func scanOneTimeToken(row scanner) (OneTimeToken, error) {
+	token := OneTimeToken{}
+	var createdAt, expiresAt, usedAt sql.NullInt64
+	err := row.Scan(&token.Id, &token.Purpose, &token.UserId, &token.Email, &createdAt, &expiresAt, &usedAt)
+	token.CreatedAt = fromUnixNano(createdAt)
+	token.ExpiresAt = fromUnixNano(expiresAt)
+	token.UsedAt = fromUnixNano(usedAt)
+	return token, err
+}
+
+// CreateOneTimeToken stores the digest of a new single-use token
+// together with the metadata in token and saves it to disk
+func (db *SQLiteDB) CreateOneTimeToken(tokenStr string, token OneTimeToken) (OneTimeToken, error) {
+	newToken := newOneTimeToken(tokenStr, token)
+	_, err := db.sql.Exec(`INSERT INTO one_time_tokens (`+oneTimeTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		newToken.Id, newToken.Purpose, newToken.UserId, newToken.Email,
+		toUnixNano(newToken.CreatedAt), toUnixNano(newToken.ExpiresAt), toUnixNano(newToken.UsedAt))
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	return newToken, nil
+}
+
+// UseOneTimeToken marks the token tokenStr issued for purpose as used
+// and returns it, a token can only be used once and before it expires
+func (db *SQLiteDB) UseOneTimeToken(tokenStr string, purpose string) (OneTimeToken, error) {
+	var token OneTimeToken
+	err := db.withTx(func(tx *sql.Tx) error {
+		row := tx.QueryRow(`SELECT `+oneTimeTokenColumns+` FROM one_time_tokens WHERE id = ? AND purpose = ?`,
+			HashToken(tokenStr), purpose)
+		var err error
+		token, err = scanOneTimeToken(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTokenNotFound
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		err = token.usable(now)
+		if err != nil {
+			return err
+		}
+		token.UsedAt = now
+		_, err = tx.Exec(`UPDATE one_time_tokens SET used_at = ? WHERE id = ?`, toUnixNano(now), token.Id)
+		return err
+	})
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	return token, nil
+}
+
+// PurgeTokens deletes tokens that expired before now and tokens
+// revoked or used before revokedBefore, rotated tokens are kept
+// until they expire so that their reuse is still detected
+func (db *SQLiteDB) PurgeTokens(now time.Time, revokedBefore time.Time) (TokenPurge, error) {
+	purge := TokenPurge{}
+	err := db.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, now.UnixNano())
+		if err != nil {
+			return err
+		}
+		expired, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		res, err = tx.Exec(`DELETE FROM refresh_tokens WHERE revoked_at < ? AND replaced_by = ''`, revokedBefore.UnixNano())
+		if err != nil {
+			return err
+		}
+		revoked, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		res, err = tx.Exec(`DELETE FROM one_time_tokens WHERE expires_at < ? OR used_at < ?`,
+			now.UnixNano(), revokedBefore.UnixNano())
+		if err != nil {
+			return err
+		}
+		oneTime, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		res, err = tx.Exec(`DELETE FROM oauth_codes WHERE expires_at < ?`, now.UnixNano())
+		if err != nil {
+			return err
+		}
+		codes, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		res, err = tx.Exec(`DELETE FROM personal_tokens WHERE expires_at < ?`, now.UnixNano())
+		if err != nil {
+			return err
+		}
+		personal, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		purge = TokenPurge{
+			Expired:    int(expired),
+			Revoked:    int(revoked),
+			OneTime:    int(oneTime),
+			OAuthCodes: int(codes),
+			Personal:   int(personal),
+		}
+		return nil
+	})
+	if err != nil {
+		return TokenPurge{}, err
+	}
+	return purge, nil
+}
+
+const personalTokenColumns = `id, user_id, name, scopes, expires_at, created_at, last_used_at`
+
+// scanPersonalToken reads a row of personalTokenColumns, the scopes are stored as a JSON array
+func scanPersonalToken(row scanner) (PersonalToken, error) {
+	token := PersonalToken{}
+	var scopes string
+	var expiresAt, createdAt, lastUsedAt sql.NullInt64
+	err := row.Scan(&token.Id, &token.UserId, &token.Name, &scopes, &expiresAt, &createdAt, &lastUsedAt)
+	if err != nil {
+		return PersonalToken{}, err
+	}
+	token.ExpiresAt = fromUnixNano(expiresAt)
+	token.CreatedAt = fromUnixNano(createdAt)
+	token.LastUsedAt = fromUnixNano(lastUsedAt)
+	err = json.Unmarshal([]byte(scopes), &token.Scopes)
+	if err != nil {
+		return PersonalToken{}, fmt.Errorf("invalid scopes of personal token %s: %w", token.Id, err)
+	}
+	return token, nil
+}
+
+// CreatePersonalToken stores the digest of a new personal access token
+// together with the metadata in token and saves it to disk
+func (db *SQLiteDB) CreatePersonalToken(tokenStr string, token PersonalToken) (PersonalToken, error) {
+	newToken := newPersonalToken(tokenStr, token)
+	scopes, err := json.Marshal(append([]string{}, newToken.Scopes...))
+	if err != nil {
+		return PersonalToken{}, err
+	}
+	_, err = db.sql.Exec(`INSERT INTO personal_tokens (`+personalTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		newToken.Id, newToken.UserId, newToken.Name, string(scopes),
+		toUnixNano(newToken.ExpiresAt), toUnixNano(newToken.CreatedAt), toUnixNano(newToken.LastUsedAt))
+	if err != nil {
+		return PersonalToken{}, err
+	}
+	return newToken, nil
+}
+
+// GetPersonalToken returns the personal access token tokenStr, expired ones included
+func (db *SQLiteDB) GetPersonalToken(tokenStr string) (PersonalToken, error) {
+	row := db.sql.QueryRow(`SELECT `+personalTokenColumns+` FROM personal_tokens WHERE id = ?`, HashToken(tokenStr))
+	token, err := scanPersonalToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PersonalToken{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return PersonalToken{}, err
+	}
+	return token, nil
+}
+
+// GetPersonalTokensByUser returns the personal access tokens of the user, newest first
+func (db *SQLiteDB) GetPersonalTokensByUser(userID int) ([]PersonalToken, error) {
+	rows, err := db.sql.Query(`SELECT `+personalTokenColumns+` FROM personal_tokens WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []PersonalToken{}
+	for rows.Next() {
+		token, err := scanPersonalToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortPersonalTokens(tokens)
+	return tokens, nil
+}
+
+// TouchPersonalToken records that the token with the digest id was used at usedAt
+func (db *SQLiteDB) TouchPersonalToken(id string, usedAt time.Time) error {
+	res, err := db.sql.Exec(`UPDATE personal_tokens SET last_used_at = ? WHERE id = ?`, toUnixNano(usedAt), id)
+	if err != nil {
+		return err
+	}
+	touched, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if touched == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// DeletePersonalToken deletes a personal access token of the user,
+// it returns ErrTokenNotFound if the user has no token with the digest id
+func (db *SQLiteDB) DeletePersonalToken(userID int, id string) error {
+	res, err := db.sql.Exec(`DELETE FROM personal_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// DeletePersonalTokensByUser deletes every personal access token of the user
+// and returns how many it deleted
+func (db *SQLiteDB) DeletePersonalTokensByUser(userID int) (int, error) {
+	res, err := db.sql.Exec(`DELETE FROM personal_tokens WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+const oauthClientColumns = `id, secret_hash, owner_id, name, redirect_uris, scopes, created_at`
+
+// scanOAuthClient reads a row of oauthClientColumns,
+// the redirect URIs and scopes are stored as JSON arrays
+func scanOAuthClient(row scanner) (OAuthClient, error) {
+	client := OAuthClient{}
+	var redirectURIs, scopes string
+	var createdAt sql.NullInt64
+	err := row.Scan(&client.Id, &client.SecretHash, &client.OwnerId, &client.Name, &redirectURIs, &scopes, &createdAt)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client.CreatedAt = fromUnixNano(createdAt)
+	err = json.Unmarshal([]byte(redirectURIs), &client.RedirectURIs)
+	if err != nil {
+		return OAuthClient{}, fmt.Errorf("invalid redirect URIs of client %s: %w", client.Id, err)
+	}
+	err = json.Unmarshal([]byte(scopes), &client.Scopes)
+	if err != nil {
+		return OAuthClient{}, fmt.Errorf("invalid scopes of client %s: %w", client.Id, err)
+	}
+	return client, nil
+}
+
+// CreateOAuthClient stores a new OAuth client registration
+func (db *SQLiteDB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	newClient := newOAuthClient(client)
+	redirectURIs, err := json.Marshal(append([]string{}, newClient.RedirectURIs...))
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	scopes, err := json.Marshal(append([]string{}, newClient.Scopes...))
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	_, err = db.sql.Exec(`INSERT INTO oauth_clients (`+oauthClientColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		newClient.Id, newClient.SecretHash, newClient.OwnerId, newClient.Name,
+		string(redirectURIs), string(scopes), toUnixNano(newClient.CreatedAt))
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return newClient, nil
+}
+
+// GetOAuthClient returns the client with the client id id, or ErrClientNotFound
+func (db *SQLiteDB) GetOAuthClient(id string) (OAuthClient, error) {
+	row := db.sql.QueryRow(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE id = ?`, id)
+	client, err := scanOAuthClient(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OAuthClient{}, ErrClientNotFound
+	}
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return client, nil
+}
+
+// GetOAuthClientsByOwner returns the clients the user registered, newest first
+func (db *SQLiteDB) GetOAuthClientsByOwner(ownerID int) ([]OAuthClient, error) {
+	rows, err := db.sql.Query(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE owner_id = ?`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortOAuthClients(clients)
+	return clients, nil
+}
+
+// DeleteOAuthClient deletes a client the user registered,
+// it returns ErrClientNotFound if the user has no client with the client id id
+func (db *SQLiteDB) DeleteOAuthClient(ownerID int, id string) error {
+	res, err := db.sql.Exec(`DELETE FROM oauth_clients WHERE id = ? AND owner_id = ?`, id, ownerID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+const oauthCodeColumns = `id, client_id, user_id, redirect_uri, scopes, code_challenge, ` +
+	`created_at, expires_at, used_at, family_id`
+
+// scanOAuthCode reads a row of oauthCodeColumns, the scopes are stored as a JSON array
+func scanOAuthCode(row scanner) (OAuthCode, error) {
+	code := OAuthCode{}
+	var scopes string
+	var createdAt, expiresAt, usedAt sql.NullInt64
+	err := row.Scan(&code.Id, &code.ClientId, &code.UserId, &code.RedirectURI, &scopes, &code.CodeChallenge,
+		&createdAt, &expiresAt, &usedAt, &code.FamilyId)
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	code.CreatedAt = fromUnixNano(createdAt)
+	code.ExpiresAt = fromUnixNano(expiresAt)
+	code.UsedAt = fromUnixNano(usedAt)
+	err = json.Unmarshal([]byte(scopes), &code.Scopes)
+	if err != nil {
+		return OAuthCode{}, fmt.Errorf("invalid scopes of authorization code %s: %w", code.Id, err)
+	}
+	return code, nil
+}
+
+// CreateOAuthCode stores the digest of a new authorization code
+// together with the grant in code
+func (db *SQLiteDB) CreateOAuthCode(codeStr string, code OAuthCode) (OAuthCode, error) {
+	newCode := newOAuthCode(codeStr, code)
+	scopes, err := json.Marshal(append([]string{}, newCode.Scopes...))
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	_, err = db.sql.Exec(`INSERT INTO oauth_codes (`+oauthCodeColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		newCode.Id, newCode.ClientId, newCode.UserId, newCode.RedirectURI, string(scopes), newCode.CodeChallenge,
+		toUnixNano(newCode.CreatedAt), toUnixNano(newCode.ExpiresAt), toUnixNano(newCode.UsedAt), newCode.FamilyId)
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	return newCode, nil
+}
+
+// UseOAuthCode marks the authorization code codeStr as exchanged for the
+// refresh token family familyID and returns it, a code can only be
+// exchanged once and before it expires, and only if check accepts it
+func (db *SQLiteDB) UseOAuthCode(codeStr string, familyID string, check func(code OAuthCode) error) (OAuthCode, error) {
+	var code OAuthCode
+	err := db.withTx(func(tx *sql.Tx) error {
+		row := tx.QueryRow(`SELECT `+oauthCodeColumns+` FROM oauth_codes WHERE id = ?`, HashToken(codeStr))
+		var err error
+		code, err = scanOAuthCode(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTokenNotFound
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		err = code.usable(now)
+		if err != nil {
+			return err
+		}
+		err = check(code)
+		if err != nil {
+			return err
+		}
+		code.UsedAt = now
+		code.FamilyId = familyID
+		_, err = tx.Exec(`UPDATE oauth_codes SET used_at = ?, family_id = ? WHERE id = ?`,
+			toUnixNano(now), familyID, code.Id)
+		return err
+	})
+	if errors.Is(err, ErrTokenUsed) {
+		return code, err
+	}
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	return code, nil
+}
+
+const externalIdentityColumns = `issuer, subject, user_id, email, created_at, last_login_at`
+
+func scanExternalIdentity(row scanner) (ExternalIdentity, error) {
+	identity := ExternalIdentity{}
+	var createdAt, lastLoginAt sql.NullInt64
+	err := row.Scan(&identity.Issuer, &identity.Subject, &identity.UserId, &identity.Email, &createdAt, &lastLoginAt)
+	identity.CreatedAt = fromUnixNano(createdAt)
+	identity.LastLoginAt = fromUnixNano(lastLoginAt)
+	return identity, err
+}
+
+// GetExternalIdentity returns the account subject at the identity provider
+// issuer is linked to, or ErrIdentityNotFound
+func (db *SQLiteDB) GetExternalIdentity(issuer string, subject string) (ExternalIdentity, error) {
+	row := db.sql.QueryRow(`SELECT `+externalIdentityColumns+` FROM external_identities WHERE issuer = ? AND subject = ?`,
+		issuer, subject)
+	identity, err := scanExternalIdentity(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ExternalIdentity{}, ErrIdentityNotFound
+	}
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	return identity, nil
+}
+
+// SaveExternalIdentity links an account at an identity provider to a user,
+// or updates the link, keeping when it was made
+func (db *SQLiteDB) SaveExternalIdentity(identity ExternalIdentity) (ExternalIdentity, error) {
+	err := db.withTx(func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, identity.UserId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return ErrUserNotFound
+		}
+		row := tx.QueryRow(`SELECT `+externalIdentityColumns+` FROM external_identities WHERE issuer = ? AND subject = ?`,
+			identity.Issuer, identity.Subject)
+		old, err := scanExternalIdentity(row)
+		switch {
+		case err == nil:
+			identity.CreatedAt = old.CreatedAt
+		case errors.Is(err, sql.ErrNoRows):
+			if identity.CreatedAt.IsZero() {
+				identity.CreatedAt = time.Now().UTC()
+			}
+		default:
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO external_identities (`+externalIdentityColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+			identity.Issuer, identity.Subject, identity.UserId, identity.Email,
+			toUnixNano(identity.CreatedAt), toUnixNano(identity.LastLoginAt))
+		return err
+	})
+	if err != nil {
+		return ExternalIdentity{}, err
+	}
+	return identity, nil
+}
+
+const loginThrottleColumns = `key, failures, last_failed_at, lockouts, locked_until`
+
+func scanLoginThrottle(row scanner) (LoginThrottle, error) {
+	throttle := LoginThrottle{}
+	var lastFailedAt, lockedUntil sql.NullInt64
+	err := row.Scan(&throttle.Key, &throttle.Failures, &lastFailedAt, &throttle.Lockouts, &lockedUntil)
+	throttle.LastFailedAt = fromUnixNano(lastFailedAt)
+	throttle.LockedUntil = fromUnixNano(lockedUntil)
+	return throttle, err
+}
+
+// GetLoginThrottle returns the failed logins counted under key,
+// a key without failures has an empty record
+func (db *SQLiteDB) GetLoginThrottle(key string) (LoginThrottle, error) {
+	row := db.sql.QueryRow(`SELECT `+loginThrottleColumns+` FROM login_throttles WHERE key = ?`, key)
+	throttle, err := scanLoginThrottle(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginThrottle{Key: key}, nil
+	}
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+	return throttle, nil
+}
+
+// ModifyLoginThrottle applies fn to the record of key inside a transaction and saves the result
+func (db *SQLiteDB) ModifyLoginThrottle(key string, fn func(throttle *LoginThrottle) error) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		row := tx.QueryRow(`SELECT `+loginThrottleColumns+` FROM login_throttles WHERE key = ?`, key)
+		throttle, err = scanLoginThrottle(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			throttle, err = LoginThrottle{Key: key}, nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(&throttle)
+		if err != nil {
+			return err
+		}
+		throttle.Key = key
+		_, err = tx.Exec(`INSERT OR REPLACE INTO login_throttles (`+loginThrottleColumns+`) VALUES (?, ?, ?, ?, ?)`,
+			throttle.Key, throttle.Failures, toUnixNano(throttle.LastFailedAt), throttle.Lockouts,
+			toUnixNano(throttle.LockedUntil))
+		return err
+	})
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+	return throttle, nil
+}
+
+// DeleteLoginThrottle forgets the failed logins counted under key
+func (db *SQLiteDB) DeleteLoginThrottle(key string) error {
+	_, err := db.sql.Exec(`DELETE FROM login_throttles WHERE key = ?`, key)
+	return err
+}
+
+// PurgeLoginThrottles deletes the records whose last failure
+// and lockout both ended before before and returns how many
+func (db *SQLiteDB) PurgeLoginThrottles(before time.Time) (int, error) {
+	res, err := db.sql.Exec(`DELETE FROM login_throttles
+		WHERE COALESCE(last_failed_at, 0) < ? AND COALESCE(locked_until, 0) < ?`,
+		before.UnixNano(), before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(purged), nil
+}
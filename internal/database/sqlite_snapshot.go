@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Snapshot writes a consistent copy of the database to w,
+// the copy is a complete SQLite database file that Restore accepts
+func (db *SQLiteDB) Snapshot(w io.Writer) error {
+	dir, err := os.MkdirTemp("", "chirpy-snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := dir + "/snapshot.db"
+	_, err = db.sql.Exec(`VACUUM INTO ` + sqlQuote(tmpPath))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore validates the snapshot read from r and, only if it is sound,
+// replaces the contents of every table with it
+func (db *SQLiteDB) Restore(r io.Reader) error {
+	dir, err := os.MkdirTemp("", "chirpy-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := dir + "/restore.db"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = validateSQLiteSnapshot(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := db.sql.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `ATTACH DATABASE `+sqlQuote(tmpPath)+` AS restore`)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE restore`)
+
+	tables, err := sqliteTables(ctx, conn)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, table := range append(tables, "sqlite_sequence") {
+		_, err = tx.Exec(`DELETE FROM main.` + table)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO main.` + table + ` SELECT * FROM restore.` + table)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("restoring %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// validateSQLiteSnapshot checks the integrity of a snapshot file
+// and upgrades it to the current schema so its tables line up with ours
+func validateSQLiteSnapshot(path string) error {
+	snapshot, err := NewSQLiteDB(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	defer snapshot.Close()
+	var result string
+	err = snapshot.sql.QueryRow(`PRAGMA integrity_check`).Scan(&result)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, result)
+	}
+	var orphans int
+	err = snapshot.sql.QueryRow(
+		`SELECT COUNT(*) FROM chirps WHERE author_id NOT IN (SELECT id FROM users)`).Scan(&orphans)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	if orphans > 0 {
+		return fmt.Errorf("%w: %d chirps belong to missing users", ErrInvalidSnapshot, orphans)
+	}
+	return nil
+}
+
+// sqliteTables lists the user tables of the main database
+func sqliteTables(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT name FROM main.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// sqlQuote quotes s as an SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
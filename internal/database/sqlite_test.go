@@ -0,0 +1,212 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sqliteHasObject reports whether the schema has a table or index named name
+func sqliteHasObject(t *testing.T, conn *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = ?`, name).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func queryInt(t *testing.T, conn *sql.DB, query string, args ...any) int {
+	t.Helper()
+	var n int
+	err := conn.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	return n
+}
+
+// TestSQLiteMigrationSteps applies the migrations one by one to a database
+// holding the rows an older build would have written
+func TestSQLiteMigrationSteps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+	conn, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tokenStr := legacyJWT(t, "1", time.Now().Add(time.Hour))
+	tableAdded := func(name string) func(t *testing.T) {
+		return func(t *testing.T) {
+			if !sqliteHasObject(t, conn, name) {
+				t.Errorf("%s was not added", name)
+			}
+		}
+	}
+
+	steps := []struct {
+		before []string
+		check  func(t *testing.T)
+	}{
+		{
+			check: tableAdded("users"),
+		},
+		{
+			// users whose emails only differ in case could be created before the index
+			before: []string{
+				`INSERT INTO users (id, email, password) VALUES (1, 'Ärger@x.com', 'hash'), (2, 'ärger@X.com', 'hash'),
+					(3, 'b@x.com', 'hash')`,
+				`INSERT INTO chirps (author_id, body) VALUES (1, 'hello')`,
+			},
+			check: tableAdded("users_email_nocase"),
+		},
+		{
+			before: []string{
+				fmt.Sprintf(`INSERT INTO refresh_tokens (id, revoked_at) VALUES ('%s', NULL), ('not-a-jwt', NULL)`, tokenStr),
+			},
+			check: func(t *testing.T) {
+				if n := queryInt(t, conn, `SELECT COUNT(*) FROM refresh_tokens`); n != 1 {
+					t.Fatalf("refresh_tokens has %d rows, want only the JWT", n)
+				}
+				if n := queryInt(t, conn, `SELECT user_id FROM refresh_tokens WHERE id = ?`, HashToken(tokenStr)); n != 1 {
+					t.Errorf("hashed token belongs to user %d, want 1", n)
+				}
+				if sqliteHasObject(t, conn, "refresh_tokens_legacy") {
+					t.Error("refresh_tokens_legacy was left behind")
+				}
+			},
+		},
+		{
+			check: func(t *testing.T) {
+				if n := queryInt(t, conn, `SELECT COUNT(*) FROM refresh_tokens WHERE family_id = id`); n != 1 {
+					t.Errorf("%d tokens start their own family, want 1", n)
+				}
+			},
+		},
+		{
+			check: tableAdded("one_time_tokens"),
+		},
+		{
+			check: func(t *testing.T) {
+				if n := queryInt(t, conn, `SELECT COUNT(*) FROM users WHERE email_verified = 1`); n != 3 {
+					t.Errorf("%d users registered before verification are verified, want 3", n)
+				}
+			},
+		},
+		{
+			// a signup after verification was added, which never verified
+			before: []string{
+				`INSERT INTO users (id, email, password) VALUES (4, 'd@x.com', 'hash')`,
+			},
+			check: func(t *testing.T) {
+				if n := queryInt(t, conn, `SELECT COUNT(*) FROM users WHERE recovery_codes = '[]'`); n != 4 {
+					t.Errorf("%d users have no recovery codes, want 4", n)
+				}
+			},
+		},
+		{
+			check: tableAdded("login_throttles"),
+		},
+		{
+			check: func(t *testing.T) {
+				if n := queryInt(t, conn, `SELECT COUNT(*) FROM users WHERE role = ?`, RoleUser); n != 4 {
+					t.Errorf("%d users have the user role, want 4", n)
+				}
+			},
+		},
+		{
+			check: tableAdded("personal_tokens"),
+		},
+		{
+			check: func(t *testing.T) {
+				tableAdded("oauth_clients")(t)
+				tableAdded("oauth_codes")(t)
+			},
+		},
+		{
+			check: tableAdded("external_identities"),
+		},
+		{
+			check: func(t *testing.T) {
+				want := map[int]sql.NullString{
+					1: {String: "ärger@x.com", Valid: true},
+					2: {},
+					3: {String: "b@x.com", Valid: true},
+					4: {String: "d@x.com", Valid: true},
+				}
+				for id, key := range want {
+					var got sql.NullString
+					err := conn.QueryRow(`SELECT email_key FROM users WHERE id = ?`, id).Scan(&got)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got != key {
+						t.Errorf("email key of user %d is %+v, want %+v", id, got, key)
+					}
+				}
+				if sqliteHasObject(t, conn, "users_email_nocase") {
+					t.Error("users_email_nocase was kept")
+				}
+				_, err := conn.Exec(`UPDATE users SET email_key = 'b@x.com' WHERE id = 2`)
+				if !errors.Is(emailTaken(err), ErrEmailTaken) {
+					t.Errorf("a duplicate email key was stored: %v", err)
+				}
+			},
+		},
+	}
+	if len(steps) != len(sqliteMigrations) {
+		t.Fatalf("%d migration steps are tested, there are %d", len(steps), len(sqliteMigrations))
+	}
+
+	for i, step := range steps {
+		for _, stmt := range step.before {
+			_, err := conn.Exec(stmt)
+			if err != nil {
+				t.Fatalf("before migration %d: %s", i+1, err)
+			}
+		}
+		tx, err := conn.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sqliteMigrations[i].up(tx)
+		if err != nil {
+			tx.Rollback()
+			t.Fatalf("migration %d (%s): %s", i+1, sqliteMigrations[i].description, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(sqliteMigrations[i].description, step.check)
+	}
+
+	pending, err := PendingSQLiteMigrations(path)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("pending migrations are %+v (%v), want none", pending, err)
+	}
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, err := db.GetUsers()
+	if err != nil || len(users) != 4 {
+		t.Fatalf("migrated users are %+v (%v)", users, err)
+	}
+	user, err := db.GetUserByEmail("ÄRGER@X.COM")
+	if err != nil || user.Id != 1 {
+		t.Fatalf("the oldest user doesn't keep the shared email: %+v (%v)", user, err)
+	}
+	user, err = db.GetUserByID(4)
+	if err != nil || user.EmailVerified {
+		t.Fatalf("a signup that never verified is %+v (%v), want it unverified", user, err)
+	}
+}
@@ -0,0 +1,383 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// Store is the storage backend used by the handlers
+type Store interface {
+	CreateUser(email string, password string) (User, error)
+	GetUsers() ([]User, error)
+	GetUserByID(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	UpdateUser(id int, email string, password string) (User, error)
+	UpgradeUser(id int) (User, error)
+	// ModifyUser applies fn to the user inside a transaction and saves the result,
+	// nothing is saved if fn fails or the new email belongs to another user
+	ModifyUser(id int, fn func(user *User) error) (User, error)
+
+	CreateChirp(body string, author_id int) (Chirp, error)
+	GetChirps(sortInAscendingOrder bool) ([]Chirp, error)
+	GetChirpsByAuthor(author_id int, sortInAscendingOrder bool) ([]Chirp, error)
+	GetChirpByID(id int) (Chirp, error)
+	DeleteChirp(id int) (Chirp, error)
+
+	CreateToken(tokenStr string, token RefreshToken) (RefreshToken, error)
+	GetToken(tokenStr string) (RefreshToken, error)
+	RevokeToken(tokenStr string) (RefreshToken, error)
+	// RotateToken revokes the token oldTokenStr in favour of newTokenStr,
+	// which joins its family, presenting an already revoked token
+	// revokes its whole family and returns ErrTokenReused
+	RotateToken(oldTokenStr string, newTokenStr string, token RefreshToken) (RefreshToken, error)
+	// GetTokensByUser returns every refresh token of the user, revoked ones included
+	GetTokensByUser(userID int) ([]RefreshToken, error)
+	// RevokeTokenFamily revokes the active tokens of one family of the user,
+	// it returns ErrTokenNotFound if the family has none
+	RevokeTokenFamily(userID int, familyID string) error
+	// RevokeUserTokens revokes every active token of the user
+	// and returns how many it revoked
+	RevokeUserTokens(userID int) (int, error)
+	// CreateOneTimeToken stores the digest of a new single-use token
+	CreateOneTimeToken(tokenStr string, token OneTimeToken) (OneTimeToken, error)
+	// UseOneTimeToken marks the token tokenStr issued for purpose as used and returns it,
+	// it fails with ErrTokenNotFound, ErrTokenUsed or ErrTokenExpired
+	UseOneTimeToken(tokenStr string, purpose string) (OneTimeToken, error)
+
+	// CreatePersonalToken stores the digest of a new personal access token
+	CreatePersonalToken(tokenStr string, token PersonalToken) (PersonalToken, error)
+	// GetPersonalToken returns the personal access token tokenStr, expired ones included
+	GetPersonalToken(tokenStr string) (PersonalToken, error)
+	// GetPersonalTokensByUser returns the personal access tokens of the user, newest first
+	GetPersonalTokensByUser(userID int) ([]PersonalToken, error)
+	// TouchPersonalToken records that the token with the digest id was used at usedAt
+	TouchPersonalToken(id string, usedAt time.Time) error
+	// DeletePersonalToken deletes a personal access token of the user,
+	// it returns ErrTokenNotFound if the user has no token with the digest id
+	DeletePersonalToken(userID int, id string) error
+	// DeletePersonalTokensByUser deletes every personal access token of the user
+	// and returns how many it deleted
+	DeletePersonalTokensByUser(userID int) (int, error)
+
+	// CreateOAuthClient stores a new OAuth client registration
+	CreateOAuthClient(client OAuthClient) (OAuthClient, error)
+	// GetOAuthClient returns the client with the client id id, or ErrClientNotFound
+	GetOAuthClient(id string) (OAuthClient, error)
+	// GetOAuthClientsByOwner returns the clients the user registered, newest first
+	GetOAuthClientsByOwner(ownerID int) ([]OAuthClient, error)
+	// DeleteOAuthClient deletes a client the user registered,
+	// it returns ErrClientNotFound if the user has no client with the client id id
+	DeleteOAuthClient(ownerID int, id string) error
+	// CreateOAuthCode stores the digest of a new authorization code
+	CreateOAuthCode(codeStr string, code OAuthCode) (OAuthCode, error)
+	// UseOAuthCode marks the authorization code codeStr as exchanged for the
+	// refresh token family familyID and returns it, it fails with ErrTokenNotFound,
+	// ErrTokenExpired or ErrTokenUsed, the latter together with the used code.
+	// The code is only marked if check accepts it, its error is returned otherwise
+	UseOAuthCode(codeStr string, familyID string, check func(code OAuthCode) error) (OAuthCode, error)
+
+	// GetExternalIdentity returns the account subject at the identity provider
+	// issuer is linked to, or ErrIdentityNotFound
+	GetExternalIdentity(issuer string, subject string) (ExternalIdentity, error)
+	// SaveExternalIdentity links an account at an identity provider to a user,
+	// or updates the link, keeping when it was made
+	SaveExternalIdentity(identity ExternalIdentity) (ExternalIdentity, error)
+
+	// PurgeTokens deletes tokens that expired before now and tokens
+	// revoked or used before revokedBefore, rotated tokens are kept until they expire
+	PurgeTokens(now time.Time, revokedBefore time.Time) (TokenPurge, error)
+
+	// GetLoginThrottle returns the failed logins counted under key,
+	// a key without failures has an empty record
+	GetLoginThrottle(key string) (LoginThrottle, error)
+	// ModifyLoginThrottle applies fn to the record of key inside a transaction and saves the result
+	ModifyLoginThrottle(key string, fn func(throttle *LoginThrottle) error) (LoginThrottle, error)
+	// DeleteLoginThrottle forgets the failed logins counted under key
+	DeleteLoginThrottle(key string) error
+	// PurgeLoginThrottles deletes the records whose last failure
+	// and lockout both ended before before and returns how many
+	PurgeLoginThrottles(before time.Time) (int, error)
+
+	// Snapshot writes a consistent backup of the whole store to w
+	Snapshot(w io.Writer) error
+	// Restore validates a backup made by Snapshot and replaces the store with it
+	Restore(r io.Reader) error
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+var (
+	ErrUserNotFound     = errors.New("no user with such id")
+	ErrEmailNotFound    = errors.New("no user with such email")
+	ErrEmailTaken       = errors.New("a user with this email already exists")
+	ErrChirpNotFound    = errors.New("no chirp with such ID")
+	ErrTokenNotFound    = errors.New("no such token")
+	ErrTokenReused      = errors.New("refresh token reuse detected, the session has been revoked")
+	ErrTokenUsed        = errors.New("token has already been used")
+	ErrTokenExpired     = errors.New("token has expired")
+	ErrClientNotFound   = errors.New("no such client")
+	ErrIdentityNotFound = errors.New("no user is linked to this identity")
+
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+type User struct {
+	Id            int    `json:"id"`
+	Email         string `json:"email"`
+	Password      string `json:"password"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
+	EmailVerified bool   `json:"email_verified"`
+	// PendingEmail replaces Email once it is verified
+	PendingEmail string `json:"pending_email"`
+	// TotpSecret is set on enrollment, TotpEnabled once a code confirmed it
+	TotpSecret  string `json:"totp_secret"`
+	TotpEnabled bool   `json:"totp_enabled"`
+	// TotpLastStep is the time step of the last accepted code, codes can't be replayed
+	TotpLastStep int64 `json:"totp_last_step"`
+	// RecoveryCodes are the digests of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes"`
+	// Role is one of RoleUser, RoleModerator and RoleAdmin
+	Role string `json:"role"`
+}
+
+// Roles of users, new users get RoleUser
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+type Chirp struct {
+	Id       int    `json:"id"`
+	AuthorId int    `json:"author_id"`
+	Body     string `json:"body"`
+}
+
+// RefreshToken is a refresh token session, the token itself is never stored
+type RefreshToken struct {
+	// Id is the hex SHA-256 digest of the token
+	Id string `json:"id"`
+	// FamilyId is the id of the token the login started with,
+	// every token rotated from it shares the family
+	FamilyId string `json:"family_id"`
+	// ReplacedBy is the id of the token this one was rotated to
+	ReplacedBy string    `json:"replaced_by"`
+	UserId     int       `json:"user_id"`
+	IssuedAt   time.Time `json:"issued_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	Ip         string    `json:"ip"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+// OneTimeToken is a single-use token sent to a user out of band,
+// like a password reset link, the token itself is never stored
+type OneTimeToken struct {
+	// Id is the hex SHA-256 digest of the token
+	Id string `json:"id"`
+	// Purpose is what the token may be used for
+	Purpose string `json:"purpose"`
+	UserId  int    `json:"user_id"`
+	// Email is the address the token was sent to, if it proves ownership of one
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt    time.Time `json:"used_at"`
+}
+
+// newOneTimeToken fills in the stored fields of a one-time token record
+func newOneTimeToken(tokenStr string, token OneTimeToken) OneTimeToken {
+	token.Id = HashToken(tokenStr)
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now().UTC()
+	}
+	token.UsedAt = time.Time{}
+	return token
+}
+
+// usable reports why the token cannot be used at now, if it cannot
+func (token OneTimeToken) usable(now time.Time) error {
+	if !token.UsedAt.IsZero() {
+		return ErrTokenUsed
+	}
+	if !token.ExpiresAt.After(now) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// LoginThrottle counts the failed logins of an account or a client address
+type LoginThrottle struct {
+	// Key is what the failures are counted by, like "email:user@example.com"
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	LastFailedAt time.Time `json:"last_failed_at"`
+	// Lockouts counts how often the failures reached the limit
+	Lockouts    int       `json:"lockouts"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// PersonalToken is a long-lived token a user creates for scripts and
+// integrations, it is limited to its scopes and never stored itself
+type PersonalToken struct {
+	// Id is the hex SHA-256 digest of the token
+	Id     string   `json:"id"`
+	UserId int      `json:"user_id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is zero for tokens that don't expire
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// newPersonalToken fills in the stored fields of a personal access token record
+func newPersonalToken(tokenStr string, token PersonalToken) PersonalToken {
+	token.Id = HashToken(tokenStr)
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now().UTC()
+	}
+	token.LastUsedAt = time.Time{}
+	return token
+}
+
+// sortPersonalTokens orders tokens by creation, newest first
+func sortPersonalTokens(tokens []PersonalToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+}
+
+// OAuthClient is a third-party app registered to act on behalf of users
+type OAuthClient struct {
+	// Id is the public client id
+	Id string `json:"id"`
+	// SecretHash is the hex SHA-256 digest of the client secret,
+	// it is empty for public clients like mobile and browser apps
+	SecretHash   string    `json:"secret_hash"`
+	OwnerId      int       `json:"owner_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// newOAuthClient fills in the stored fields of a client record
+func newOAuthClient(client OAuthClient) OAuthClient {
+	if client.CreatedAt.IsZero() {
+		client.CreatedAt = time.Now().UTC()
+	}
+	return client
+}
+
+// sortOAuthClients orders clients by registration, newest first
+func sortOAuthClients(clients []OAuthClient) {
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].CreatedAt.After(clients[j].CreatedAt)
+	})
+}
+
+// OAuthCode is an authorization code a user granted a client,
+// the code itself is never stored
+type OAuthCode struct {
+	// Id is the hex SHA-256 digest of the code
+	Id          string   `json:"id"`
+	ClientId    string   `json:"client_id"`
+	UserId      int      `json:"user_id"`
+	RedirectURI string   `json:"redirect_uri"`
+	Scopes      []string `json:"scopes"`
+	// CodeChallenge is the PKCE S256 challenge the code verifier must match
+	CodeChallenge string    `json:"code_challenge"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	UsedAt        time.Time `json:"used_at"`
+	// FamilyId is the refresh token family the code was exchanged for,
+	// it is revoked if the code is presented again
+	FamilyId string `json:"family_id"`
+}
+
+// newOAuthCode fills in the stored fields of an authorization code record
+func newOAuthCode(codeStr string, code OAuthCode) OAuthCode {
+	code.Id = HashToken(codeStr)
+	if code.CreatedAt.IsZero() {
+		code.CreatedAt = time.Now().UTC()
+	}
+	code.UsedAt = time.Time{}
+	code.FamilyId = ""
+	return code
+}
+
+// usable reports why the code cannot be exchanged at now, if it cannot
+func (code OAuthCode) usable(now time.Time) error {
+	if !code.UsedAt.IsZero() {
+		return ErrTokenUsed
+	}
+	if !code.ExpiresAt.After(now) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// ExternalIdentity links an account at an OpenID Connect provider to a user
+type ExternalIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	UserId  int    `json:"user_id"`
+	// Email is the address the provider last reported
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+// externalIdentityKey is the key an identity is stored under,
+// subjects are only unique per issuer
+func externalIdentityKey(issuer string, subject string) string {
+	return issuer + " " + subject
+}
+
+// TokenPurge counts the tokens deleted by PurgeTokens
+type TokenPurge struct {
+	Expired int
+	Revoked int
+	// OneTime counts expired or used one-time tokens
+	OneTime int
+	// OAuthCodes counts expired authorization codes
+	OAuthCodes int
+	// Personal counts expired personal access tokens
+	Personal int
+}
+
+// HashToken returns the digest a token is stored and looked up by
+func HashToken(tokenStr string) string {
+	sum := sha256.Sum256([]byte(tokenStr))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshToken fills in the stored fields of a token record
+func newRefreshToken(tokenStr string, token RefreshToken) RefreshToken {
+	token.Id = HashToken(tokenStr)
+	if token.FamilyId == "" {
+		token.FamilyId = token.Id
+	}
+	token.ReplacedBy = ""
+	if token.IssuedAt.IsZero() {
+		token.IssuedAt = time.Now().UTC()
+	}
+	token.RevokedAt = time.Time{}
+	return token
+}
+
+// sortTokens orders tokens from the most recently issued
+func sortTokens(tokens []RefreshToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].IssuedAt.Equal(tokens[j].IssuedAt) {
+			return tokens[i].IssuedAt.After(tokens[j].IssuedAt)
+		}
+		return tokens[i].Id < tokens[j].Id
+	})
+}
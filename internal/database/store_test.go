@@ -0,0 +1,214 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// forEachStore runs test against a new store of every backend
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("json", func(t *testing.T) {
+		db := openTestDB(t, filepath.Join(t.TempDir(), "database.json"))
+		defer db.Close()
+		test(t, db)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"))
+		if err != nil {
+			t.Fatalf("NewSQLiteDB: %s", err)
+		}
+		defer db.Close()
+		test(t, db)
+	})
+}
+
+func TestUseOAuthCodeChecksBeforeUsing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user, err := store.CreateUser("a@x.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.CreateOAuthCode("code", OAuthCode{
+			ClientId:  "client",
+			UserId:    user.Id,
+			ExpiresAt: time.Now().Add(time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errRejected := errors.New("rejected")
+		_, err = store.UseOAuthCode("code", "family", func(code OAuthCode) error {
+			return errRejected
+		})
+		if !errors.Is(err, errRejected) {
+			t.Fatalf("UseOAuthCode returned %v, want the error of check", err)
+		}
+		// a rejected request doesn't use up the code
+		code, err := store.UseOAuthCode("code", "family", func(code OAuthCode) error {
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("the code can't be used after a rejected attempt: %s", err)
+		}
+		if code.FamilyId != "family" || code.UsedAt.IsZero() {
+			t.Fatalf("used code is %+v", code)
+		}
+		code, err = store.UseOAuthCode("code", "other", func(code OAuthCode) error {
+			t.Error("check called for a used code")
+			return nil
+		})
+		if !errors.Is(err, ErrTokenUsed) || code.FamilyId != "family" {
+			t.Fatalf("using the code again returned %+v (%v), want ErrTokenUsed with the first family", code, err)
+		}
+	})
+}
+
+func TestRotateTokenReuseRevokesFamily(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user, err := store.CreateUser("a@x.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expires := time.Now().Add(time.Hour)
+		first, err := store.CreateToken("first", RefreshToken{FamilyId: "family", UserId: user.Id, ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// another login of the same user is not affected
+		_, err = store.CreateToken("other", RefreshToken{FamilyId: "other", UserId: user.Id, ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := store.RotateToken("first", "second", RefreshToken{ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.FamilyId != first.FamilyId || second.UserId != user.Id {
+			t.Fatalf("rotated token is %+v, want it in the family of %+v", second, first)
+		}
+		_, err = store.RotateToken("second", "third", RefreshToken{ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// presenting the first token again revokes the family
+		_, err = store.RotateToken("first", "stolen", RefreshToken{ExpiresAt: expires})
+		if !errors.Is(err, ErrTokenReused) {
+			t.Fatalf("reusing a rotated token returned %v, want ErrTokenReused", err)
+		}
+		third, err := store.GetToken("third")
+		if err != nil || third.RevokedAt.IsZero() {
+			t.Fatalf("latest token of the family is %+v (%v), want it revoked", third, err)
+		}
+		if _, err := store.GetToken("stolen"); !errors.Is(err, ErrTokenNotFound) {
+			t.Fatalf("reuse issued a token: %v", err)
+		}
+		other, err := store.GetToken("other")
+		if err != nil || !other.RevokedAt.IsZero() {
+			t.Fatalf("token of another family is %+v (%v), want it active", other, err)
+		}
+	})
+}
+
+func TestEmailsAreUniqueIgnoringCase(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user, err := store.CreateUser("Ärger@Example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOCASE alone would only fold the ASCII letters
+		_, err = store.CreateUser(" ärger@example.COM", "hash")
+		if !errors.Is(err, ErrEmailTaken) {
+			t.Fatalf("creating a user with the same email in other case returned %v, want ErrEmailTaken", err)
+		}
+		found, err := store.GetUserByEmail("ÄRGER@EXAMPLE.COM")
+		if err != nil || found.Id != user.Id {
+			t.Fatalf("looking up the email in other case found %+v (%v)", found, err)
+		}
+
+		other, err := store.CreateUser("other@example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.UpdateUser(other.Id, "ärger@example.com", "hash")
+		if !errors.Is(err, ErrEmailTaken) {
+			t.Fatalf("UpdateUser to a taken email returned %v, want ErrEmailTaken", err)
+		}
+		_, err = store.ModifyUser(other.Id, func(user *User) error {
+			user.Email = "ÄRGER@example.com"
+			return nil
+		})
+		if !errors.Is(err, ErrEmailTaken) {
+			t.Fatalf("ModifyUser to a taken email returned %v, want ErrEmailTaken", err)
+		}
+		// a user may change the case of their own email
+		_, err = store.UpdateUser(user.Id, "ärger@example.com", "hash")
+		if err != nil {
+			t.Fatalf("changing the case of the own email: %s", err)
+		}
+	})
+}
+
+func TestDeletePersonalTokensByUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		for _, token := range []struct {
+			tokenStr string
+			userID   int
+		}{{"first", 1}, {"second", 1}, {"other", 2}} {
+			_, err := store.CreatePersonalToken(token.tokenStr, PersonalToken{
+				UserId: token.userID,
+				Name:   token.tokenStr,
+				Scopes: []string{"chirps:read"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		deleted, err := store.DeletePersonalTokensByUser(1)
+		if err != nil || deleted != 2 {
+			t.Fatalf("DeletePersonalTokensByUser returned %d (%v), want 2", deleted, err)
+		}
+		if tokens, err := store.GetPersonalTokensByUser(1); err != nil || len(tokens) != 0 {
+			t.Fatalf("tokens left are %+v (%v)", tokens, err)
+		}
+		if _, err := store.GetPersonalToken("other"); err != nil {
+			t.Fatalf("token of another user: %s", err)
+		}
+	})
+}
+
+func TestPurgeTokensCountsAuthorizationCodesApart(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user, err := store.CreateUser("a@x.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		_, err = store.CreateOneTimeToken("reset", OneTimeToken{
+			Purpose:   "password_reset",
+			UserId:    user.Id,
+			ExpiresAt: now.Add(-time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, codeStr := range []string{"expired", "also expired"} {
+			_, err = store.CreateOAuthCode(codeStr, OAuthCode{
+				ClientId:  "client",
+				UserId:    user.Id,
+				ExpiresAt: now.Add(-time.Minute),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		purge, err := store.PurgeTokens(now, now.Add(-time.Hour))
+		if err != nil || purge.OneTime != 1 || purge.OAuthCodes != 2 {
+			t.Fatalf("PurgeTokens returned %+v (%v), want 1 one-time token and 2 codes", purge, err)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// table is one map of DBStructure. Reads go to rows directly, writes go
+// through set and delete so that an open transaction journals the keys it
+// changes, which is all Update has to log, index or roll back
+type table[K comparable, V any] struct {
+	rows map[K]V
+	// changes holds the value every key changed by the open transaction had
+	// before it, it is nil outside of transactions
+	changes map[K]rowChange[V]
+}
+
+// rowChange is the value a row had before a transaction changed it
+type rowChange[V any] struct {
+	prev    V
+	existed bool
+}
+
+func newTable[K comparable, V any]() table[K, V] {
+	return table[K, V]{rows: make(map[K]V)}
+}
+
+// journal records the current value of k unless the open transaction already did
+func (t *table[K, V]) journal(k K) {
+	if t.changes == nil {
+		return
+	}
+	if _, ok := t.changes[k]; ok {
+		return
+	}
+	prev, existed := t.rows[k]
+	t.changes[k] = rowChange[V]{prev: prev, existed: existed}
+}
+
+func (t *table[K, V]) set(k K, v V) {
+	t.journal(k)
+	t.rows[k] = v
+}
+
+func (t *table[K, V]) delete(k K) {
+	if _, ok := t.rows[k]; !ok {
+		return
+	}
+	t.journal(k)
+	delete(t.rows, k)
+}
+
+// begin starts journaling the changes of a transaction
+func (t *table[K, V]) begin() {
+	t.changes = make(map[K]rowChange[V])
+}
+
+// end stops journaling and forgets the changes, keeping them
+func (t *table[K, V]) end() {
+	t.changes = nil
+}
+
+// rollback undoes the changes of the open transaction
+func (t *table[K, V]) rollback() {
+	for k, c := range t.changes {
+		if c.existed {
+			t.rows[k] = c.prev
+		} else {
+			delete(t.rows, k)
+		}
+	}
+	t.changes = nil
+}
+
+// ops returns the log operations for the rows the open transaction changed,
+// rows set back to their old value are left out
+func (t *table[K, V]) ops(name string, formatKey func(K) string) ([]walOp, error) {
+	ops := []walOp{}
+	for k, c := range t.changes {
+		v, ok := t.rows[k]
+		switch {
+		case ok && c.existed && reflect.DeepEqual(c.prev, v):
+		case ok:
+			dat, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, walOp{Table: name, Key: formatKey(k), Value: dat})
+		case c.existed:
+			ops = append(ops, walOp{Table: name, Key: formatKey(k), Delete: true})
+		}
+	}
+	return ops, nil
+}
+
+func (t table[K, V]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.rows)
+}
+
+func (t *table[K, V]) UnmarshalJSON(dat []byte) error {
+	return json.Unmarshal(dat, &t.rows)
+}
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// walRecord is one committed transaction in the write-ahead log,
+// every record is a single line so a torn write only loses the last one
+type walRecord struct {
+	Lsn int64   `json:"lsn"`
+	Ops []walOp `json:"ops"`
+}
+
+// walOp replaces or deletes one entry of a table
+type walOp struct {
+	Table  string          `json:"table"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Delete bool            `json:"delete,omitempty"`
+}
+
+// walTable reaches one table of DBStructure without knowing its types
+type walTable struct {
+	begin    func(dbs *DBStructure)
+	end      func(dbs *DBStructure)
+	rollback func(dbs *DBStructure)
+	ops      func(dbs *DBStructure) ([]walOp, error)
+}
+
+// walTables lists every table that is persisted through the log
+var walTables = []walTable{
+	tableOf("sequences", func(dbs *DBStructure) *table[string, int] { return &dbs.Sequences }, formatString),
+	tableOf("users", func(dbs *DBStructure) *table[int, User] { return &dbs.Users }, strconv.Itoa),
+	tableOf("chirps", func(dbs *DBStructure) *table[int, Chirp] { return &dbs.Chirps }, strconv.Itoa),
+	tableOf("refresh_tokens", func(dbs *DBStructure) *table[string, RefreshToken] { return &dbs.RefreshTokens }, formatString),
+	tableOf("one_time_tokens", func(dbs *DBStructure) *table[string, OneTimeToken] { return &dbs.OneTimeTokens }, formatString),
+	tableOf("login_throttles", func(dbs *DBStructure) *table[string, LoginThrottle] { return &dbs.LoginThrottles }, formatString),
+	tableOf("personal_tokens", func(dbs *DBStructure) *table[string, PersonalToken] { return &dbs.PersonalTokens }, formatString),
+	tableOf("oauth_clients", func(dbs *DBStructure) *table[string, OAuthClient] { return &dbs.OAuthClients }, formatString),
+	tableOf("oauth_codes", func(dbs *DBStructure) *table[string, OAuthCode] { return &dbs.OAuthCodes }, formatString),
+	tableOf("external_identities", func(dbs *DBStructure) *table[string, ExternalIdentity] {
+		return &dbs.ExternalIdentities
+	}, formatString),
+}
+
+func formatString(s string) string {
+	return s
+}
+
+// tableOf builds the walTable for a table field of DBStructure,
+// name is the key of the table in the database file
+func tableOf[K comparable, V any](name string, field func(*DBStructure) *table[K, V],
+	formatKey func(K) string) walTable {
+	return walTable{
+		begin:    func(dbs *DBStructure) { field(dbs).begin() },
+		end:      func(dbs *DBStructure) { field(dbs).end() },
+		rollback: func(dbs *DBStructure) { field(dbs).rollback() },
+		ops: func(dbs *DBStructure) ([]walOp, error) {
+			return field(dbs).ops(name, formatKey)
+		},
+	}
+}
+
+// beginTx starts journaling the changes made to every table of dbs
+func beginTx(dbs *DBStructure) {
+	for _, t := range walTables {
+		t.begin(dbs)
+	}
+}
+
+// endTx stops journaling and keeps the changes,
+// or undoes them if rollback is set
+func endTx(dbs *DBStructure, rollback bool) {
+	for _, t := range walTables {
+		if rollback {
+			t.rollback(dbs)
+		} else {
+			t.end(dbs)
+		}
+	}
+}
+
+// txOps returns the log operations for the changes journaled since beginTx
+func txOps(dbs *DBStructure) ([]walOp, error) {
+	ops := []walOp{}
+	for _, t := range walTables {
+		tableOps, err := t.ops(dbs)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, tableOps...)
+	}
+	return ops, nil
+}
+
+// walPath returns the path of the log that belongs to the database file at path
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+// openWAL opens the log for appending and replays every record newer than
+// the snapshot onto doc, a torn or corrupt tail is cut off.
+// Records are always written in the schema of the snapshot they follow,
+// so they are replayed before the snapshot is migrated.
+// stale reports that some records are not sealed with the current key
+func openWAL(path string, doc document, ring *keyring) (f *os.File, lsn int64, replayed int, stale bool, err error) {
+	lsn, err = doc.lsn()
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	f, err = os.OpenFile(walPath(path), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	var good int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			f.Close()
+			return nil, 0, 0, false, err
+		}
+		if err == io.EOF {
+			log.Printf("database: discarding torn write-ahead log tail at offset %d", good)
+			break
+		}
+		plain, staleLine, err := ring.open(bytes.TrimSpace(line))
+		if errors.Is(err, ErrEncrypted) {
+			f.Close()
+			return nil, 0, 0, false, err
+		}
+		rec := walRecord{}
+		if err != nil || json.Unmarshal(plain, &rec) != nil {
+			log.Printf("database: discarding torn write-ahead log tail at offset %d", good)
+			break
+		}
+		good += int64(len(line))
+		if rec.Lsn <= lsn {
+			continue
+		}
+		if rec.Lsn != lsn+1 {
+			log.Printf("database: write-ahead log jumps from lsn %d to %d", lsn, rec.Lsn)
+		}
+		err = doc.applyRecord(rec)
+		if err != nil {
+			f.Close()
+			return nil, 0, 0, false, fmt.Errorf("replaying lsn %d: %w", rec.Lsn, err)
+		}
+		lsn = rec.Lsn
+		replayed++
+		stale = stale || staleLine
+	}
+	err = f.Truncate(good)
+	if err == nil {
+		_, err = f.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, false, err
+	}
+	return f, lsn, replayed, stale, nil
+}
+
+// appendWAL durably appends rec to the log,
+// a failed append is cut off again so later records stay readable
+func appendWAL(f *os.File, rec walRecord, ring *keyring) error {
+	dat, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	dat, err = ring.seal(dat)
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(dat, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(offset)
+		f.Seek(offset, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
+// resetWAL empties the log once its records are part of the snapshot
+func resetWAL(f *os.File) error {
+	err := f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,263 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, path string, opts ...Option) *DB {
+	t.Helper()
+	db, err := NewDB(path, append([]Option{WithCompactInterval(time.Hour)}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	return db
+}
+
+// walRecords reads the records in the log of the database file at path
+func walRecords(t *testing.T, path string) []walRecord {
+	t.Helper()
+	f, err := os.Open(walPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := []walRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		rec := walRecord{}
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			t.Fatalf("decoding log record: %s", err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// crashCopy copies the database file and its log to a new directory,
+// as they would be found after the process died without closing db
+func crashCopy(t *testing.T, path string) string {
+	t.Helper()
+	copyPath := filepath.Join(t.TempDir(), "database.json")
+	for _, pair := range [][2]string{{path, copyPath}, {walPath(path), walPath(copyPath)}} {
+		dat, err := os.ReadFile(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(pair[1], dat, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return copyPath
+}
+
+func TestUpdateLogsOnlyChangedRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	defer db.Close()
+	for _, email := range []string{"a@x.com", "b@x.com", "c@x.com"} {
+		_, err := db.CreateUser(email, "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.UpgradeUser(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := walRecords(t, path)
+	last := records[len(records)-1]
+	if len(last.Ops) != 1 || last.Ops[0].Table != "users" || last.Ops[0].Key != "2" {
+		t.Fatalf("upgrading one user logged %+v, want a single users/2 op", last.Ops)
+	}
+
+	// setting a row back to its value is not a change
+	err = db.Update(func(dbs *DBStructure) error {
+		user := dbs.Users.rows[1]
+		dbs.Users.set(1, User{})
+		dbs.Users.set(1, user)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(walRecords(t, path)); n != len(records) {
+		t.Fatalf("a no-op transaction appended %d records", n-len(records))
+	}
+}
+
+func TestUpdateRollsBackOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	defer db.Close()
+	user, err := db.CreateUser("a@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(walRecords(t, path))
+
+	errAbort := errors.New("abort")
+	err = db.Update(func(dbs *DBStructure) error {
+		changed := dbs.Users.rows[user.Id]
+		changed.Email = "changed@x.com"
+		dbs.Users.set(user.Id, changed)
+		dbs.Users.delete(user.Id)
+		nextID(dbs, "users")
+		dbs.Chirps.set(99, Chirp{Id: 99, AuthorId: user.Id})
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Update returned %v, want the error of fn", err)
+	}
+
+	got, err := db.GetUserByEmail("a@x.com")
+	if err != nil || !reflect.DeepEqual(got, user) {
+		t.Fatalf("user after rollback is %+v (%v), want %+v", got, err, user)
+	}
+	if _, err := db.GetUserByEmail("changed@x.com"); !errors.Is(err, ErrEmailNotFound) {
+		t.Fatalf("rolled back email is still indexed: %v", err)
+	}
+	if _, err := db.GetChirpByID(99); err == nil {
+		t.Fatal("rolled back chirp exists")
+	}
+	next, err := db.CreateUser("b@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Id != user.Id+1 {
+		t.Fatalf("rolled back sequence handed out id %d, want %d", next.Id, user.Id+1)
+	}
+	if n := len(walRecords(t, path)); n != before+1 {
+		t.Fatalf("log has %d new records, want only the one of the second user", n-before)
+	}
+}
+
+func TestReplayAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	defer db.Close()
+	user, err := db.CreateUser("a@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.CreateChirp("first", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("second", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DeleteChirp(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crashed := crashCopy(t, path)
+	// a record torn by the crash is cut off
+	f, err := os.OpenFile(walPath(crashed), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"lsn":99,"ops":[{"table":"users","key":"7"`)
+	f.Close()
+
+	recovered := openTestDB(t, crashed)
+	defer recovered.Close()
+	chirps, err := recovered.GetChirpsByAuthor(user.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "second" {
+		t.Fatalf("replayed chirps are %+v, want only the second", chirps)
+	}
+	if _, err := recovered.GetUserByEmail("a@x.com"); err != nil {
+		t.Fatalf("replayed user: %s", err)
+	}
+	// replay folds the log into the snapshot
+	if n := len(walRecords(t, crashed)); n != 0 {
+		t.Fatalf("log has %d records after replay, want 0", n)
+	}
+	next, err := recovered.CreateChirp("third", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Id != 3 {
+		t.Fatalf("chirp after replay got id %d, want 3", next.Id)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	for i := 0; i < compactThreshold+1; i++ {
+		_, err := db.ModifyLoginThrottle("ip:127.0.0.1", func(throttle *LoginThrottle) error {
+			throttle.Failures++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(walRecords(t, path)); n >= compactThreshold {
+		t.Fatalf("log has %d records, want it compacted at %d", n, compactThreshold)
+	}
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(walRecords(t, path)); n != 0 {
+		t.Fatalf("log has %d records after Close, want 0", n)
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := DBStructure{}
+	err = json.Unmarshal(dat, &snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshot.LoginThrottles.rows["ip:127.0.0.1"].Failures; got != compactThreshold+1 {
+		t.Fatalf("snapshot counts %d failures, want %d", got, compactThreshold+1)
+	}
+
+	reopened := openTestDB(t, path)
+	defer reopened.Close()
+	throttle, err := reopened.GetLoginThrottle("ip:127.0.0.1")
+	if err != nil || throttle.Failures != compactThreshold+1 {
+		t.Fatalf("reopened throttle is %+v (%v)", throttle, err)
+	}
+}
+
+func TestCloseTwiceAndNonPositiveCompactInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	for _, d := range []time.Duration{0, -time.Second} {
+		db, err := NewDB(path, WithCompactInterval(d))
+		if err != nil {
+			t.Fatalf("NewDB with compact interval %s: %s", d, err)
+		}
+		if db.compactInterval != defaultCompactInterval {
+			t.Fatalf("compact interval %s was taken, want the default", d)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatalf("second Close: %s", err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// kidTimeFormat names generated keys so that newer keys sort last
+const kidTimeFormat = "20060102T150405Z"
+
+// Generate writes a new private key for alg, EdDSA or RS256, to dir
+// and returns its id, a running set picks it up the next time it is loaded
+func Generate(dir string, alg string) (string, error) {
+	var private any
+	var err error
+	switch alg {
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, minRSABits)
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	kid := fmt.Sprintf("%s-%s", time.Now().UTC().Format(kidTimeFormat), alg)
+	f, err := os.OpenFile(filepath.Join(dir, kid+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return kid, nil
+}
+
+// Retire replaces the private key kid in dir with its public half,
+// tokens it signed stay verifiable but it can no longer sign new ones
+func Retire(dir string, kid string) error {
+	path := filepath.Join(dir, kid+".pem")
+	key, err := loadKey(path)
+	if err != nil {
+		return err
+	}
+	if key.private == nil {
+		return fmt.Errorf("key %q is already retired", kid)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,211 @@
+// Package keys signs and verifies JWTs with a set of asymmetric keys
+// loaded from a directory and publishes their public halves as a JWKS
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const minRSABits = 2048
+
+var ErrNoSigningKey = errors.New("no signing key is configured")
+
+// Key is one signing key, or a verification key if it has no private half,
+// its id is the name of the file it was loaded from without the extension
+type Key struct {
+	Id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// Alg returns the JWS algorithm of the key
+func (k *Key) Alg() string {
+	return k.method.Alg()
+}
+
+// Set holds every key tokens may be signed with and the one new tokens are signed with,
+// a legacy HMAC secret keeps tokens without a key id verifiable
+type Set struct {
+	signing *Key
+	keys    map[string]*Key
+	legacy  []byte
+	// legacyCutoff is when the legacy secret stopped signing,
+	// it verifies no token issued later
+	legacyCutoff time.Time
+}
+
+// NewSet loads every *.pem file in dir, which may be empty to load none.
+// PKCS #8 or PKCS #1 private keys can sign and verify, PKIX public keys only verify.
+// The private key named signingKid signs new tokens, or the one whose name
+// sorts last if signingKid is empty. Without any private key new tokens
+// are signed with HS256 and legacySecret. Once a private key signs, legacySecret
+// only verifies tokens issued before legacyCutoff, or before the oldest key file
+// was written if legacyCutoff is zero.
+func NewSet(dir string, signingKid string, legacySecret []byte, legacyCutoff time.Time) (*Set, error) {
+	s := Set{keys: make(map[string]*Key), legacy: legacySecret}
+	var introduced time.Time
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			key, err := loadKey(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if introduced.IsZero() || info.ModTime().Before(introduced) {
+				introduced = info.ModTime()
+			}
+			s.keys[key.Id] = key
+			if key.private != nil && signingKid == "" {
+				s.signing = key
+			}
+		}
+	}
+	if signingKid != "" {
+		key, ok := s.keys[signingKid]
+		if !ok || key.private == nil {
+			return nil, fmt.Errorf("no private key with id %q in %s", signingKid, dir)
+		}
+		s.signing = key
+	}
+	if s.signing == nil && len(s.legacy) == 0 {
+		return nil, ErrNoSigningKey
+	}
+	if s.signing != nil && len(s.legacy) > 0 {
+		s.legacyCutoff = legacyCutoff
+		if s.legacyCutoff.IsZero() {
+			s.legacyCutoff = introduced
+		}
+	}
+	return &s, nil
+}
+
+// loadKey parses a single PEM file
+func loadKey(path string) (*Key, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := Key{Id: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.method, key.public = jwt.SigningMethodEdDSA, k
+	case *rsa.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodRS256, k, k.Public()
+	case *rsa.PublicKey:
+		key.method, key.public = jwt.SigningMethodRS256, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	if pub, ok := key.public.(*rsa.PublicKey); ok && pub.N.BitLen() < minRSABits {
+		return nil, fmt.Errorf("RSA key is %d bits, want at least %d", pub.N.BitLen(), minRSABits)
+	}
+	return &key, nil
+}
+
+// Sign signs claims with the signing key and names it in the kid header
+func (s *Set) Sign(claims jwt.Claims) (string, error) {
+	if s.signing == nil {
+		if len(s.legacy) == 0 {
+			return "", ErrNoSigningKey
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.legacy)
+	}
+	token := jwt.NewWithClaims(s.signing.method, claims)
+	token.Header["kid"] = s.signing.Id
+	return token.SignedString(s.signing.private)
+}
+
+// Keyfunc finds the key a token was signed with for jwt.Parse,
+// a token has to use the algorithm of the key it names
+func (s *Set) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() || len(s.legacy) == 0 {
+			return nil, errors.New("token has no key id")
+		}
+		if !s.legacyCutoff.IsZero() {
+			// whoever still holds the secret must not be able to mint new tokens with it
+			issuedAt, err := token.Claims.GetIssuedAt()
+			if err != nil || issuedAt == nil || !issuedAt.Before(s.legacyCutoff) {
+				return nil, errors.New("token was signed with the legacy secret after it was retired")
+			}
+		}
+		return s.legacy, nil
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %q does not sign with %s", kid, token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+// Methods lists the algorithms tokens may be signed with
+func (s *Set) Methods() []string {
+	methods := []string{}
+	if len(s.legacy) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	for _, key := range s.keys {
+		if !slices.Contains(methods, key.Alg()) {
+			methods = append(methods, key.Alg())
+		}
+	}
+	return methods
+}
+
+// SigningKey returns the key new tokens are signed with, nil for the legacy secret
+func (s *Set) SigningKey() *Key {
+	return s.signing
+}
+
+// LegacyCutoff returns when the legacy secret stopped signing,
+// zero if it still signs or there is none
+func (s *Set) LegacyCutoff() time.Time {
+	return s.legacyCutoff
+}
@@ -0,0 +1,222 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// verify parses tokenStr like the server does
+func verify(s *Set, tokenStr string) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, s.Keyfunc, jwt.WithValidMethods(s.Methods()))
+}
+
+func TestSignAndVerifyAcrossRotation(t *testing.T) {
+	dir := t.TempDir()
+	edKid, err := Generate(dir, "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKid, err := Generate(dir, "RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a signing kid the key whose name sorts last signs
+	s, err := NewSet(dir, "", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.SigningKey().Id != rsaKid {
+		t.Fatalf("signing key is %s, want %s", s.SigningKey().Id, rsaKid)
+	}
+	s, err = NewSet(dir, edKid, nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStr, err := s.Sign(jwt.RegisteredClaims{Subject: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := verify(s, tokenStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != edKid || token.Method.Alg() != "EdDSA" {
+		t.Fatalf("token header is %v", token.Header)
+	}
+
+	// a retired key can't sign but its tokens still verify
+	err = Retire(dir, edKid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Retire(dir, edKid); err == nil {
+		t.Fatal("retiring a key twice succeeded")
+	}
+	if _, err := NewSet(dir, edKid, nil, time.Time{}); err == nil {
+		t.Fatal("a retired key was made the signing key")
+	}
+	rotated, err := NewSet(dir, "", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.SigningKey().Id != rsaKid {
+		t.Fatalf("signing key after retiring is %s, want %s", rotated.SigningKey().Id, rsaKid)
+	}
+	if _, err := verify(rotated, tokenStr); err != nil {
+		t.Fatalf("token of the retired key: %s", err)
+	}
+}
+
+func TestLegacySecret(t *testing.T) {
+	secret := []byte("secret")
+	legacy, err := NewSet("", "", secret, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStr, err := legacy.Sign(jwt.RegisteredClaims{
+		Subject:  "1",
+		IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(legacy, tokenStr); err != nil {
+		t.Fatalf("token of the secret while it signs: %s", err)
+	}
+
+	dir := t.TempDir()
+	kid, err := Generate(dir, "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSet(dir, "", secret, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(s, tokenStr); err != nil {
+		t.Fatalf("token of the legacy secret: %s", err)
+	}
+	// once a key signs, the secret only verifies tokens issued before the key was written
+	for name, claims := range map[string]jwt.RegisteredClaims{
+		"issued later":       {Subject: "1", IssuedAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+		"without issue time": {Subject: "1"},
+	} {
+		minted, err := legacy.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verify(s, minted); err == nil {
+			t.Errorf("a legacy token %s verified", name)
+		}
+	}
+	cutoff, err := NewSet(dir, "", secret, time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(cutoff, tokenStr); err == nil {
+		t.Error("a legacy token issued after the configured cutoff verified")
+	}
+	// nothing signed with the secret may claim to come from a key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	forged.Header["kid"] = kid
+	forgedStr, err := forged.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(s, forgedStr); err == nil {
+		t.Fatal("an HS256 token naming an EdDSA key verified")
+	}
+	withoutSecret, err := NewSet(dir, "", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(withoutSecret, tokenStr); err == nil {
+		t.Fatal("a token without key id verified without a legacy secret")
+	}
+
+	if _, err := NewSet("", "", nil, time.Time{}); !errors.Is(err, ErrNoSigningKey) {
+		t.Fatalf("NewSet without keys returned %v, want ErrNoSigningKey", err)
+	}
+}
+
+func TestUnknownKeyID(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Generate(dir, "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSet(dir, "", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.RegisteredClaims{Subject: "1"})
+	token.Header["kid"] = "elsewhere"
+	tokenStr, err := token.SignedString(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(s, tokenStr); err == nil {
+		t.Fatal("a token of an unknown key verified")
+	}
+}
+
+func TestLoadKeyRejectsWeakRSA(t *testing.T) {
+	dir := t.TempDir()
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(weak)})
+	err = os.WriteFile(filepath.Join(dir, "weak.pem"), dat, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSet(dir, "", nil, time.Time{}); err == nil {
+		t.Fatal("a 1024 bit RSA key was loaded")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	edKid, err := Generate(dir, "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKid, err := Generate(dir, "RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSet(dir, "", []byte("secret"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := s.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != edKid || jwks.Keys[1].Kid != rsaKid {
+		t.Fatalf("JWKS is %+v, want the two keys ordered by id and no secret", jwks)
+	}
+	ed := jwks.Keys[0]
+	x, err := base64.RawURLEncoding.DecodeString(ed.X)
+	if err != nil || ed.Kty != "OKP" || ed.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+		t.Errorf("Ed25519 JWK is %+v", ed)
+	}
+	rs := jwks.Keys[1]
+	if rs.Kty != "RSA" || rs.E != "AQAB" || rs.Alg != "RS256" || rs.Use != "sig" {
+		t.Errorf("RSA JWK is %+v", rs)
+	}
+}
@@ -0,0 +1,47 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const outboxTimeFormat = "20060102T150405.000000000Z"
+
+// Outbox is a Mailer for local development that writes
+// every message to a .eml file in a directory instead of sending it
+type Outbox struct {
+	dir string
+}
+
+func NewOutbox(dir string) *Outbox {
+	return &Outbox{dir: dir}
+}
+
+// Send writes msg to a new file in the outbox directory
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	now := time.Now().UTC()
+	dat, err := format(msg, now)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(o.dir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(o.dir, now.Format(outboxTimeFormat)+"-*.eml")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(dat)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing %s: %w", filepath.Base(f.Name()), err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTP is a Mailer that hands messages to an SMTP server,
+// STARTTLS is used whenever the server offers it
+type SMTP struct {
+	addr string
+	host string
+	auth smtp.Auth
+}
+
+// NewSMTP returns a Mailer for the server at host:port,
+// it authenticates with PLAIN if username is set, which net/smtp
+// only allows over TLS or to localhost
+func NewSMTP(host string, port int, username string, password string) *SMTP {
+	s := SMTP{addr: net.JoinHostPort(host, strconv.Itoa(port)), host: host}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &s
+}
+
+// Send delivers msg, giving up when ctx is done
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	dat, err := format(msg, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return s.send(client, from.Address, to.Address, dat)
+}
+
+// send runs one mail transaction on an open client
+func (s *SMTP) send(client *smtp.Client, from string, to string, dat []byte) error {
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err := client.StartTLS(&tls.Config{ServerName: s.host})
+		if err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		err := client.Auth(s.auth)
+		if err != nil {
+			return err
+		}
+	}
+	err := client.Mail(from)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(dat)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what a client told the stand-in server
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// startSMTP runs a stand-in SMTP server on localhost that accepts PLAIN auth,
+// rejects recipients at rejectDomain and reports every finished session
+func startSMTP(t *testing.T, rejectDomain string) (string, int, <-chan smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	sessions := make(chan smtpSession, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, rejectDomain, sessions)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, sessions
+}
+
+func serveSMTP(conn net.Conn, rejectDomain string, sessions chan<- smtpSession) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		fmt.Fprintf(conn, "%s\r\n", line)
+	}
+	session := smtpSession{}
+	reply("220 localhost ESMTP stand-in")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0])
+		switch {
+		case verb == "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case verb == "AUTH":
+			session.auth = strings.TrimPrefix(cmd, "AUTH PLAIN ")
+			reply("235 2.7.0 authenticated")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			session.from = strings.TrimPrefix(cmd, "MAIL FROM:")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			rcpt := strings.TrimPrefix(cmd, "RCPT TO:")
+			if rejectDomain != "" && strings.HasSuffix(rcpt, "@"+rejectDomain+">") {
+				reply("550 5.1.1 no such user")
+				continue
+			}
+			session.to = append(session.to, rcpt)
+			reply("250 OK")
+		case verb == "DATA":
+			reply("354 go ahead")
+			data := strings.Builder{}
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			session.data = data.String()
+			reply("250 OK queued")
+		case verb == "QUIT":
+			reply("221 bye")
+			sessions <- session
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	host, port, sessions := startSMTP(t, "")
+	mailer := NewSMTP(host, port, "chirpy", "hunter2")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := mailer.Send(ctx, Message{
+		From:    "Chirpy <no-reply@chirpy.example>",
+		To:      "A User <a@x.com>",
+		Subject: "Verify your email ✓",
+		Body:    "Hello,\nclick the link.\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := <-sessions
+
+	auth, err := base64.StdEncoding.DecodeString(session.auth)
+	if err != nil || string(auth) != "\x00chirpy\x00hunter2" {
+		t.Errorf("PLAIN credentials are %q (%v)", auth, err)
+	}
+	if session.from != "<no-reply@chirpy.example>" || len(session.to) != 1 || session.to[0] != "<a@x.com>" {
+		t.Errorf("envelope is from %s to %v, want the bare addresses", session.from, session.to)
+	}
+	headers, body, ok := strings.Cut(session.data, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("message has no header section: %q", session.data)
+	}
+	for _, want := range []string{
+		"From: Chirpy <no-reply@chirpy.example>",
+		"To: A User <a@x.com>",
+		"Subject: =?utf-8?q?Verify_your_email_=E2=9C=93?=",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	} {
+		if !strings.Contains(headers+"\r\n", want+"\r\n") {
+			t.Errorf("headers lack %q:\n%s", want, headers)
+		}
+	}
+	if !strings.Contains(headers, "Message-ID: <") || !strings.Contains(headers, "@chirpy.example>") {
+		t.Errorf("Message-ID is not in the domain of the sender:\n%s", headers)
+	}
+	if body != "Hello,\r\nclick the link.\r\n" {
+		t.Errorf("body is %q, want CRLF line endings", body)
+	}
+}
+
+func TestSMTPRejectsHeaderInjection(t *testing.T) {
+	host, port, sessions := startSMTP(t, "")
+	mailer := NewSMTP(host, port, "", "")
+	for name, msg := range map[string]Message{
+		"subject": {From: "no-reply@chirpy.example", To: "a@x.com", Subject: "Hi\r\nBcc: victim@x.com"},
+		"to":      {From: "no-reply@chirpy.example", To: "a@x.com\nBcc: victim@x.com", Subject: "Hi"},
+		"from":    {From: "no-reply@chirpy.example\r\nBcc: victim@x.com", To: "a@x.com", Subject: "Hi"},
+	} {
+		if err := mailer.Send(context.Background(), msg); err == nil {
+			t.Errorf("a line break in the %s header was sent", name)
+		}
+	}
+	select {
+	case session := <-sessions:
+		t.Fatalf("the server received a message: %+v", session)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSMTPRejectedRecipient(t *testing.T) {
+	host, port, _ := startSMTP(t, "nowhere.example")
+	mailer := NewSMTP(host, port, "", "")
+	err := mailer.Send(context.Background(), Message{
+		From:    "no-reply@chirpy.example",
+		To:      "a@nowhere.example",
+		Subject: "Hi",
+	})
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("Send returned %v, want the 550 of the server", err)
+	}
+}
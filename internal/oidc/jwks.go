@@ -0,0 +1,174 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyRefreshInterval limits how often an unknown key id refetches the JWKS,
+// so tokens with made up key ids can't hammer the provider
+const keyRefreshInterval = time.Minute
+
+// jwk is a public key as described in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// publicKey decodes the key, keys of unknown types are skipped by the caller
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// keyCache holds the signing keys of the provider,
+// it refetches them when a token names a key it doesn't know
+type keyCache struct {
+	http *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newKeyCache(client *http.Client) *keyCache {
+	return &keyCache{http: client, keys: map[string]crypto.PublicKey{}}
+}
+
+// fetch replaces the cached keys with those published at uri, the caller holds mu
+func (c *keyCache) fetch(ctx context.Context, uri string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	c.fetched = time.Now()
+	err = getJSON(c.http, req, &set)
+	if err != nil {
+		return fmt.Errorf("fetching the JWKS: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	c.keys = keys
+	return nil
+}
+
+// key returns the key kid from the JWKS at uri, a token without a key id
+// can only be verified if the provider publishes a single key
+func (c *keyCache) key(ctx context.Context, uri string, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookup := func() (crypto.PublicKey, bool) {
+		if kid == "" && len(c.keys) == 1 {
+			for _, pub := range c.keys {
+				return pub, true
+			}
+		}
+		pub, ok := c.keys[kid]
+		return pub, ok
+	}
+	if pub, ok := lookup(); ok {
+		return pub, nil
+	}
+	if time.Since(c.fetched) < keyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	err := c.fetch(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := lookup(); ok {
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// keyfunc returns a jwt.Keyfunc resolving keys from the JWKS at uri
+func (c *keyCache) keyfunc(ctx context.Context, uri string) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.key(ctx, uri, kid)
+	}
+}
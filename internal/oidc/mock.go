@@ -0,0 +1,238 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mockKid      = "mock"
+	mockCodeTTL  = time.Minute
+	mockTokenTTL = 5 * time.Minute
+)
+
+// MockProvider is a minimal OpenID Connect provider for local testing, it signs
+// in whoever the authorization request names without asking for a password:
+// the login_hint parameter or else Email, with the email verified unless the
+// request has mock_email_verified=false
+type MockProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Email        string
+
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+// mockGrant is what an authorization code of the mock stands for
+type mockGrant struct {
+	email         string
+	emailVerified bool
+	nonce         string
+	redirectURI   string
+	challenge     string
+	expiresAt     time.Time
+}
+
+// NewMockProvider returns a mock provider with a fresh signing key
+func NewMockProvider(issuer string, clientID string, clientSecret string, email string) (*MockProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockProvider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Email:        email,
+		key:          key,
+		codes:        map[string]mockGrant{},
+	}, nil
+}
+
+// Handler serves discovery, authorization, token and JWKS endpoints
+func (p *MockProvider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+discoveryPath, p.serveDiscovery)
+	mux.HandleFunc("GET /authorize", p.serveAuthorize)
+	mux.HandleFunc("POST /token", p.serveToken)
+	mux.HandleFunc("GET /jwks", p.serveJWKS)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *MockProvider) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *MockProvider) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": mockKid,
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+// serveAuthorize signs the user in at once and sends them back with a code
+func (p *MockProvider) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.ClientID {
+		writeError(w, http.StatusBadRequest, "invalid_request", "unknown client_id")
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid redirect_uri")
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "the code flow with a PKCE S256 challenge is required")
+		return
+	}
+	email := q.Get("login_hint")
+	if email == "" {
+		email = p.Email
+	}
+	if email == "" {
+		writeError(w, http.StatusBadRequest, "login_required", "no login_hint and no default email")
+		return
+	}
+
+	code := make([]byte, 16)
+	_, err = rand.Read(code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	codeStr := hex.EncodeToString(code)
+	p.mu.Lock()
+	p.codes[codeStr] = mockGrant{
+		email:         email,
+		emailVerified: q.Get("mock_email_verified") != "false",
+		nonce:         q.Get("nonce"),
+		redirectURI:   redirectURI.String(),
+		challenge:     q.Get("code_challenge"),
+		expiresAt:     time.Now().Add(mockCodeTTL),
+	}
+	p.mu.Unlock()
+	log.Printf("mock-oidc: signed in %s", email)
+
+	back := redirectURI.Query()
+	back.Set("code", codeStr)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// serveToken exchanges a code for an ID token
+func (p *MockProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if clientID != p.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(p.ClientSecret)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	p.mu.Lock()
+	grant, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if !ok || time.Now().After(grant.expiresAt) || grant.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+		return
+	}
+	if CodeChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match the code_challenge")
+		return
+	}
+
+	// the subject is stable per email, as it would be per account at a real provider
+	sub := sha256.Sum256([]byte(strings.ToLower(grant.email)))
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.Issuer,
+			Subject:   hex.EncodeToString(sub[:8]),
+			Audience:  jwt.ClaimStrings{p.ClientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(mockTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Nonce:         grant.nonce,
+		Email:         grant.email,
+		EmailVerified: Bool(grant.emailVerified),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = mockKid
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken := make([]byte, 16)
+	_, err = rand.Read(accessToken)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": hex.EncodeToString(accessToken),
+		"token_type":   "Bearer",
+		"expires_in":   int(mockTokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
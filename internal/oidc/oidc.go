@@ -0,0 +1,269 @@
+// Package oidc signs users in with an external OpenID Connect provider:
+// it discovers the provider, runs the authorization code flow with PKCE
+// and validates the ID tokens it returns against the provider's JWKS
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// discoveryPath is appended to the issuer to find its metadata
+	discoveryPath = "/.well-known/openid-configuration"
+	httpTimeout   = 10 * time.Second
+	// clockSkew is how far the clocks of the provider and ours may drift apart
+	clockSkew = time.Minute
+	// maxResponseSize caps what is read from the provider
+	maxResponseSize = 1 << 20
+)
+
+// signingMethods are the algorithms ID tokens may be signed with,
+// shared secrets and unsigned tokens are never accepted
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var (
+	ErrNonceMismatch   = errors.New("ID token nonce doesn't match")
+	ErrInvalidAudience = errors.New("ID token wasn't issued to this client")
+)
+
+// Metadata is the part of the provider metadata the relying party uses
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Discover fetches the metadata of the provider issuer,
+// which has to name itself with exactly that issuer
+func Discover(ctx context.Context, client *http.Client, issuer string) (Metadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+discoveryPath, nil)
+	if err != nil {
+		return Metadata{}, err
+	}
+	meta := Metadata{}
+	err = getJSON(client, req, &meta)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("discovering %s: %w", issuer, err)
+	}
+	if meta.Issuer != issuer {
+		return Metadata{}, fmt.Errorf("discovering %s: metadata names issuer %q", issuer, meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return Metadata{}, fmt.Errorf("discovering %s: metadata lacks endpoints", issuer)
+	}
+	return meta, nil
+}
+
+// getJSON sends req and decodes a successful JSON response into v
+func getJSON(client *http.Client, req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dat, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(dat)))
+	}
+	return json.Unmarshal(dat, v)
+}
+
+// Config identifies the relying party to the provider
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, registered with it
+	RedirectURL string
+	// Scopes are requested besides openid
+	Scopes []string
+	// HTTPClient talks to the provider, a client with a timeout if nil
+	HTTPClient *http.Client
+}
+
+// RelyingParty signs users in with one provider, its metadata is
+// discovered on first use so the provider may be down at startup
+type RelyingParty struct {
+	cfg  Config
+	http *http.Client
+	keys *keyCache
+
+	mu   sync.Mutex
+	meta *Metadata
+}
+
+// NewRelyingParty returns a relying party for the provider in cfg
+func NewRelyingParty(cfg Config) *RelyingParty {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: httpTimeout}
+	}
+	return &RelyingParty{cfg: cfg, http: client, keys: newKeyCache(client)}
+}
+
+// Issuer returns the issuer of the provider
+func (rp *RelyingParty) Issuer() string {
+	return rp.cfg.Issuer
+}
+
+// metadata returns the provider metadata, discovering it if it isn't yet
+func (rp *RelyingParty) metadata(ctx context.Context) (Metadata, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.meta != nil {
+		return *rp.meta, nil
+	}
+	meta, err := Discover(ctx, rp.http, rp.cfg.Issuer)
+	if err != nil {
+		return Metadata{}, err
+	}
+	rp.meta = &meta
+	return meta, nil
+}
+
+// CodeChallenge returns the PKCE S256 challenge of verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns where to send the user to sign in with the provider,
+// state and nonce tie the response to this request and verifier is the
+// PKCE code verifier Exchange needs later. loginHint may be empty
+func (rp *RelyingParty) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string,
+	loginHint string) (string, error) {
+	meta, err := rp.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", rp.cfg.ClientID)
+	q.Set("redirect_uri", rp.cfg.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, rp.cfg.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", CodeChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	if loginHint != "" {
+		q.Set("login_hint", loginHint)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange trades an authorization code for the tokens of the user
+// and returns the raw ID token, which still has to be verified
+func (rp *RelyingParty) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	meta, err := rp.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {rp.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if rp.cfg.ClientSecret == "" {
+		form.Set("client_id", rp.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rp.cfg.ClientSecret != "" {
+		// RFC 6749 section 2.3.1 has the credentials form encoded before basic auth
+		req.SetBasicAuth(url.QueryEscape(rp.cfg.ClientID), url.QueryEscape(rp.cfg.ClientSecret))
+	}
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = getJSON(rp.http, req, &tokens)
+	if err != nil {
+		return "", fmt.Errorf("exchanging the authorization code: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("the token endpoint returned no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// Bool is a JSON boolean that some providers send as a string
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(dat []byte) error {
+	switch string(dat) {
+	case "true", `"true"`:
+		*b = true
+	case "false", `"false"`, "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", dat)
+	}
+	return nil
+}
+
+// Claims are the claims of an ID token the relying party uses
+type Claims struct {
+	jwt.RegisteredClaims
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp,omitempty"`
+	Email           string `json:"email,omitempty"`
+	EmailVerified   Bool   `json:"email_verified,omitempty"`
+	Name            string `json:"name,omitempty"`
+}
+
+// VerifyIDToken checks the signature, issuer, audience, lifetime
+// and nonce of an ID token and returns its claims
+func (rp *RelyingParty) VerifyIDToken(ctx context.Context, raw string, nonce string) (Claims, error) {
+	meta, err := rp.metadata(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	claims := Claims{}
+	_, err = jwt.ParseWithClaims(raw, &claims, rp.keys.keyfunc(ctx, meta.JWKSURI),
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(meta.Issuer),
+		jwt.WithAudience(rp.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew))
+	if err != nil {
+		return Claims{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if claims.Subject == "" {
+		return Claims{}, errors.New("invalid ID token: no subject")
+	}
+	// a token for several audiences has to name us as the party it was issued to
+	if (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != rp.cfg.ClientID {
+		return Claims{}, ErrInvalidAudience
+	}
+	if claims.Nonce != nonce {
+		return Claims{}, ErrNonceMismatch
+	}
+	return claims, nil
+}
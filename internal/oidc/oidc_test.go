@@ -0,0 +1,229 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID    = "chirpy"
+	testSecret      = "s3cret&more"
+	testRedirectURL = "https://chirpy.example/api/login/oidc/callback"
+)
+
+// startMock serves a mock provider whose issuer is the URL of the test server
+func startMock(t *testing.T) (*MockProvider, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	mock, err := NewMockProvider("http://"+srv.Listener.Addr().String(), testClientID, testSecret, "default@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Handler = mock.Handler()
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return mock, srv
+}
+
+func newTestRP(srv *httptest.Server) *RelyingParty {
+	return NewRelyingParty(Config{
+		Issuer:       srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: testSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"email"},
+		HTTPClient:   srv.Client(),
+	})
+}
+
+// authorize follows authURL to the mock and returns the query of the redirect back
+func authorize(t *testing.T, srv *httptest.Server, authURL string) url.Values {
+	t.Helper()
+	client := *srv.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization responded %s", resp.Status)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), testRedirectURL+"?") {
+		t.Fatalf("authorization redirected to %s", location)
+	}
+	return location.Query()
+}
+
+func TestLoginWithMock(t *testing.T) {
+	_, srv := startMock(t)
+	rp := newTestRP(srv)
+	ctx := context.Background()
+
+	authURL, err := rp.AuthCodeURL(ctx, "state", "nonce", "verifier", "User@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := url.ParseQuery(authURL[strings.Index(authURL, "?")+1:])
+	if q.Get("scope") != "openid email" || q.Get("code_challenge") != CodeChallenge("verifier") ||
+		q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request is %v", q)
+	}
+	back := authorize(t, srv, authURL)
+	if back.Get("state") != "state" {
+		t.Fatalf("state came back as %q", back.Get("state"))
+	}
+
+	raw, err := rp.Exchange(ctx, back.Get("code"), "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := rp.VerifyIDToken(ctx, raw, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != srv.URL || claims.Email != "User@x.com" || !bool(claims.EmailVerified) || claims.Subject == "" {
+		t.Fatalf("claims are %+v", claims)
+	}
+	if _, err := rp.VerifyIDToken(ctx, raw, "other"); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("verifying with another nonce returned %v, want ErrNonceMismatch", err)
+	}
+	// codes are single use
+	if _, err := rp.Exchange(ctx, back.Get("code"), "verifier"); err == nil {
+		t.Fatal("a code was exchanged twice")
+	}
+}
+
+func TestExchangeRequiresVerifier(t *testing.T) {
+	_, srv := startMock(t)
+	rp := newTestRP(srv)
+	ctx := context.Background()
+	authURL, err := rp.AuthCodeURL(ctx, "state", "nonce", "verifier", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := authorize(t, srv, authURL+"&mock_email_verified=false")
+	if _, err := rp.Exchange(ctx, back.Get("code"), "other"); err == nil {
+		t.Fatal("the code was exchanged with the wrong verifier")
+	}
+
+	authURL, _ = rp.AuthCodeURL(ctx, "state", "nonce", "verifier", "")
+	back = authorize(t, srv, authURL+"&mock_email_verified=false")
+	raw, err := rp.Exchange(ctx, back.Get("code"), "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := rp.VerifyIDToken(ctx, raw, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "default@x.com" || bool(claims.EmailVerified) {
+		t.Fatalf("claims are %+v, want the unverified default email", claims)
+	}
+}
+
+func TestVerifyIDTokenRejectsForgedTokens(t *testing.T) {
+	mock, srv := startMock(t)
+	rp := newTestRP(srv)
+	ctx := context.Background()
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() Claims {
+		now := time.Now()
+		return Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    srv.URL,
+				Subject:   "sub",
+				Audience:  jwt.ClaimStrings{testClientID},
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(now),
+			},
+			Nonce: "nonce",
+		}
+	}
+	sign := func(method jwt.SigningMethod, claims Claims, key any) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = mockKid
+		raw, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	if _, err := rp.VerifyIDToken(ctx, sign(jwt.SigningMethodRS256, valid(), mock.key), "nonce"); err != nil {
+		t.Fatalf("a token signed by the mock was refused: %s", err)
+	}
+	tests := map[string]string{
+		"other key":    sign(jwt.SigningMethodRS256, valid(), other),
+		"shared":       sign(jwt.SigningMethodHS256, valid(), []byte(testSecret)),
+		"unsigned":     sign(jwt.SigningMethodNone, valid(), jwt.UnsafeAllowNoneSignatureType),
+		"other issuer": sign(jwt.SigningMethodRS256, func() Claims { c := valid(); c.Issuer = "https://evil"; return c }(), mock.key),
+		"audience": sign(jwt.SigningMethodRS256, func() Claims {
+			c := valid()
+			c.Audience = jwt.ClaimStrings{"other"}
+			return c
+		}(), mock.key),
+		"authorized party": sign(jwt.SigningMethodRS256, func() Claims {
+			c := valid()
+			c.Audience = jwt.ClaimStrings{testClientID, "other"}
+			c.AuthorizedParty = "other"
+			return c
+		}(), mock.key),
+		"expired": sign(jwt.SigningMethodRS256, func() Claims {
+			c := valid()
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-clockSkew - time.Minute))
+			return c
+		}(), mock.key),
+		"no expiry":  sign(jwt.SigningMethodRS256, func() Claims { c := valid(); c.ExpiresAt = nil; return c }(), mock.key),
+		"no subject": sign(jwt.SigningMethodRS256, func() Claims { c := valid(); c.Subject = ""; return c }(), mock.key),
+	}
+	for name, raw := range tests {
+		if _, err := rp.VerifyIDToken(ctx, raw, "nonce"); err == nil {
+			t.Errorf("%s: the token was accepted", name)
+		}
+	}
+}
+
+func TestDiscoverChecksIssuer(t *testing.T) {
+	_, srv := startMock(t)
+	if _, err := Discover(context.Background(), srv.Client(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	// the metadata names the issuer without the trailing slash
+	if _, err := Discover(context.Background(), srv.Client(), srv.URL+"/"); err == nil {
+		t.Fatal("metadata naming another issuer was accepted")
+	}
+}
+
+func TestBoolUnmarshal(t *testing.T) {
+	for dat, want := range map[string]bool{`true`: true, `"true"`: true, `false`: false, `"false"`: false, `null`: false} {
+		var b Bool
+		if err := json.Unmarshal([]byte(dat), &b); err != nil || bool(b) != want {
+			t.Errorf("%s decoded to %v (%v), want %v", dat, b, err, want)
+		}
+	}
+	var b Bool
+	if err := json.Unmarshal([]byte(`"yes"`), &b); err == nil {
+		t.Error(`"yes" was decoded`)
+	}
+}
@@ -0,0 +1,98 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+)
+
+// Argon2id hashes passwords with argon2id and encodes them in the PHC string format
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+type Argon2id struct {
+	// Memory is in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// NewArgon2id returns an argon2id hasher, it fails if a setting is zero
+func NewArgon2id(memory uint32, time uint32, threads uint8) (Argon2id, error) {
+	if memory == 0 || time == 0 || threads == 0 {
+		return Argon2id{}, errors.New("argon2id memory, time and threads must be positive")
+	}
+	if memory < 8*uint32(threads) {
+		return Argon2id{}, fmt.Errorf("argon2id needs at least %d KiB of memory for %d threads", 8*uint32(threads), threads)
+	}
+	return Argon2id{Memory: memory, Time: time, Threads: threads}, nil
+}
+
+// Hash returns the argon2id hash of password with a random salt
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, argon2KeySize)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Current reports whether hash is an argon2id hash with the same settings
+func (a Argon2id) Current(hash string) bool {
+	params, _, key, err := parseArgon2id(hash)
+	return err == nil && params == a && len(key) == argon2KeySize
+}
+
+// parseArgon2id splits a PHC string made by Hash into its parts
+func parseArgon2id(hash string) (Argon2id, []byte, []byte, error) {
+	var version int
+	var params Argon2id
+	var salt, key string
+	_, err := fmt.Sscanf(hash, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s", &version,
+		&params.Memory, &params.Time, &params.Threads, &salt)
+	if err != nil {
+		return Argon2id{}, nil, nil, ErrUnknownFormat
+	}
+	if version != argon2.Version {
+		return Argon2id{}, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	salt, key, ok := strings.Cut(salt, "$")
+	if !ok {
+		return Argon2id{}, nil, nil, ErrUnknownFormat
+	}
+	saltBytes, err := base64.RawStdEncoding.DecodeString(salt)
+	if err != nil {
+		return Argon2id{}, nil, nil, ErrUnknownFormat
+	}
+	keyBytes, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil || len(keyBytes) == 0 {
+		return Argon2id{}, nil, nil, ErrUnknownFormat
+	}
+	return params, saltBytes, keyBytes, nil
+}
+
+func verifyArgon2id(hash string, password string) error {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	if params.Time == 0 || params.Threads == 0 {
+		return ErrUnknownFormat
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
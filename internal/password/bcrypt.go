@@ -0,0 +1,36 @@
+package password
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt hashes passwords with bcrypt at Cost
+type Bcrypt struct {
+	Cost int
+}
+
+// NewBcrypt returns a bcrypt hasher, it fails if cost is out of range
+func NewBcrypt(cost int) (Bcrypt, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return Bcrypt{}, fmt.Errorf("bcrypt cost %d is not between %d and %d", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return Bcrypt{Cost: cost}, nil
+}
+
+// Hash returns the bcrypt hash of password in modular crypt format,
+// passwords longer than 72 bytes are refused
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Current reports whether hash is a bcrypt hash of the same cost
+func (b Bcrypt) Current(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost == b.Cost
+}
@@ -0,0 +1,39 @@
+// Package password hashes and checks user passwords
+package password
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrMismatch      = errors.New("password does not match")
+	ErrUnknownFormat = errors.New("unknown password hash format")
+)
+
+// Hasher hashes new passwords with one algorithm and its settings
+type Hasher interface {
+	Hash(password string) (string, error)
+	// Current reports whether hash was made with the algorithm
+	// and settings of the hasher, if not it should be rehashed
+	Current(hash string) bool
+}
+
+// Verify checks password against a hash made by any of the hashers
+// and returns ErrMismatch if it is wrong
+func Verify(hash string, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+		return err
+	default:
+		return ErrUnknownFormat
+	}
+}
@@ -0,0 +1,107 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashers(t *testing.T) {
+	argon, err := NewArgon2id(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHasher, err := NewBcrypt(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, hasher := range map[string]Hasher{"argon2id": argon, "bcrypt": bcryptHasher} {
+		t.Run(name, func(t *testing.T) {
+			hash, err := hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Verify(hash, "correct horse"); err != nil {
+				t.Fatalf("Verify with the password: %s", err)
+			}
+			if err := Verify(hash, "correct horsf"); !errors.Is(err, ErrMismatch) {
+				t.Fatalf("Verify with a wrong password returned %v, want ErrMismatch", err)
+			}
+			if !hasher.Current(hash) {
+				t.Fatal("a fresh hash is not current")
+			}
+			again, err := hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again == hash {
+				t.Fatal("two hashes of a password are equal, the salt is missing")
+			}
+		})
+	}
+}
+
+func TestCurrentAcrossSettings(t *testing.T) {
+	weak, _ := NewArgon2id(64, 1, 1)
+	strong, _ := NewArgon2id(128, 2, 1)
+	bcryptHasher, _ := NewBcrypt(bcrypt.MinCost)
+	argonHash, err := weak.Hash("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcryptHasher.Hash("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strong.Current(argonHash) {
+		t.Error("a hash with weaker argon2id settings is current")
+	}
+	if weak.Current(bcryptHash) {
+		t.Error("a bcrypt hash is current for argon2id")
+	}
+	stronger, _ := NewBcrypt(bcrypt.MinCost + 1)
+	if stronger.Current(bcryptHash) || stronger.Current(argonHash) {
+		t.Error("a hash of another cost or algorithm is current for bcrypt")
+	}
+	// a hash made with older settings still verifies after they change
+	if err := Verify(argonHash, "pw"); err != nil {
+		t.Errorf("hash with older settings: %s", err)
+	}
+}
+
+func TestVerifyRejectsMalformedHashes(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$argon2id$v=19$m=64,t=1,p=1$",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+	} {
+		if err := Verify(hash, "pw"); err == nil || errors.Is(err, ErrMismatch) {
+			t.Errorf("Verify(%q) returned %v, want a format error", hash, err)
+		}
+	}
+	if err := Verify("$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5", "pw"); err == nil {
+		t.Error("an unsupported argon2 version was accepted")
+	}
+}
+
+func TestNewHasherSettings(t *testing.T) {
+	for _, settings := range [][3]uint32{{0, 1, 1}, {64, 0, 1}, {64, 1, 0}, {8, 1, 4}} {
+		if _, err := NewArgon2id(settings[0], settings[1], uint8(settings[2])); err == nil {
+			t.Errorf("argon2id settings %v were accepted", settings)
+		}
+	}
+	for _, cost := range []int{bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+		if _, err := NewBcrypt(cost); err == nil {
+			t.Errorf("bcrypt cost %d was accepted", cost)
+		}
+	}
+	bcryptHasher, _ := NewBcrypt(bcrypt.MinCost)
+	if _, err := bcryptHasher.Hash(strings.Repeat("a", MaxLength+1)); err == nil {
+		t.Error("bcrypt hashed a password longer than it reads")
+	}
+}
@@ -0,0 +1,83 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxLength is the longest password in bytes, bcrypt ignores anything beyond it
+const MaxLength = 72
+
+var ErrBreached = errors.New("password appears in a list of breached passwords, choose another one")
+
+// Policy is what new passwords have to meet
+type Policy struct {
+	// MinLength is the shortest password in characters
+	MinLength int
+	// breached holds the uppercase hex SHA-1 digests of known breached passwords
+	breached map[string]struct{}
+}
+
+// sha1Line matches a line of a digest list like the Pwned Passwords downloads, "<SHA-1>:<count>"
+var sha1Line = regexp.MustCompile(`^[0-9A-Fa-f]{40}(:\d+)?$`)
+
+// LoadBreached reads a breached password list into the policy, one password
+// or hex SHA-1 digest per line, a digest may be followed by ":<count>"
+func (p *Policy) LoadBreached(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if p.breached == nil {
+		p.breached = make(map[string]struct{})
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if sha1Line.MatchString(line) {
+			p.breached[strings.ToUpper(line[:40])] = struct{}{}
+			continue
+		}
+		p.breached[digest(line)] = struct{}{}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// Breached returns how many passwords the breached list holds
+func (p *Policy) Breached() int {
+	return len(p.breached)
+}
+
+// Check returns why password may not be used, if it may not
+func (p *Policy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if len(password) > MaxLength {
+		return fmt.Errorf("password must be at most %d bytes long", MaxLength)
+	}
+	if _, ok := p.breached[digest(password)]; ok {
+		return ErrBreached
+	}
+	return nil
+}
+
+func digest(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
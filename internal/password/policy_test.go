@@ -0,0 +1,59 @@
+package password
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	p := Policy{MinLength: 8}
+	for password, ok := range map[string]bool{
+		"short":                          false,
+		"long enough":                    true,
+		"ünïcödé":                        false,
+		"ünïcödé!":                       true,
+		strings.Repeat("a", MaxLength):   true,
+		strings.Repeat("a", MaxLength+1): false,
+	} {
+		err := p.Check(password)
+		if (err == nil) != ok {
+			t.Errorf("Check(%q) returned %v", password, err)
+		}
+	}
+}
+
+func TestLoadBreached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	// the digest of "password1" in upper case with a count, then in lower case, then a plain password
+	err := os.WriteFile(path, []byte(strings.Join([]string{
+		"E38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D:2413945",
+		"e38ad214943daad1d64c102faec29de4afe9da3d",
+		"letmein123\r",
+		"",
+	}, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Policy{MinLength: 8}
+	err = p.LoadBreached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Breached() != 2 {
+		t.Fatalf("policy holds %d breached passwords, want 2", p.Breached())
+	}
+	for _, password := range []string{"password1", "letmein123"} {
+		if err := p.Check(password); !errors.Is(err, ErrBreached) {
+			t.Errorf("Check(%q) returned %v, want ErrBreached", password, err)
+		}
+	}
+	if err := p.Check("password2"); err != nil {
+		t.Errorf("a password not on the list was refused: %s", err)
+	}
+	if err := p.LoadBreached(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loading a missing list succeeded")
+	}
+}
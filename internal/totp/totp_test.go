@@ -0,0 +1,99 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// the last 6 of the 8 digits of appendix B
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		got, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("code at %d is %s, want %s", unix, got, want)
+		}
+	}
+	// authenticator apps may show the secret in lower case
+	got, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("lower case secret gave %s (%v)", got, err)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("an invalid secret was accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code, err := Code(rfcSecret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := Validate(rfcSecret, " "+code+" ", now, 1, 0); !ok || got != step {
+		t.Fatalf("current code matched %v at step %d, want step %d", ok, got, step)
+	}
+	// a code of the step before still counts within the skew
+	previous, _ := Code(rfcSecret, step-1)
+	if got, ok := Validate(rfcSecret, previous, now, 1, 0); !ok || got != step-1 {
+		t.Fatalf("code of the previous step matched %v at step %d", ok, got)
+	}
+	if _, ok := Validate(rfcSecret, previous, now, 0, 0); ok {
+		t.Fatal("code of the previous step matched without skew")
+	}
+	// once a step was used its code and older ones are refused
+	if _, ok := Validate(rfcSecret, code, now, 1, step); ok {
+		t.Fatal("a used code matched again")
+	}
+	if _, ok := Validate(rfcSecret, previous, now, 1, step); ok {
+		t.Fatal("a code older than the used one matched")
+	}
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(rfcSecret, bad, now, 1, 0); ok {
+			t.Errorf("code %q matched", bad)
+		}
+	}
+}
+
+func TestGenerateSecretAndURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Fatalf("generated secret can't make codes: %s", err)
+	}
+	other, _ := GenerateSecret()
+	if secret == other {
+		t.Fatal("two generated secrets are equal")
+	}
+
+	u, err := url.Parse(URI("Chirpy", "a@x.com", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Chirpy:a@x.com" {
+		t.Errorf("URI is %s", u)
+	}
+	query := u.Query()
+	if query.Get("secret") != secret || query.Get("digits") != "6" || query.Get("period") != "30" ||
+		query.Get("issuer") != "Chirpy" {
+		t.Errorf("URI parameters are %v", query)
+	}
+}
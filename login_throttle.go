@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	defaultLoginMaxFailures    = 5
+	defaultLoginMaxIPFailures  = 50
+	defaultLoginLockout        = 15 * time.Minute
+	defaultMaxMagicLinks       = 5
+	defaultMaxPasswordResets   = 5
+	defaultMaxIPPasswordResets = 20
+
+	// loginBackoff is the wait after the first failure, it doubles with every further one
+	loginBackoff = time.Second
+	// loginMaxLockout caps the lockout, which doubles with every lockout in a row
+	loginMaxLockout = 24 * time.Hour
+	// loginFailureWindow is how long a failure counts towards a lockout
+	loginFailureWindow = time.Hour
+	// mailLimitWindow is how long an emailed link counts towards its limit,
+	// like MaxMagicLinks, and how long sending is held back once it is reached
+	mailLimitWindow = time.Hour
+	// loginThrottleRetention is how long records are kept after their last failure or lockout
+	loginThrottleRetention = 24 * time.Hour
+)
+
+// LoginThrottleConfig limits how many logins may fail before
+// an account or a client address is locked out
+type LoginThrottleConfig struct {
+	// MaxFailures is the limit per account
+	MaxFailures int
+	// MaxIPFailures is the limit per client address, across accounts
+	MaxIPFailures int
+	// Lockout is how long the first lockout lasts
+	Lockout time.Duration
+	// MaxMagicLinks limits the magic links sent to an email within mailLimitWindow
+	MaxMagicLinks int
+	// MaxPasswordResets limits the password resets requested for an email
+	// within mailLimitWindow, MaxIPPasswordResets those requested by a client address
+	MaxPasswordResets   int
+	MaxIPPasswordResets int
+}
+
+// LoadLoginThrottleConfig reads the login limits from the environment
+func LoadLoginThrottleConfig() (LoginThrottleConfig, error) {
+	tc := LoginThrottleConfig{
+		MaxFailures:   defaultLoginMaxFailures,
+		MaxIPFailures: defaultLoginMaxIPFailures,
+		Lockout:       defaultLoginLockout,
+		MaxMagicLinks: defaultMaxMagicLinks,
+
+		MaxPasswordResets:   defaultMaxPasswordResets,
+		MaxIPPasswordResets: defaultMaxIPPasswordResets,
+	}
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return LoginThrottleConfig{}, fmt.Errorf("invalid LOGIN_MAX_FAILURES %q", v)
+		}
+		tc.MaxFailures = n
+	}
+	if v := os.Getenv("LOGIN_MAX_IP_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return LoginThrottleConfig{}, fmt.Errorf("invalid LOGIN_MAX_IP_FAILURES %q", v)
+		}
+		tc.MaxIPFailures = n
+	}
+	if v := os.Getenv("LOGIN_MAX_MAGIC_LINKS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return LoginThrottleConfig{}, fmt.Errorf("invalid LOGIN_MAX_MAGIC_LINKS %q", v)
+		}
+		tc.MaxMagicLinks = n
+	}
+	if v := os.Getenv("LOGIN_MAX_PASSWORD_RESETS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return LoginThrottleConfig{}, fmt.Errorf("invalid LOGIN_MAX_PASSWORD_RESETS %q", v)
+		}
+		tc.MaxPasswordResets = n
+	}
+	if v := os.Getenv("LOGIN_MAX_IP_PASSWORD_RESETS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return LoginThrottleConfig{}, fmt.Errorf("invalid LOGIN_MAX_IP_PASSWORD_RESETS %q", v)
+		}
+		tc.MaxIPPasswordResets = n
+	}
+	if lockout := os.Getenv("LOGIN_LOCKOUT"); lockout != "" {
+		d, err := time.ParseDuration(lockout)
+		if err != nil || d <= 0 {
+			return LoginThrottleConfig{}, fmt.Errorf("invalid LOGIN_LOCKOUT %q", lockout)
+		}
+		tc.Lockout = d
+	}
+	return tc, nil
+}
+
+// accountThrottleKey is the key the failed logins of an email are counted by,
+// whether or not a user has that email
+func accountThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ipThrottleKey is the key the failed logins of a client address are counted by
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// magicLinkThrottleKey is the key the magic links sent to an email are counted by,
+// whether or not a user has that email
+func magicLinkThrottleKey(email string) string {
+	return "magic:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// passwordResetThrottleKey is the key the password resets requested for an email
+// are counted by, whether or not a user has that email
+func passwordResetThrottleKey(email string) string {
+	return "reset:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ipPasswordResetThrottleKey is the key the password resets requested by a client address are counted by
+func ipPasswordResetThrottleKey(ip string) string {
+	return "reset-ip:" + ip
+}
+
+// retryAt returns when the next login may be tried: after a lockout ends,
+// or after a backoff that doubles with every recent failure up to maxBackoff
+func retryAt(throttle database.LoginThrottle, maxBackoff time.Duration) time.Time {
+	next := throttle.LockedUntil
+	if throttle.Failures > 0 && time.Since(throttle.LastFailedAt) < loginFailureWindow {
+		backoff := min(loginBackoff<<min(throttle.Failures-1, 20), maxBackoff)
+		if throttle.LastFailedAt.Add(backoff).After(next) {
+			next = throttle.LastFailedAt.Add(backoff)
+		}
+	}
+	return next
+}
+
+// loginRetryAfter returns how long the client has to wait before
+// trying to log in to email again, zero if it may try now.
+// Client addresses are only locked out, backing them off
+// would slow down every user behind a shared address
+func (cfg *Config) loginRetryAfter(email string, ip string) (time.Duration, error) {
+	maxBackoff := map[string]time.Duration{
+		accountThrottleKey(email): cfg.throttle.Lockout,
+		ipThrottleKey(ip):         0,
+	}
+	wait := time.Duration(0)
+	for key, backoff := range maxBackoff {
+		throttle, err := cfg.db.GetLoginThrottle(key)
+		if err != nil {
+			return 0, err
+		}
+		if d := time.Until(retryAt(throttle, backoff)); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login to email from ip
+// and locks either out once it reaches its limit
+func (cfg *Config) recordLoginFailure(email string, ip string) error {
+	limits := map[string]int{
+		accountThrottleKey(email): cfg.throttle.MaxFailures,
+		ipThrottleKey(ip):         cfg.throttle.MaxIPFailures,
+	}
+	for key, limit := range limits {
+		_, err := cfg.db.ModifyLoginThrottle(key, func(throttle *database.LoginThrottle) error {
+			now := time.Now().UTC()
+			if now.Sub(throttle.LastFailedAt) >= loginFailureWindow {
+				throttle.Failures = 0
+			}
+			throttle.Failures++
+			throttle.LastFailedAt = now
+			if throttle.Failures < limit {
+				return nil
+			}
+			lockout := min(cfg.throttle.Lockout<<min(throttle.Lockouts, 20), loginMaxLockout)
+			throttle.Failures = 0
+			throttle.Lockouts++
+			throttle.LockedUntil = now.Add(lockout)
+			log.Printf("login locked out for %s until %s (lockout %d)", key,
+				throttle.LockedUntil.Format(time.RFC3339), throttle.Lockouts)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordLoginSuccess clears the failures of the account, those of the
+// client address stay so one known password can't reset them
+func (cfg *Config) recordLoginSuccess(email string) error {
+	return cfg.db.DeleteLoginThrottle(accountThrottleKey(email))
+}
+
+// recordMagicLink counts a magic link sent to email, unless the limit was
+// reached, and returns how long to wait before the next one may be sent then
+func (cfg *Config) recordMagicLink(email string) (time.Duration, error) {
+	return cfg.recordMailSent(magicLinkThrottleKey(email), cfg.throttle.MaxMagicLinks)
+}
+
+// recordPasswordReset counts a password reset requested for email from ip,
+// unless either limit was reached, and returns how long to wait before
+// the next one may be requested then
+func (cfg *Config) recordPasswordReset(email string, ip string) (time.Duration, error) {
+	wait, err := cfg.recordMailSent(ipPasswordResetThrottleKey(ip), cfg.throttle.MaxIPPasswordResets)
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	return cfg.recordMailSent(passwordResetThrottleKey(email), cfg.throttle.MaxPasswordResets)
+}
+
+// recordMailSent counts an emailed link under key, unless limit links were sent
+// within mailLimitWindow, and returns how long to wait before the next one then
+func (cfg *Config) recordMailSent(key string, limit int) (time.Duration, error) {
+	wait := time.Duration(0)
+	_, err := cfg.db.ModifyLoginThrottle(key, func(throttle *database.LoginThrottle) error {
+		now := time.Now().UTC()
+		if now.Before(throttle.LockedUntil) {
+			wait = throttle.LockedUntil.Sub(now)
+			return nil
+		}
+		// the failures of this record are the links sent
+		if now.Sub(throttle.LastFailedAt) >= mailLimitWindow {
+			throttle.Failures = 0
+		}
+		throttle.Failures++
+		throttle.LastFailedAt = now
+		if throttle.Failures >= limit {
+			throttle.Failures = 0
+			throttle.Lockouts++
+			throttle.LockedUntil = now.Add(mailLimitWindow)
+		}
+		return nil
+	})
+	return wait, err
+}
+
+var errInvalidCredentials = errors.New("invalid email or password")
+
+// allowLoginAttempt responds with 429 and reports false
+// while logins to email or from ip are backed off or locked out
+func (cfg *Config) allowLoginAttempt(w http.ResponseWriter, email string, ip string) bool {
+	wait, err := cfg.loginRetryAfter(email, ip)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		RespondWithError(w, http.StatusTooManyRequests, errors.New("too many failed logins, try again later").Error())
+		return false
+	}
+	return true
+}
+
+// failLogin records a failed login to email from ip and responds with 401 and reason
+func (cfg *Config) failLogin(w http.ResponseWriter, email string, ip string, reason error) {
+	err := cfg.recordLoginFailure(email, ip)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithError(w, http.StatusUnauthorized, reason.Error())
+}
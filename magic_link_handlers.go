@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	issuerMagicLink  = "chirpy-magic-link"
+	purposeMagicLink = "magic_link"
+	magicLinkTTL     = 15 * time.Minute
+)
+
+var errInvalidMagicLink = errors.New("invalid or expired login link")
+
+// ApiRequestMagicLink emails a single-use login link to the user, the response
+// is the same whether or not the email belongs to a user, only the number of
+// links sent to an address is limited. The link is issued in the background
+// so the response time doesn't tell either
+func (cfg *Config) ApiRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Email string `json:"email"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	email, err := validateEmail(rqParams.Email)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wait, err := cfg.recordMagicLink(email)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		RespondWithError(w, http.StatusTooManyRequests, errors.New("too many login links sent to this address, try again later").Error())
+		return
+	}
+
+	cfg.outgoing.Add(1)
+	go func() {
+		defer cfg.outgoing.Done()
+		err := cfg.sendMagicLink(email)
+		if err != nil {
+			log.Printf("login link for %s failed: %s", email, err)
+		}
+	}()
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusAccepted, respParams)
+}
+
+// sendMagicLink emails a login link to the user with the email,
+// an email no user has is ignored
+func (cfg *Config) sendMagicLink(email string) error {
+	user, err := cfg.db.GetUserByEmail(email)
+	if errors.Is(err, database.ErrEmailNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	linkTokenStr, err := cfg.issueMagicLinkToken(user)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/app/magic_login.html?token=%s", cfg.mail.PublicURL, url.QueryEscape(linkTokenStr))
+	cfg.sendMail(user.Email, "Log in to Chirpy", fmt.Sprintf(`Someone asked for a link to log in to your Chirpy account.
+
+To log in, open this link within %d minutes, it works only once:
+
+%s
+
+If it wasn't you, ignore this email, nobody can log in without the link.
+`, int(magicLinkTTL.Minutes()), link))
+	return nil
+}
+
+// issueMagicLinkToken signs a login link token for user, its jti is a one-time
+// token so the signed link can only be redeemed once
+func (cfg *Config) issueMagicLinkToken(user database.User) (string, error) {
+	oneTimeStr, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = cfg.db.CreateOneTimeToken(oneTimeStr, database.OneTimeToken{
+		Purpose:   purposeMagicLink,
+		UserId:    user.Id,
+		Email:     user.Email,
+		ExpiresAt: now.Add(magicLinkTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	claims := &TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        oneTimeStr,
+			Issuer:    issuerMagicLink,
+			Subject:   strconv.Itoa(user.Id),
+			ExpiresAt: jwt.NewNumericDate(now.Add(magicLinkTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	return cfg.tokenKeys.Sign(claims)
+}
+
+// ApiRedeemMagicLink logs in with the token of a login link like ApiLogin does,
+// which also proves the user receives mail at their address
+func (cfg *Config) ApiRedeemMagicLink(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Token string `json:"token"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	linkToken, err := cfg.parseToken(rqParams.Token, issuerMagicLink)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, errInvalidMagicLink.Error())
+		return
+	}
+	token, err := cfg.db.UseOneTimeToken(linkToken.Claims.ID, purposeMagicLink)
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenUsed) ||
+		errors.Is(err, database.ErrTokenExpired) {
+		RespondWithError(w, http.StatusUnauthorized, errInvalidMagicLink.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if strconv.Itoa(token.UserId) != linkToken.Claims.Subject {
+		RespondWithError(w, http.StatusUnauthorized, errInvalidMagicLink.Error())
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(token.UserId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		RespondWithError(w, http.StatusUnauthorized, errInvalidMagicLink.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// a link sent before the email changed doesn't prove the new one
+	if !strings.EqualFold(user.Email, token.Email) {
+		RespondWithError(w, http.StatusUnauthorized, errInvalidMagicLink.Error())
+		return
+	}
+	user, err = cfg.claimEmail(user.Id)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	cfg.completeLogin(w, r, user, user.Email)
+}
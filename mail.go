@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/mail"
+)
+
+const mailTimeout = 30 * time.Second
+
+// sendMail delivers an email to a user in the background,
+// so that responses take as long whether or not an email was sent,
+// failures are only logged
+func (cfg *Config) sendMail(to string, subject string, body string) {
+	msg := mail.Message{From: cfg.mail.From, To: to, Subject: subject, Body: body}
+	cfg.outgoing.Add(1)
+	go func() {
+		defer cfg.outgoing.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		err := cfg.mail.Mailer.Send(ctx, msg)
+		if err != nil {
+			log.Printf("sending %q to %s failed: %s", subject, to, err)
+		}
+	}()
+}
+
+// WaitForMail blocks until every email in flight has been sent or has failed
+func (cfg *Config) WaitForMail() {
+	cfg.outgoing.Wait()
+}
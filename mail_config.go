@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	chirpymail "github.com/dimadudin/web-server-go/internal/mail"
+)
+
+const (
+	defaultPublicURL = "http://localhost:8080"
+	defaultMailFrom  = "Chirpy <no-reply@localhost>"
+	defaultOutboxDir = "./outbox"
+	defaultSMTPPort  = 587
+)
+
+// MailConfig is how and as whom emails to users are sent
+type MailConfig struct {
+	Mailer chirpymail.Mailer
+	From   string
+	// PublicURL is where users reach the server, links in emails point to it
+	PublicURL string
+}
+
+// LoadMailConfig reads the mail settings from the environment,
+// MAILER is either "outbox", the default, or "smtp"
+func LoadMailConfig() (MailConfig, error) {
+	mc := MailConfig{
+		From:      os.Getenv("MAIL_FROM"),
+		PublicURL: strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+	}
+	if mc.From == "" {
+		mc.From = defaultMailFrom
+	}
+	if _, err := mail.ParseAddress(mc.From); err != nil {
+		return MailConfig{}, fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+	if mc.PublicURL == "" {
+		mc.PublicURL = defaultPublicURL
+	}
+
+	switch mailer := os.Getenv("MAILER"); mailer {
+	case "", "outbox":
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = defaultOutboxDir
+		}
+		mc.Mailer = chirpymail.NewOutbox(dir)
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return MailConfig{}, fmt.Errorf("SMTP_HOST is required by MAILER=smtp")
+		}
+		port := defaultSMTPPort
+		if p := os.Getenv("SMTP_PORT"); p != "" {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 1 || n > 65535 {
+				return MailConfig{}, fmt.Errorf("invalid SMTP_PORT %q", p)
+			}
+			port = n
+		}
+		mc.Mailer = chirpymail.NewSMTP(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	default:
+		return MailConfig{}, fmt.Errorf("unknown MAILER %q", mailer)
+	}
+	return mc, nil
+}
@@ -1,39 +1,130 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/dimadudin/web-server-go/internal/database"
 	"github.com/joho/godotenv"
 )
 
 const (
-	port   = "8080"
-	dbPath = "./database.json"
+	port            = "8080"
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
 	dbg := flag.Bool("debug", false, "Enable debug mode")
 	flag.Parse()
+
+	godotenv.Load()
+	if flag.NArg() > 0 {
+		if !runCommand(flag.Arg(0), flag.Args()[1:]) {
+			log.Fatalf("unknown command %q", flag.Arg(0))
+		}
+		return
+	}
+
+	polkaApiKey := os.Getenv("POLKA_API_KEY")
+	if os.Getenv("ADMIN_API_KEY") != "" {
+		log.Print("ADMIN_API_KEY is no longer used, the admin routes take the access token of an admin")
+	}
+
+	tokenKeys, err := LoadTokenKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	storeCfg, err := LoadStoreConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	snapshotCfg, err := LoadSnapshotConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	janitorCfg, err := LoadTokenJanitorConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mailCfg, err := LoadMailConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy, err := LoadAccountPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	throttleCfg, err := LoadLoginThrottleConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	passwordCfg, err := LoadPasswordConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	oidcCfg, err := LoadOIDCConfig(mailCfg.PublicURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *dbg {
-		os.Remove(dbPath)
+		storeCfg.Remove()
 	}
 
-	db, err := database.NewDB(dbPath)
+	db, err := storeCfg.Open()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer db.Close()
 
-	godotenv.Load()
-	jwtSecret := os.Getenv("JWT_SECRET")
-	polkaApiKey := os.Getenv("POLKA_API_KEY")
+	if snapshotCfg.Dir != "" {
+		scheduler := NewSnapshotScheduler(db, snapshotCfg)
+		scheduler.Start()
+		defer scheduler.Stop()
+	}
+
+	janitor := NewTokenJanitor(db, janitorCfg)
+	janitor.Start()
+	defer janitor.Stop()
 
-	cfg := NewApiConfig(db, jwtSecret, polkaApiKey)
+	cfg := NewApiConfig(db, tokenKeys, polkaApiKey, janitor, mailCfg, policy, throttleCfg, passwordCfg, oidcCfg)
+	defer cfg.WaitForMail()
 
 	router := Route(cfg)
 	server := http.Server{Addr: ":" + port, Handler: router}
-	log.Fatal(server.ListenAndServe())
+	err = serve(&server)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs server until SIGINT or SIGTERM and then shuts it down gracefully,
+// requests in flight get shutdownTimeout to finish,
+// only a failure to start serving is returned
+func serve(server *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	log.Print("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown: %s", err)
+	}
+	return nil
 }
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
 )
 
 func MwAddCors(next http.Handler) http.Handler {
@@ -25,6 +33,159 @@ func (cfg *Config) MwIncrementHits(next http.Handler) http.Handler {
 	})
 }
 
+// authenticate validates the bearer token of r from issuer and loads its user,
+// it returns the status to fail the request with if either is invalid
+func (cfg *Config) authenticate(r *http.Request, issuer string) (database.User, AuthToken, int, error) {
+	tokenStr, err := bearerToken(r)
+	if err != nil {
+		return database.User{}, AuthToken{}, http.StatusUnauthorized, err
+	}
+	if strings.HasPrefix(tokenStr, personalTokenPrefix) {
+		return database.User{}, AuthToken{}, http.StatusForbidden,
+			errors.New("personal access tokens can't be used here, log in instead")
+	}
+	token, err := cfg.parseToken(tokenStr, issuer)
+	if err != nil {
+		return database.User{}, AuthToken{}, http.StatusUnauthorized, err
+	}
+	userID, err := strconv.Atoi(token.Claims.Subject)
+	if err != nil {
+		return database.User{}, AuthToken{}, http.StatusUnauthorized, errors.New("invalid token subject")
+	}
+	user, err := cfg.db.GetUserByID(userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return database.User{}, AuthToken{}, http.StatusUnauthorized, err
+	}
+	if err != nil {
+		return database.User{}, AuthToken{}, http.StatusInternalServerError, err
+	}
+	return user, token, http.StatusOK, nil
+}
+
+// MwRequireAuth only lets requests through that carry a valid bearer token
+// from issuer, the token and its user are available to the next handler
+// through AuthTokenFrom and AuthUser. Access tokens of OAuth clients
+// are turned away, only MwRequireScope accepts them
+func (cfg *Config) MwRequireAuth(issuer string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, token, status, err := cfg.authenticate(r, issuer)
+			if err != nil {
+				RespondWithError(w, status, err.Error())
+				return
+			}
+			if issuer == issuerAccess && token.Claims.ClientId != "" {
+				RespondWithError(w, http.StatusForbidden,
+					errors.New("tokens of third-party apps can't be used here").Error())
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withAuth(r.Context(), user, token)))
+		})
+	}
+}
+
+// MwRequireScope is MwRequireAuth for access tokens that also lets requests
+// through that carry a personal access token or an OAuth client token with scope
+func (cfg *Config) MwRequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenStr, err := bearerToken(r)
+			if err != nil || !strings.HasPrefix(tokenStr, personalTokenPrefix) {
+				user, token, status, err := cfg.authenticate(r, issuerAccess)
+				if err != nil {
+					RespondWithError(w, status, err.Error())
+					return
+				}
+				if token.Claims.ClientId != "" && !slices.Contains(token.Claims.scopes(), scope) {
+					RespondWithError(w, http.StatusForbidden,
+						fmt.Errorf("token lacks the %s scope", scope).Error())
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(withAuth(r.Context(), user, token)))
+				return
+			}
+			token, err := cfg.db.GetPersonalToken(tokenStr)
+			if errors.Is(err, database.ErrTokenNotFound) {
+				RespondWithError(w, http.StatusUnauthorized, errors.New("invalid personal access token").Error())
+				return
+			}
+			if err != nil {
+				RespondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			now := time.Now().UTC()
+			if !token.ExpiresAt.IsZero() && !token.ExpiresAt.After(now) {
+				RespondWithError(w, http.StatusUnauthorized, errors.New("personal access token has expired").Error())
+				return
+			}
+			if !slices.Contains(token.Scopes, scope) {
+				RespondWithError(w, http.StatusForbidden,
+					fmt.Errorf("personal access token lacks the %s scope", scope).Error())
+				return
+			}
+			user, err := cfg.db.GetUserByID(token.UserId)
+			if errors.Is(err, database.ErrUserNotFound) {
+				RespondWithError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if err != nil {
+				RespondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if now.Sub(token.LastUsedAt) >= personalTokenTouchInterval {
+				err = cfg.db.TouchPersonalToken(token.Id, now)
+				if err != nil {
+					log.Printf("recording the use of personal access token %s failed: %s", token.Id, err)
+				}
+			}
+			auth := AuthToken{Raw: tokenStr, Claims: personalTokenClaims(user, token), Personal: &token}
+			next.ServeHTTP(w, r.WithContext(withAuth(r.Context(), user, auth)))
+		})
+	}
+}
+
+// MwOptionalScope lets requests without a bearer token through and holds those
+// with one to MwRequireScope, so a token is never used beyond its scopes
+func (cfg *Config) MwOptionalScope(scope string) func(http.Handler) http.Handler {
+	requireScope := cfg.MwRequireScope(scope)
+	return func(next http.Handler) http.Handler {
+		scoped := requireScope(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			scoped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MwRequireVerifiedEmail stops users whose email is not verified
+// if the account policy asks for it, it must run after MwRequireAuth
+func (cfg *Config) MwRequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := AuthUser(r.Context())
+		if cfg.policy.RequireVerifiedEmail && !user.EmailVerified {
+			RespondWithError(w, http.StatusForbidden, errors.New("verify your email address first").Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MwRequireTwoFactor stops Chirpy Red users without two-factor authentication
+// if the account policy asks for it, it must run after MwRequireAuth
+func (cfg *Config) MwRequireTwoFactor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := AuthUser(r.Context())
+		if cfg.policy.Require2FAForRed && user.IsChirpyRed && !user.TotpEnabled {
+			RespondWithError(w, http.StatusForbidden, errors.New("enable two-factor authentication first").Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func MwLog(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s %s", r.Method, r.URL.Path)
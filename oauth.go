@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	// oauthClientSecretPrefix tells client secrets apart from other tokens
+	// and makes leaked ones easy to find with secret scanners
+	oauthClientSecretPrefix = "chirpy_cs_"
+	maxOAuthClientName      = 100
+	maxRedirectURIs         = 10
+	// oauthCodeTTL is how long an authorization code can be exchanged, RFC 6749 suggests 10 minutes at most
+	oauthCodeTTL = 10 * time.Minute
+)
+
+// oauthScopes are the scopes third-party apps can be granted, they never
+// get to change the email, password or sessions of a user or use their role
+var oauthScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileRead}
+
+// oauthError is an error response of RFC 6749, Code is one of its error codes
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Description
+}
+
+func newOAuthError(code string, description string) *oauthError {
+	return &oauthError{Code: code, Description: description}
+}
+
+// respondOAuthError writes err as an RFC 6749 error response,
+// errors that aren't an oauthError are server errors
+func respondOAuthError(w http.ResponseWriter, err error) {
+	oerr := &oauthError{}
+	if !errors.As(err, &oerr) {
+		oerr = newOAuthError("server_error", err.Error())
+	}
+	status := http.StatusBadRequest
+	switch oerr.Code {
+	case "invalid_client":
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		status = http.StatusUnauthorized
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+	RespondWithJSON(w, status, oerr)
+}
+
+// randomID returns a new random id for clients and sessions
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validateRedirectURI checks a redirect URI a client registers: https URIs,
+// http ones on the loopback interface and the private-use schemes of
+// native apps, like com.example.app:/callback, are accepted
+func validateRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return fmt.Errorf("redirect URI %q is not an absolute URI", raw)
+	}
+	if u.Fragment != "" || strings.Contains(raw, "#") {
+		return fmt.Errorf("redirect URI %q must not have a fragment", raw)
+	}
+	switch {
+	case u.Scheme == "https" && u.Host != "":
+	case u.Scheme == "http" && isLoopback(u.Hostname()):
+	case strings.Contains(u.Scheme, "."):
+	default:
+		return fmt.Errorf("redirect URI %q must use https, http on localhost or a private-use scheme", raw)
+	}
+	return nil
+}
+
+// isLoopback reports whether host is localhost or a loopback address
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseScopes splits a space separated scope parameter and drops duplicates
+func parseScopes(scope string) []string {
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// authorizationRequest is the request of a client to be granted access,
+// as sent to /oauth/authorize
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientId            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+func authorizationRequestFromQuery(q url.Values) authorizationRequest {
+	return authorizationRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientId:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+}
+
+// authorizationClient looks up the client of req and settles its redirect URI,
+// which may be left out if the client registered only one. Errors here
+// must not be sent to the redirect URI, it can't be trusted yet
+func (cfg *Config) authorizationClient(req *authorizationRequest) (database.OAuthClient, error) {
+	if req.ClientId == "" {
+		return database.OAuthClient{}, errors.New("client_id is required")
+	}
+	client, err := cfg.db.GetOAuthClient(req.ClientId)
+	if err != nil {
+		return database.OAuthClient{}, err
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return database.OAuthClient{}, errors.New("redirect_uri is not registered for this client")
+	}
+	return client, nil
+}
+
+// grantedScopes checks the rest of req and returns the scopes it asks for,
+// those the client registered if it names none
+func (req authorizationRequest) grantedScopes(client database.OAuthClient) ([]string, error) {
+	if req.ResponseType != "code" {
+		return nil, newOAuthError("unsupported_response_type", "only the code response type is supported")
+	}
+	if req.CodeChallengeMethod != "S256" {
+		return nil, newOAuthError("invalid_request", "a PKCE code_challenge with the S256 method is required")
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(req.CodeChallenge)
+	if err != nil || len(challenge) != sha256.Size {
+		return nil, newOAuthError("invalid_request", "invalid code_challenge")
+	}
+	scopes := parseScopes(req.Scope)
+	if len(scopes) == 0 {
+		return client.Scopes, nil
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			return nil, newOAuthError("invalid_scope", fmt.Sprintf("scope %s is not available to this client", scope))
+		}
+	}
+	return scopes, nil
+}
+
+// redirectURL adds params to the query of the redirect URI of req
+func (req authorizationRequest) redirectURL(params url.Values) string {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return req.RedirectURI
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// errorRedirectURL is where the user agent is sent when req fails with err
+func (req authorizationRequest) errorRedirectURL(err error) string {
+	oerr := &oauthError{}
+	if !errors.As(err, &oerr) {
+		oerr = newOAuthError("server_error", err.Error())
+	}
+	params := url.Values{"error": {oerr.Code}}
+	if oerr.Description != "" {
+		params.Set("error_description", oerr.Description)
+	}
+	return req.redirectURL(params)
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against the S256 challenge
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	// RFC 7636 verifiers are 43 to 128 characters long
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// authenticateClient identifies the client of a request to the token,
+// introspection or revocation endpoint by HTTP basic auth or by the
+// client_id and client_secret form parameters, public clients send no secret
+func (cfg *Config) authenticateClient(r *http.Request) (database.OAuthClient, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		var err error
+		clientID, err = url.QueryUnescape(clientID)
+		if err == nil {
+			secret, err = url.QueryUnescape(secret)
+		}
+		if err != nil {
+			return database.OAuthClient{}, newOAuthError("invalid_client", "invalid client credentials")
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		return database.OAuthClient{}, newOAuthError("invalid_client", "client authentication is required")
+	}
+	client, err := cfg.db.GetOAuthClient(clientID)
+	if errors.Is(err, database.ErrClientNotFound) {
+		return database.OAuthClient{}, newOAuthError("invalid_client", "invalid client credentials")
+	}
+	if err != nil {
+		return database.OAuthClient{}, err
+	}
+	if client.SecretHash == "" {
+		if secret != "" {
+			return database.OAuthClient{}, newOAuthError("invalid_client", "public clients have no secret")
+		}
+		return client, nil
+	}
+	digest := database.HashToken(secret)
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(client.SecretHash)) != 1 {
+		return database.OAuthClient{}, newOAuthError("invalid_client", "invalid client credentials")
+	}
+	return client, nil
+}
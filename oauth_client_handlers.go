@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+// OAuthClient is an OAuth client as shown to the user who registered it
+type OAuthClient struct {
+	ClientId     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newOAuthClientView(client database.OAuthClient) OAuthClient {
+	return OAuthClient{
+		ClientId:     client.Id,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Scopes:       client.Scopes,
+		Confidential: client.SecretHash != "",
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// ApiCreateOAuthClient registers a third-party app of the caller, confidential
+// clients get a client secret that is only part of this response
+func (cfg *Config) ApiCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	type requestParameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := strings.TrimSpace(rqParams.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxOAuthClientName {
+		RespondWithError(w, http.StatusBadRequest,
+			fmt.Errorf("name must be between 1 and %d characters long", maxOAuthClientName).Error())
+		return
+	}
+	if len(rqParams.RedirectURIs) == 0 || len(rqParams.RedirectURIs) > maxRedirectURIs {
+		RespondWithError(w, http.StatusBadRequest,
+			fmt.Errorf("between 1 and %d redirect URIs are required", maxRedirectURIs).Error())
+		return
+	}
+	redirectURIs := []string{}
+	for _, uri := range rqParams.RedirectURIs {
+		err = validateRedirectURI(uri)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !slices.Contains(redirectURIs, uri) {
+			redirectURIs = append(redirectURIs, uri)
+		}
+	}
+	if len(rqParams.Scopes) == 0 {
+		RespondWithError(w, http.StatusBadRequest, errors.New("at least one scope is required").Error())
+		return
+	}
+	scopes := []string{}
+	for _, scope := range rqParams.Scopes {
+		if !slices.Contains(oauthScopes, scope) {
+			RespondWithError(w, http.StatusBadRequest,
+				fmt.Errorf("scope %q can't be granted to third-party apps", scope).Error())
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	clientID, err := randomID()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	secretStr := ""
+	secretHash := ""
+	if rqParams.Confidential {
+		secret, err := randomToken()
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		secretStr = oauthClientSecretPrefix + secret
+		secretHash = database.HashToken(secretStr)
+	}
+	client, err := cfg.db.CreateOAuthClient(database.OAuthClient{
+		Id:           clientID,
+		SecretHash:   secretHash,
+		OwnerId:      user.Id,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct {
+		OAuthClient
+		ClientSecret string `json:"client_secret,omitempty"`
+	}
+	respParams := responseParameters{OAuthClient: newOAuthClientView(client), ClientSecret: secretStr}
+	RespondWithJSON(w, http.StatusCreated, respParams)
+}
+
+// ApiGetOAuthClients lists the OAuth clients the caller registered, newest first
+func (cfg *Config) ApiGetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	clients, err := cfg.db.GetOAuthClientsByOwner(user.Id)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	views := make([]OAuthClient, 0, len(clients))
+	for _, client := range clients {
+		views = append(views, newOAuthClientView(client))
+	}
+	RespondWithJSON(w, http.StatusOK, views)
+}
+
+// ApiDeleteOAuthClient deletes an OAuth client of the caller, the refresh
+// tokens issued to it can't be used anymore as the client can't authenticate
+func (cfg *Config) ApiDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	err := cfg.db.DeleteOAuthClient(user.Id, r.PathValue("clientID"))
+	if errors.Is(err, database.ErrClientNotFound) {
+		RespondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+// OAuthAuthorize checks the authorization request of a client and sends
+// the user on to the consent page. Requests with an unknown client or
+// redirect URI are refused here, the rest of the errors go back to the client
+func (cfg *Config) OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req := authorizationRequestFromQuery(r.URL.Query())
+	client, err := cfg.authorizationClient(&req)
+	if errors.Is(err, database.ErrClientNotFound) {
+		RespondWithError(w, http.StatusBadRequest, errors.New("unknown client_id").Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	_, err = req.grantedScopes(client)
+	if err != nil {
+		http.Redirect(w, r, req.errorRedirectURL(err), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/app/oauth_consent.html?"+r.URL.RawQuery, http.StatusFound)
+}
+
+// OAuthAuthorizationDetails describes an authorization request for the consent page
+func (cfg *Config) OAuthAuthorizationDetails(w http.ResponseWriter, r *http.Request) {
+	req := authorizationRequestFromQuery(r.URL.Query())
+	client, err := cfg.authorizationClient(&req)
+	if errors.Is(err, database.ErrClientNotFound) {
+		RespondWithError(w, http.StatusBadRequest, errors.New("unknown client_id").Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	scopes, err := req.grantedScopes(client)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	type responseParameters struct {
+		ClientId    string   `json:"client_id"`
+		ClientName  string   `json:"client_name"`
+		RedirectURI string   `json:"redirect_uri"`
+		Scopes      []string `json:"scopes"`
+	}
+	respParams := responseParameters{
+		ClientId:    client.Id,
+		ClientName:  client.Name,
+		RedirectURI: req.RedirectURI,
+		Scopes:      scopes,
+	}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// OAuthDecide records the decision of the logged in user on an authorization
+// request and returns where to send them: back to the client with an
+// authorization code if they approved, with an access_denied error if not
+func (cfg *Config) OAuthDecide(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	type requestParameters struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req := rqParams.authorizationRequest
+	client, err := cfg.authorizationClient(&req)
+	if errors.Is(err, database.ErrClientNotFound) {
+		RespondWithError(w, http.StatusBadRequest, errors.New("unknown client_id").Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	type responseParameters struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	scopes, err := req.grantedScopes(client)
+	if err != nil {
+		RespondWithJSON(w, http.StatusOK, responseParameters{RedirectTo: req.errorRedirectURL(err)})
+		return
+	}
+	if !rqParams.Approve {
+		err = newOAuthError("access_denied", "the user denied the request")
+		RespondWithJSON(w, http.StatusOK, responseParameters{RedirectTo: req.errorRedirectURL(err)})
+		return
+	}
+
+	codeStr, err := randomToken()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = cfg.db.CreateOAuthCode(codeStr, database.OAuthCode{
+		ClientId:      client.Id,
+		UserId:        user.Id,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().UTC().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respParams := responseParameters{RedirectTo: req.redirectURL(url.Values{"code": {codeStr}})}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// OAuthToken is the token endpoint of RFC 6749, it exchanges authorization
+// codes and refresh tokens for tokens limited to the granted scopes
+func (cfg *Config) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	err := r.ParseForm()
+	if err != nil {
+		respondOAuthError(w, newOAuthError("invalid_request", err.Error()))
+		return
+	}
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		cfg.exchangeAuthorizationCode(w, r, client)
+	case "refresh_token":
+		cfg.exchangeRefreshToken(w, r, client)
+	default:
+		respondOAuthError(w, newOAuthError("unsupported_grant_type",
+			"grant_type must be authorization_code or refresh_token"))
+	}
+}
+
+// exchangeAuthorizationCode starts a session of the client with an authorization
+// code, presenting a code again revokes the session it started
+func (cfg *Config) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client database.OAuthClient) {
+	invalidGrant := newOAuthError("invalid_grant", "invalid authorization code")
+	familyID, err := randomID()
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	// the redirect URI may only be left out if the client registered just one
+	redirectURI := r.PostForm.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	// the code is only used up once the request proved it was issued to it
+	code, err := cfg.db.UseOAuthCode(r.PostForm.Get("code"), familyID, func(code database.OAuthCode) error {
+		if code.ClientId != client.Id || code.RedirectURI != redirectURI {
+			return invalidGrant
+		}
+		if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+			return newOAuthError("invalid_grant", "code_verifier doesn't match the code_challenge")
+		}
+		return nil
+	})
+	if errors.Is(err, database.ErrTokenUsed) {
+		if code.ClientId == client.Id && code.FamilyId != "" {
+			log.Printf("authorization code reuse by client %s, session of user %d revoked", client.Id, code.UserId)
+			err = cfg.db.RevokeTokenFamily(code.UserId, code.FamilyId)
+			if err != nil && !errors.Is(err, database.ErrTokenNotFound) {
+				respondOAuthError(w, err)
+				return
+			}
+		}
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) {
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	user, err := cfg.db.GetUserByID(code.UserId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+
+	refreshTokenStr, refreshClaims, err := cfg.issueClientToken(issuerRefresh, user, refreshTokenTTL, "",
+		client.Id, code.Scopes)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	session, err := cfg.db.CreateToken(refreshTokenStr, database.RefreshToken{
+		FamilyId:  familyID,
+		UserId:    user.Id,
+		IssuedAt:  refreshClaims.IssuedAt.Time,
+		ExpiresAt: refreshClaims.ExpiresAt.Time,
+		UserAgent: r.UserAgent(),
+		Ip:        ClientIP(r),
+	})
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	cfg.respondClientTokens(w, user, client, session.FamilyId, code.Scopes, refreshTokenStr)
+}
+
+// exchangeRefreshToken rotates a refresh token of the client, the new access token
+// may be limited to fewer scopes while the refresh token keeps the granted ones
+func (cfg *Config) exchangeRefreshToken(w http.ResponseWriter, r *http.Request, client database.OAuthClient) {
+	invalidGrant := newOAuthError("invalid_grant", "invalid refresh token")
+	token, err := cfg.parseToken(r.PostForm.Get("refresh_token"), issuerRefresh)
+	if err != nil || token.Claims.ClientId != client.Id {
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	granted := token.Claims.scopes()
+	scopes := granted
+	if scope := r.PostForm.Get("scope"); scope != "" {
+		scopes = parseScopes(scope)
+		for _, s := range scopes {
+			if !slices.Contains(granted, s) {
+				respondOAuthError(w, newOAuthError("invalid_scope", "scope "+s+" was not granted"))
+				return
+			}
+		}
+	}
+	userID, err := strconv.Atoi(token.Claims.Subject)
+	if err != nil {
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	user, err := cfg.db.GetUserByID(userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+
+	refreshTokenStr, refreshClaims, err := cfg.issueClientToken(issuerRefresh, user,
+		time.Until(token.Claims.ExpiresAt.Time), "", client.Id, granted)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	session, err := cfg.db.RotateToken(token.Raw, refreshTokenStr, database.RefreshToken{
+		IssuedAt:  refreshClaims.IssuedAt.Time,
+		ExpiresAt: refreshClaims.ExpiresAt.Time,
+		UserAgent: r.UserAgent(),
+		Ip:        ClientIP(r),
+	})
+	if errors.Is(err, database.ErrTokenReused) {
+		log.Printf("refresh token reuse by client %s for user %d from %s, session revoked", client.Id, user.Id, ClientIP(r))
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	if errors.Is(err, database.ErrTokenNotFound) {
+		respondOAuthError(w, invalidGrant)
+		return
+	}
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	cfg.respondClientTokens(w, user, client, session.FamilyId, scopes, refreshTokenStr)
+}
+
+// respondClientTokens issues an access token of the client for the session sid
+// and responds with it and the refresh token
+func (cfg *Config) respondClientTokens(w http.ResponseWriter, user database.User, client database.OAuthClient,
+	sid string, scopes []string, refreshTokenStr string) {
+	accessTokenStr, _, err := cfg.issueClientToken(issuerAccess, user, accessTokenTTL, sid, client.Id, scopes)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+
+	type responseParameters struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+	respParams := responseParameters{
+		AccessToken:  accessTokenStr,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		RefreshToken: refreshTokenStr,
+		Scope:        strings.Join(scopes, " "),
+	}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// clientToken validates an access or refresh token issued to client,
+// refresh tokens also have to be active in the store
+func (cfg *Config) clientToken(tokenStr string, client database.OAuthClient) (AuthToken, bool, error) {
+	token, err := cfg.parseToken(tokenStr, issuerAccess)
+	if err != nil {
+		token, err = cfg.parseToken(tokenStr, issuerRefresh)
+	}
+	if err != nil || token.Claims.ClientId != client.Id {
+		return AuthToken{}, false, nil
+	}
+	if token.Claims.Issuer == issuerRefresh {
+		session, err := cfg.db.GetToken(tokenStr)
+		if errors.Is(err, database.ErrTokenNotFound) {
+			return AuthToken{}, false, nil
+		}
+		if err != nil {
+			return AuthToken{}, false, err
+		}
+		if !session.RevokedAt.IsZero() {
+			return AuthToken{}, false, nil
+		}
+	}
+	return token, true, nil
+}
+
+// OAuthIntrospect is the introspection endpoint of RFC 7662,
+// clients can only introspect their own tokens
+func (cfg *Config) OAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	err := r.ParseForm()
+	if err != nil {
+		respondOAuthError(w, newOAuthError("invalid_request", err.Error()))
+		return
+	}
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+
+	type responseParameters struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientId  string `json:"client_id,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		Issuer    string `json:"iss,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+		Id        string `json:"jti,omitempty"`
+	}
+	token, active, err := cfg.clientToken(r.PostForm.Get("token"), client)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	if !active {
+		RespondWithJSON(w, http.StatusOK, responseParameters{Active: false})
+		return
+	}
+	tokenType := "access_token"
+	if token.Claims.Issuer == issuerRefresh {
+		tokenType = "refresh_token"
+	}
+	respParams := responseParameters{
+		Active:    true,
+		Scope:     token.Claims.Scope,
+		ClientId:  token.Claims.ClientId,
+		TokenType: tokenType,
+		Subject:   token.Claims.Subject,
+		Issuer:    token.Claims.Issuer,
+		ExpiresAt: token.Claims.ExpiresAt.Unix(),
+		IssuedAt:  token.Claims.IssuedAt.Unix(),
+		Id:        token.Claims.ID,
+	}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// OAuthRevoke is the revocation endpoint of RFC 7009, revoking a refresh token
+// ends its session. Access tokens can't be revoked, they expire within the hour
+func (cfg *Config) OAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondOAuthError(w, newOAuthError("invalid_request", err.Error()))
+		return
+	}
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+
+	tokenStr := r.PostForm.Get("token")
+	token, active, err := cfg.clientToken(tokenStr, client)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	if active && token.Claims.Issuer == issuerAccess {
+		respondOAuthError(w, newOAuthError("unsupported_token_type", "access tokens can't be revoked"))
+		return
+	}
+	if active {
+		session, err := cfg.db.GetToken(tokenStr)
+		if err != nil {
+			respondOAuthError(w, err)
+			return
+		}
+		err = cfg.db.RevokeTokenFamily(session.UserId, session.FamilyId)
+		if err != nil && !errors.Is(err, database.ErrTokenNotFound) {
+			respondOAuthError(w, err)
+			return
+		}
+	}
+	// unknown and invalid tokens are no error, RFC 7009 section 2.2
+	w.WriteHeader(http.StatusOK)
+}
+
+// OAuthMetadata publishes the authorization server metadata of RFC 8414
+func (cfg *Config) OAuthMetadata(w http.ResponseWriter, r *http.Request) {
+	base := cfg.mail.PublicURL
+	type responseParameters struct {
+		Issuer                            string   `json:"issuer"`
+		AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+		TokenEndpoint                     string   `json:"token_endpoint"`
+		IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+		RevocationEndpoint                string   `json:"revocation_endpoint"`
+		JWKSURI                           string   `json:"jwks_uri"`
+		ScopesSupported                   []string `json:"scopes_supported"`
+		ResponseTypesSupported            []string `json:"response_types_supported"`
+		GrantTypesSupported               []string `json:"grant_types_supported"`
+		TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+		CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	}
+	respParams := responseParameters{
+		Issuer:                            base,
+		AuthorizationEndpoint:             base + "/oauth/authorize",
+		TokenEndpoint:                     base + "/oauth/token",
+		IntrospectionEndpoint:             base + "/oauth/introspect",
+		RevocationEndpoint:                base + "/oauth/revoke",
+		JWKSURI:                           base + "/.well-known/jwks.json",
+		ScopesSupported:                   oauthScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
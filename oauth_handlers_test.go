@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testRedirectURI = "https://app.example/callback"
+	testVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testChallenge   = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+// testClient is a confidential client registered through the API
+type testClient struct {
+	id     string
+	secret string
+}
+
+func registerClient(t *testing.T, srv *httptest.Server, accessToken string, scopes ...string) testClient {
+	t.Helper()
+	resp, body := doJSON(t, http.MethodPost, srv.URL+"/api/oauth/clients", accessToken, map[string]any{
+		"name":          "app",
+		"redirect_uris": []string{testRedirectURI, "https://app.example/other"},
+		"scopes":        scopes,
+		"confidential":  true,
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registering a client responded %s: %v", resp.Status, body)
+	}
+	return testClient{id: body["client_id"].(string), secret: body["client_secret"].(string)}
+}
+
+// authorizeCode approves an authorization request of client as the user of accessToken
+func authorizeCode(t *testing.T, srv *httptest.Server, accessToken string, client testClient, scope string) string {
+	t.Helper()
+	resp, body := doJSON(t, http.MethodPost, srv.URL+"/oauth/authorize", accessToken, map[string]any{
+		"response_type":         "code",
+		"client_id":             client.id,
+		"redirect_uri":          testRedirectURI,
+		"scope":                 scope,
+		"state":                 "xyz",
+		"code_challenge":        testChallenge,
+		"code_challenge_method": "S256",
+		"approve":               true,
+	})
+	redirectTo, _ := body["redirect_to"].(string)
+	location, err := url.Parse(redirectTo)
+	if resp.StatusCode != http.StatusOK || err != nil || location.Query().Get("code") == "" {
+		t.Fatalf("approving responded %s: %v", resp.Status, body)
+	}
+	return location.Query().Get("code")
+}
+
+// postOAuth sends form to an OAuth endpoint authenticated as client
+func postOAuth(t *testing.T, srv *httptest.Server, path string, client testClient, form url.Values) (*http.Response, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(client.id), url.QueryEscape(client.secret))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]any{}
+	if resp.ContentLength != 0 {
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil {
+			t.Fatalf("decoding the %s response of %s: %s", resp.Status, path, err)
+		}
+	}
+	return resp, body
+}
+
+func exchangeCode(t *testing.T, srv *httptest.Server, client testClient, code string) (*http.Response, map[string]any) {
+	t.Helper()
+	return postOAuth(t, srv, "/oauth/token", client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testVerifier},
+	})
+}
+
+func refresh(t *testing.T, srv *httptest.Server, client testClient, refreshToken string, scope string) (*http.Response, map[string]any) {
+	t.Helper()
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	return postOAuth(t, srv, "/oauth/token", client, form)
+}
+
+func TestOAuthCodeSurvivesRejectedExchanges(t *testing.T) {
+	_, srv := startTestServer(t, nil)
+	accessToken := loginTestUser(t, srv, "a@x.com")
+	client := registerClient(t, srv, accessToken, ScopeChirpsRead)
+	other := registerClient(t, srv, accessToken, ScopeChirpsRead)
+	code := authorizeCode(t, srv, accessToken, client, ScopeChirpsRead)
+
+	for name, attempt := range map[string]struct {
+		client testClient
+		form   url.Values
+	}{
+		"another redirect URI": {client, url.Values{"redirect_uri": {"https://app.example/other"}}},
+		"another client":       {other, url.Values{}},
+		"a wrong verifier":     {client, url.Values{"code_verifier": {testVerifier[1:] + "x"}}},
+	} {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {testRedirectURI},
+			"code_verifier": {testVerifier},
+		}
+		for key, value := range attempt.form {
+			form[key] = value
+		}
+		resp, body := postOAuth(t, srv, "/oauth/token", attempt.client, form)
+		if resp.StatusCode != http.StatusBadRequest || body["error"] != "invalid_grant" {
+			t.Errorf("exchanging with %s responded %s: %v, want invalid_grant", name, resp.Status, body)
+		}
+	}
+
+	resp, body := exchangeCode(t, srv, client, code)
+	if resp.StatusCode != http.StatusOK || body["access_token"] == "" || body["scope"] != ScopeChirpsRead {
+		t.Fatalf("the code was used up by rejected exchanges: %s %v", resp.Status, body)
+	}
+}
+
+func TestOAuthCodeReplayRevokesSession(t *testing.T) {
+	_, srv := startTestServer(t, nil)
+	accessToken := loginTestUser(t, srv, "a@x.com")
+	client := registerClient(t, srv, accessToken, ScopeChirpsRead)
+	code := authorizeCode(t, srv, accessToken, client, ScopeChirpsRead)
+
+	resp, tokens := exchangeCode(t, srv, client, code)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("exchanging the code responded %s: %v", resp.Status, tokens)
+	}
+	resp, body := exchangeCode(t, srv, client, code)
+	if resp.StatusCode != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("exchanging the code again responded %s: %v, want invalid_grant", resp.Status, body)
+	}
+	// the session the code started is over
+	resp, body = refresh(t, srv, client, tokens["refresh_token"].(string), "")
+	if resp.StatusCode != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("refreshing after the replay responded %s: %v, want invalid_grant", resp.Status, body)
+	}
+}
+
+func TestOAuthRefreshKeepsGrantedScopes(t *testing.T) {
+	_, srv := startTestServer(t, nil)
+	accessToken := loginTestUser(t, srv, "a@x.com")
+	client := registerClient(t, srv, accessToken, ScopeChirpsRead, ScopeProfileRead)
+	code := authorizeCode(t, srv, accessToken, client, ScopeChirpsRead)
+	resp, tokens := exchangeCode(t, srv, client, code)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("exchanging the code responded %s: %v", resp.Status, tokens)
+	}
+
+	// the client may ask for the scope but the user didn't grant it
+	resp, body := refresh(t, srv, client, tokens["refresh_token"].(string), ScopeChirpsRead+" "+ScopeProfileRead)
+	if resp.StatusCode != http.StatusBadRequest || body["error"] != "invalid_scope" {
+		t.Fatalf("widening the scopes responded %s: %v, want invalid_scope", resp.Status, body)
+	}
+	resp, body = refresh(t, srv, client, tokens["refresh_token"].(string), "")
+	if resp.StatusCode != http.StatusOK || body["scope"] != ScopeChirpsRead {
+		t.Fatalf("refreshing responded %s: %v, want the granted scope", resp.Status, body)
+	}
+	resp, body = doJSON(t, http.MethodPost, srv.URL+"/api/chirps", body["access_token"].(string),
+		map[string]string{"body": "hello"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("posting a chirp with a chirps:read token responded %s: %v, want 403", resp.Status, body)
+	}
+}
+
+func TestOAuthIntrospectOwnTokensOnly(t *testing.T) {
+	_, srv := startTestServer(t, nil)
+	accessToken := loginTestUser(t, srv, "a@x.com")
+	client := registerClient(t, srv, accessToken, ScopeChirpsRead)
+	other := registerClient(t, srv, accessToken, ScopeChirpsRead)
+	code := authorizeCode(t, srv, accessToken, client, ScopeChirpsRead)
+	_, tokens := exchangeCode(t, srv, client, code)
+
+	for _, token := range []string{tokens["access_token"].(string), tokens["refresh_token"].(string)} {
+		resp, body := postOAuth(t, srv, "/oauth/introspect", client, url.Values{"token": {token}})
+		if resp.StatusCode != http.StatusOK || body["active"] != true || body["client_id"] != client.id ||
+			body["scope"] != ScopeChirpsRead {
+			t.Errorf("introspecting an own token responded %s: %v", resp.Status, body)
+		}
+		resp, body = postOAuth(t, srv, "/oauth/introspect", other, url.Values{"token": {token}})
+		if resp.StatusCode != http.StatusOK || body["active"] != false || len(body) != 1 {
+			t.Errorf("introspecting the token of another client responded %s: %v, want only inactive", resp.Status, body)
+		}
+	}
+	// tokens of the first-party login aren't any client's
+	resp, body := postOAuth(t, srv, "/oauth/introspect", client, url.Values{"token": {accessToken}})
+	if resp.StatusCode != http.StatusOK || body["active"] != false {
+		t.Errorf("introspecting a login token responded %s: %v, want inactive", resp.Status, body)
+	}
+}
+
+func TestOAuthRevokeEndsSession(t *testing.T) {
+	_, srv := startTestServer(t, nil)
+	accessToken := loginTestUser(t, srv, "a@x.com")
+	client := registerClient(t, srv, accessToken, ScopeChirpsRead)
+	code := authorizeCode(t, srv, accessToken, client, ScopeChirpsRead)
+	_, tokens := exchangeCode(t, srv, client, code)
+	// the revoked token is an earlier one of the family
+	first := tokens["refresh_token"].(string)
+	resp, rotated := refresh(t, srv, client, first, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refreshing responded %s: %v", resp.Status, rotated)
+	}
+
+	resp, body := postOAuth(t, srv, "/oauth/revoke", client, url.Values{"token": {tokens["access_token"].(string)}})
+	if resp.StatusCode != http.StatusBadRequest || body["error"] != "unsupported_token_type" {
+		t.Fatalf("revoking an access token responded %s: %v, want unsupported_token_type", resp.Status, body)
+	}
+	latest := rotated["refresh_token"].(string)
+	resp, body = postOAuth(t, srv, "/oauth/revoke", client, url.Values{"token": {latest}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking responded %s: %v", resp.Status, body)
+	}
+	resp, body = refresh(t, srv, client, latest, "")
+	if resp.StatusCode != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("refreshing a revoked token responded %s: %v, want invalid_grant", resp.Status, body)
+	}
+	resp, body = postOAuth(t, srv, "/oauth/introspect", client, url.Values{"token": {latest}})
+	if body["active"] != false {
+		t.Fatalf("a revoked token is %v", body)
+	}
+	// unknown tokens are no error
+	resp, _ = postOAuth(t, srv, "/oauth/revoke", client, url.Values{"token": {"unknown"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking an unknown token responded %s, want 200", resp.Status)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// the example of RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if !verifyCodeChallenge(verifier, challenge) {
+		t.Fatal("the RFC 7636 example verifier doesn't match its challenge")
+	}
+	for name, verifier := range map[string]string{
+		"empty":     "",
+		"other":     "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXl",
+		"too short": "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjX",
+		"challenge": challenge,
+	} {
+		if verifyCodeChallenge(verifier, challenge) {
+			t.Errorf("%s verifier matches the challenge", name)
+		}
+	}
+}
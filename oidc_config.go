@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dimadudin/web-server-go/internal/oidc"
+)
+
+const (
+	defaultOIDCScopes       = "email profile"
+	defaultOIDCCallbackPath = "/api/login/oidc/callback"
+)
+
+// OIDCConfig is the external OpenID Connect provider users may sign in with
+type OIDCConfig struct {
+	// RP is nil when no provider is configured
+	RP *oidc.RelyingParty
+	// AllowedDomains limit the email domains that may sign in,
+	// any domain may if it is empty
+	AllowedDomains []string
+	// Provision creates users for verified emails without an account
+	Provision bool
+}
+
+// LoadOIDCConfig reads the provider settings from the environment,
+// signing in with a provider is enabled by setting OIDC_ISSUER,
+// the redirect URL defaults to the callback under publicURL
+func LoadOIDCConfig(publicURL string) (OIDCConfig, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return OIDCConfig{}, nil
+	}
+	rpCfg := oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+	}
+	if rpCfg.ClientID == "" {
+		return OIDCConfig{}, fmt.Errorf("OIDC_CLIENT_ID is required by OIDC_ISSUER")
+	}
+	if rpCfg.RedirectURL == "" {
+		rpCfg.RedirectURL = publicURL + defaultOIDCCallbackPath
+	}
+	scopes := os.Getenv("OIDC_SCOPES")
+	if scopes == "" {
+		scopes = defaultOIDCScopes
+	}
+	for _, scope := range strings.Fields(scopes) {
+		if scope != "openid" {
+			rpCfg.Scopes = append(rpCfg.Scopes, scope)
+		}
+	}
+
+	oc := OIDCConfig{RP: oidc.NewRelyingParty(rpCfg), Provision: true}
+	for _, domain := range strings.Split(os.Getenv("OIDC_ALLOWED_DOMAINS"), ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			oc.AllowedDomains = append(oc.AllowedDomains, domain)
+		}
+	}
+	if p := os.Getenv("OIDC_PROVISION"); p != "" {
+		provision, err := strconv.ParseBool(p)
+		if err != nil {
+			return OIDCConfig{}, fmt.Errorf("invalid OIDC_PROVISION %q", p)
+		}
+		oc.Provision = provision
+	}
+	return oc, nil
+}
+
+// allowsEmail reports whether email is in one of the allowed domains
+func (oc OIDCConfig) allowsEmail(email string) bool {
+	if len(oc.AllowedDomains) == 0 {
+		return true
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	domain = strings.ToLower(domain)
+	for _, allowed := range oc.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	issuerOIDCLogin = "chirpy-oidc-login"
+	oidcLoginTTL    = 10 * time.Minute
+	oidcLoginCookie = "chirpy_oidc"
+	oidcLoginPath   = "/api/login/oidc"
+	// oidcLoginPage completes a sign in in the browser, it redeems the code
+	// the callback hands off and asks for the second factor if needed
+	oidcLoginPage    = "/app/oidc_login.html"
+	purposeOIDCLogin = "oidc_login"
+	oidcHandoffTTL   = 2 * time.Minute
+)
+
+var (
+	errOIDCDisabled       = errors.New("signing in with an identity provider isn't enabled")
+	errOIDCLoginExpired   = errors.New("the sign in expired or was started in another browser, start over")
+	errOIDCEmailUnusable  = errors.New("the identity provider didn't vouch for an email address")
+	errOIDCDomainRejected = errors.New("accounts of this email domain can't sign in")
+	errOIDCNoAccount      = errors.New("no account has this email address")
+	errOIDCInvalidCode    = errors.New("invalid or expired sign in code, start over")
+)
+
+// oidcLoginClaims are the claims of the cookie that carries a sign in
+// from the redirect to the provider to the callback
+type oidcLoginClaims struct {
+	jwt.RegisteredClaims
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// ApiLoginOIDC sends the user to sign in with the identity provider,
+// the optional login_hint query parameter suggests the account to use
+func (cfg *Config) ApiLoginOIDC(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc.RP == nil {
+		RespondWithError(w, http.StatusNotFound, errOIDCDisabled.Error())
+		return
+	}
+
+	login := oidcLoginClaims{}
+	for _, s := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		var err error
+		*s, err = randomToken()
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	now := time.Now().UTC()
+	login.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    issuerOIDCLogin,
+		ExpiresAt: jwt.NewNumericDate(now.Add(oidcLoginTTL)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+	cookieStr, err := cfg.tokenKeys.Sign(login)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	authURL, err := cfg.oidc.RP.AuthCodeURL(r.Context(), login.State, login.Nonce, login.Verifier,
+		r.URL.Query().Get("login_hint"))
+	if err != nil {
+		log.Printf("oidc: %s", err)
+		RespondWithError(w, http.StatusBadGateway, "the identity provider is unavailable")
+		return
+	}
+	http.SetCookie(w, cfg.oidcLoginCookie(cookieStr, int(oidcLoginTTL.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcLoginCookie returns the sign in cookie, which is only sent back to the
+// callback and is removed when maxAge is negative
+func (cfg *Config) oidcLoginCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     oidcLoginPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.mail.PublicURL, "https://"),
+		// Lax still sends the cookie on the top level redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ApiLoginOIDCCallback completes a sign in with the identity provider, it links
+// the provider account to the user with its verified email, creating the user
+// if needed. The browser is sent on to oidcLoginPage with a single-use code
+// that ApiRedeemOIDCLogin exchanges for the session, or with the error
+func (cfg *Config) ApiLoginOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc.RP == nil {
+		RespondWithError(w, http.StatusNotFound, errOIDCDisabled.Error())
+		return
+	}
+	http.SetCookie(w, cfg.oidcLoginCookie("", -1))
+
+	q := r.URL.Query()
+	if providerErr := q.Get("error"); providerErr != "" {
+		msg := "the identity provider refused the sign in: " + providerErr
+		if desc := q.Get("error_description"); desc != "" {
+			msg += ", " + desc
+		}
+		redirectToOIDCLoginPage(w, r, url.Values{"error": {msg}})
+		return
+	}
+
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil {
+		redirectToOIDCLoginPage(w, r, url.Values{"error": {errOIDCLoginExpired.Error()}})
+		return
+	}
+	login := oidcLoginClaims{}
+	_, err = jwt.ParseWithClaims(cookie.Value, &login, cfg.tokenKeys.Keyfunc,
+		jwt.WithValidMethods(cfg.tokenKeys.Methods()),
+		jwt.WithIssuer(issuerOIDCLogin),
+		jwt.WithExpirationRequired())
+	if err != nil || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(login.State)) != 1 {
+		redirectToOIDCLoginPage(w, r, url.Values{"error": {errOIDCLoginExpired.Error()}})
+		return
+	}
+
+	rawIDToken, err := cfg.oidc.RP.Exchange(r.Context(), q.Get("code"), login.Verifier)
+	if err != nil {
+		log.Printf("oidc: %s", err)
+		redirectToOIDCLoginPage(w, r, url.Values{"error": {"exchanging the code with the identity provider failed"}})
+		return
+	}
+	claims, err := cfg.oidc.RP.VerifyIDToken(r.Context(), rawIDToken, login.Nonce)
+	if err != nil {
+		log.Printf("oidc: %s", err)
+		redirectToOIDCLoginPage(w, r, url.Values{"error": {"the identity provider returned an invalid ID token"}})
+		return
+	}
+
+	user, err := cfg.oidcUser(claims.Issuer, claims.Subject, claims.Email, bool(claims.EmailVerified))
+	if err != nil {
+		redirectToOIDCLoginPage(w, r, url.Values{"error": {err.Error()}})
+		return
+	}
+	codeStr, err := randomToken()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = cfg.db.CreateOneTimeToken(codeStr, database.OneTimeToken{
+		Purpose:   purposeOIDCLogin,
+		UserId:    user.Id,
+		Email:     user.Email,
+		ExpiresAt: time.Now().UTC().Add(oidcHandoffTTL),
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	redirectToOIDCLoginPage(w, r, url.Values{"code": {codeStr}})
+}
+
+// redirectToOIDCLoginPage sends the browser to oidcLoginPage with params in the
+// fragment, which keeps the code out of server logs and Referer headers
+func redirectToOIDCLoginPage(w http.ResponseWriter, r *http.Request, params url.Values) {
+	http.Redirect(w, r, oidcLoginPage+"#"+params.Encode(), http.StatusFound)
+}
+
+// ApiRedeemOIDCLogin exchanges the code ApiLoginOIDCCallback handed off
+// for a session, or a second factor challenge, like ApiLogin does
+func (cfg *Config) ApiRedeemOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Code string `json:"code"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, err := cfg.db.UseOneTimeToken(rqParams.Code, purposeOIDCLogin)
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenUsed) ||
+		errors.Is(err, database.ErrTokenExpired) {
+		RespondWithError(w, http.StatusUnauthorized, errOIDCInvalidCode.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	user, err := cfg.db.GetUserByID(token.UserId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		RespondWithError(w, http.StatusUnauthorized, errOIDCInvalidCode.Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.completeLogin(w, r, user, user.Email)
+}
+
+// oidcUser returns the user the provider account subject is linked to,
+// or links it to the user with its verified email, which is created
+// if it doesn't exist yet and provisioning is enabled
+func (cfg *Config) oidcUser(issuer string, subject string, email string, emailVerified bool) (database.User, error) {
+	// an unverified email may still be remembered, but it never selects or restricts an account
+	addr, emailErr := validateEmail(email)
+	usable := emailErr == nil && emailVerified
+	if len(cfg.oidc.AllowedDomains) > 0 && (!usable || !cfg.oidc.allowsEmail(addr)) {
+		return database.User{}, errOIDCDomainRejected
+	}
+
+	now := time.Now().UTC()
+	identity, err := cfg.db.GetExternalIdentity(issuer, subject)
+	if err == nil {
+		user, err := cfg.db.GetUserByID(identity.UserId)
+		if err == nil {
+			identity.Email = email
+			identity.LastLoginAt = now
+			_, err = cfg.db.SaveExternalIdentity(identity)
+			if err != nil {
+				return database.User{}, err
+			}
+			return user, nil
+		}
+		// the user was deleted, the account is linked again below
+		if !errors.Is(err, database.ErrUserNotFound) {
+			return database.User{}, err
+		}
+	} else if !errors.Is(err, database.ErrIdentityNotFound) {
+		return database.User{}, err
+	}
+
+	if !usable {
+		return database.User{}, errOIDCEmailUnusable
+	}
+	user, err := cfg.db.GetUserByEmail(addr)
+	if errors.Is(err, database.ErrEmailNotFound) {
+		if !cfg.oidc.Provision {
+			return database.User{}, errOIDCNoAccount
+		}
+		// without a password the user can only sign in through a provider
+		// until they set one with a password reset
+		user, err = cfg.db.CreateUser(addr, "")
+		if errors.Is(err, database.ErrEmailTaken) {
+			user, err = cfg.db.GetUserByEmail(addr)
+		}
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+	// the provider vouched for the address
+	user, err = cfg.claimEmail(user.Id)
+	if err != nil {
+		return database.User{}, err
+	}
+	_, err = cfg.db.SaveExternalIdentity(database.ExternalIdentity{
+		Issuer:      issuer,
+		Subject:     subject,
+		UserId:      user.Id,
+		Email:       email,
+		LastLoginAt: now,
+	})
+	if err != nil {
+		return database.User{}, fmt.Errorf("linking the identity: %w", err)
+	}
+	log.Printf("oidc: linked %s at %s to user %d", subject, issuer, user.Id)
+	return user, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/dimadudin/web-server-go/internal/oidc"
+)
+
+// startOIDCLogin serves chirpy with signing in through a mock provider enabled
+func startOIDCLogin(t *testing.T) (*database.DB, *httptest.Server) {
+	t.Helper()
+	provider := httptest.NewUnstartedServer(nil)
+	mock, err := oidc.NewMockProvider("http://"+provider.Listener.Addr().String(), "chirpy", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.Config.Handler = mock.Handler()
+	provider.Start()
+	t.Cleanup(provider.Close)
+
+	return startTestServer(t, func(publicURL string) OIDCConfig {
+		return OIDCConfig{
+			RP: oidc.NewRelyingParty(oidc.Config{
+				Issuer:       mock.Issuer,
+				ClientID:     mock.ClientID,
+				ClientSecret: mock.ClientSecret,
+				RedirectURL:  publicURL + defaultOIDCCallbackPath,
+			}),
+			Provision: true,
+		}
+	})
+}
+
+// oidcHandoff signs in as email through the provider like a browser would,
+// following the redirects with the cookies they set, and returns the
+// parameters the callback hands to the login page
+func oidcHandoff(t *testing.T, srv *httptest.Server, email string) url.Values {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Path == oidcLoginPage {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(srv.URL + oidcLoginPath + "?login_hint=" + email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return loginPageParams(t, resp)
+}
+
+// loginPageParams returns the fragment of a redirect to the login page
+func loginPageParams(t *testing.T, resp *http.Response) url.Values {
+	t.Helper()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || location.Path != oidcLoginPage {
+		t.Fatalf("sign in responded %s to %s, want a redirect to the login page", resp.Status, location)
+	}
+	params, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+// redeemOIDC exchanges the handed off code like the login page does
+func redeemOIDC(t *testing.T, srv *httptest.Server, code string) (*http.Response, map[string]any) {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/api/login/oidc/redeem", "application/json",
+		strings.NewReader(`{"code": "`+code+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]any{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		t.Fatalf("decoding the %s response: %s", resp.Status, err)
+	}
+	return resp, body
+}
+
+// loginOIDC signs in as email and redeems the handed off code
+func loginOIDC(t *testing.T, srv *httptest.Server, email string) (*http.Response, map[string]any) {
+	t.Helper()
+	params := oidcHandoff(t, srv, email)
+	if params.Get("code") == "" {
+		t.Fatalf("the login page got no code: %v", params)
+	}
+	return redeemOIDC(t, srv, params.Get("code"))
+}
+
+func TestOIDCLoginLinksUserByEmail(t *testing.T) {
+	db, srv := startOIDCLogin(t)
+	user, err := db.CreateUser("a@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = db.ModifyUser(user.Id, func(user *database.User) error {
+		user.EmailVerified = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := loginOIDC(t, srv, "A@x.com")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login responded %s: %v", resp.Status, body)
+	}
+	if body["id"] != float64(user.Id) || body["token"] == "" || body["refresh_token"] == "" {
+		t.Fatalf("login response is %v, want a session of user %d", body, user.Id)
+	}
+	linked, err := db.GetUserByID(user.Id)
+	if err != nil || linked.Password != "hash" {
+		t.Fatalf("the password of a verified user changed: %+v (%v)", linked, err)
+	}
+
+	// the second login finds the user by the linked identity
+	resp, body = loginOIDC(t, srv, "a@x.com")
+	if resp.StatusCode != http.StatusOK || body["id"] != float64(user.Id) {
+		t.Fatalf("second login responded %s: %v", resp.Status, body)
+	}
+	users, err := db.GetUsers()
+	if err != nil || len(users) != 1 {
+		t.Fatalf("users are %+v (%v), want only the linked one", users, err)
+	}
+}
+
+func TestOIDCLoginClaimsUnverifiedSignup(t *testing.T) {
+	db, srv := startOIDCLogin(t)
+	squatter, err := db.CreateUser("b@x.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := loginOIDC(t, srv, "b@x.com")
+	if resp.StatusCode != http.StatusOK || body["id"] != float64(squatter.Id) {
+		t.Fatalf("login responded %s: %v", resp.Status, body)
+	}
+	user, err := db.GetUserByID(squatter.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified || user.Password != "" {
+		t.Fatalf("claimed user is %+v, want it verified and without the password of the signup", user)
+	}
+
+	// a provider account with an email nobody has gets a new user
+	resp, body = loginOIDC(t, srv, "c@x.com")
+	if resp.StatusCode != http.StatusOK || body["email"] != "c@x.com" || body["email_verified"] != true {
+		t.Fatalf("login of a new email responded %s: %v", resp.Status, body)
+	}
+}
+
+func TestOIDCHandoffCodeWorksOnce(t *testing.T) {
+	_, srv := startOIDCLogin(t)
+	params := oidcHandoff(t, srv, "d@x.com")
+	resp, body := redeemOIDC(t, srv, params.Get("code"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("redeeming responded %s: %v", resp.Status, body)
+	}
+	resp, body = redeemOIDC(t, srv, params.Get("code"))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("redeeming the code again responded %s: %v, want 401", resp.Status, body)
+	}
+}
+
+func TestOIDCCallbackRequiresLoginCookie(t *testing.T) {
+	_, srv := startOIDCLogin(t)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(srv.URL + defaultOIDCCallbackPath + "?code=code&state=state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	params := loginPageParams(t, resp)
+	if params.Get("error") != errOIDCLoginExpired.Error() || params.Has("code") {
+		t.Fatalf("callback without the login cookie handed off %v, want the error", params)
+	}
+}
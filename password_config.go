@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/dimadudin/web-server-go/internal/password"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultPasswordMinLength = 8
+	defaultArgon2Memory      = 64 * 1024
+	defaultArgon2Time        = 3
+	defaultArgon2Threads     = 2
+)
+
+// PasswordConfig is how passwords are hashed and what new ones have to meet
+type PasswordConfig struct {
+	Hasher password.Hasher
+	Policy *password.Policy
+	// dummyHash is verified against when no user has the email,
+	// so that the response takes as long as for a wrong password
+	dummyHash string
+}
+
+// LoadPasswordConfig reads the password settings from the environment,
+// PASSWORD_HASH picks bcrypt (the default) or argon2id
+func LoadPasswordConfig() (PasswordConfig, error) {
+	pc := PasswordConfig{Policy: &password.Policy{MinLength: defaultPasswordMinLength}}
+
+	var err error
+	switch algorithm := os.Getenv("PASSWORD_HASH"); algorithm {
+	case "", "bcrypt":
+		cost, err := envInt("BCRYPT_COST", bcrypt.DefaultCost)
+		if err != nil {
+			return PasswordConfig{}, err
+		}
+		pc.Hasher, err = password.NewBcrypt(cost)
+		if err != nil {
+			return PasswordConfig{}, err
+		}
+	case "argon2id":
+		memory, err := envInt("ARGON2_MEMORY", defaultArgon2Memory)
+		if err != nil {
+			return PasswordConfig{}, err
+		}
+		iterations, err := envInt("ARGON2_TIME", defaultArgon2Time)
+		if err != nil {
+			return PasswordConfig{}, err
+		}
+		threads, err := envInt("ARGON2_THREADS", defaultArgon2Threads)
+		if err != nil || threads > 255 {
+			return PasswordConfig{}, fmt.Errorf("invalid ARGON2_THREADS %q", os.Getenv("ARGON2_THREADS"))
+		}
+		pc.Hasher, err = password.NewArgon2id(uint32(memory), uint32(iterations), uint8(threads))
+		if err != nil {
+			return PasswordConfig{}, err
+		}
+	default:
+		return PasswordConfig{}, fmt.Errorf("unknown PASSWORD_HASH %q, want bcrypt or argon2id", algorithm)
+	}
+
+	pc.Policy.MinLength, err = envInt("PASSWORD_MIN_LENGTH", defaultPasswordMinLength)
+	if err != nil {
+		return PasswordConfig{}, err
+	}
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		err = pc.Policy.LoadBreached(path)
+		if err != nil {
+			return PasswordConfig{}, fmt.Errorf("loading PASSWORD_BREACHED_LIST: %w", err)
+		}
+		log.Printf("loaded %d breached passwords", pc.Policy.Breached())
+	}
+
+	dummy := make([]byte, 16)
+	_, err = rand.Read(dummy)
+	if err != nil {
+		return PasswordConfig{}, err
+	}
+	pc.dummyHash, err = pc.Hasher.Hash(hex.EncodeToString(dummy))
+	if err != nil {
+		return PasswordConfig{}, err
+	}
+	return pc, nil
+}
+
+// envInt reads a positive integer from the environment variable name
+func envInt(name string, fallback int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	purposePasswordReset = "password_reset"
+	passwordResetTTL     = 30 * time.Minute
+)
+
+// ApiRequestPasswordReset emails a single-use password reset link to the user,
+// the response is the same whether or not the email belongs to a user.
+// The link is issued in the background so the response time doesn't tell either
+func (cfg *Config) ApiRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Email string `json:"email"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wait, err := cfg.recordPasswordReset(rqParams.Email, ClientIP(r))
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		RespondWithError(w, http.StatusTooManyRequests, errors.New("too many password resets requested, try again later").Error())
+		return
+	}
+
+	cfg.outgoing.Add(1)
+	go func() {
+		defer cfg.outgoing.Done()
+		err := cfg.sendPasswordReset(rqParams.Email)
+		if err != nil {
+			log.Printf("password reset for %s failed: %s", rqParams.Email, err)
+		}
+	}()
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusAccepted, respParams)
+}
+
+// sendPasswordReset issues a reset token to the user with the email
+// and emails the link, an email no user has is ignored
+func (cfg *Config) sendPasswordReset(email string) error {
+	user, err := cfg.db.GetUserByEmail(email)
+	if errors.Is(err, database.ErrEmailNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tokenStr, err := randomToken()
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.CreateOneTimeToken(tokenStr, database.OneTimeToken{
+		Purpose:   purposePasswordReset,
+		UserId:    user.Id,
+		Email:     user.Email,
+		ExpiresAt: time.Now().UTC().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/app/password_reset.html?token=%s", cfg.mail.PublicURL, url.QueryEscape(tokenStr))
+	cfg.sendMail(user.Email, "Reset your Chirpy password", fmt.Sprintf(`Someone asked to reset the password of your Chirpy account.
+
+To choose a new password, open this link within %d minutes:
+
+%s
+
+If it wasn't you, ignore this email and your password stays the same.
+`, int(passwordResetTTL.Minutes()), link))
+	return nil
+}
+
+// ApiConfirmPasswordReset sets a new password with a reset token, logs the user
+// out of every session and deletes their personal access tokens, the email the
+// token was sent to counts as verified
+func (cfg *Config) ApiConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = cfg.passwords.Policy.Check(rqParams.Password)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, err := cfg.db.UseOneTimeToken(rqParams.Token, purposePasswordReset)
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenUsed) ||
+		errors.Is(err, database.ErrTokenExpired) {
+		RespondWithError(w, http.StatusBadRequest, errors.New("invalid or expired reset token").Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	hashedPassword, err := cfg.passwords.Hasher.Hash(rqParams.Password)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	user, err := cfg.db.ModifyUser(token.UserId, func(user *database.User) error {
+		user.Password = hashedPassword
+		// redeeming the emailed token proves the user receives mail at the address,
+		// unless the email changed since the token was sent
+		if strings.EqualFold(user.Email, token.Email) {
+			user.EmailVerified = true
+		}
+		return nil
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	revoked, err := cfg.db.RevokeUserTokens(user.Id)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	deleted, err := cfg.db.DeletePersonalTokensByUser(user.Id)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("password of user %d reset, %d sessions revoked and %d personal access tokens deleted",
+		user.Id, revoked, deleted)
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	// personalTokenPrefix tells personal access tokens apart from JWTs
+	// and makes leaked ones easy to find with secret scanners
+	personalTokenPrefix  = "chirpy_pat_"
+	maxPersonalTokenName = 100
+	// personalTokenTouchInterval limits how often last use is written to the store
+	personalTokenTouchInterval = time.Minute
+)
+
+// Scopes a personal access token can be limited to, access tokens
+// from a login aren't limited
+const (
+	// ScopeChirpsRead reads chirps, which needs no token, but a token that is
+	// presented anyway must have it
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	ScopeProfileRead = "profile:read"
+	// ScopeProfileWrite changes the email, password and sessions of the user
+	ScopeProfileWrite = "profile:write"
+	// ScopeAdmin lets the token use the permissions of the role of its user
+	ScopeAdmin = "admin"
+)
+
+var knownScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileRead, ScopeProfileWrite, ScopeAdmin}
+
+// personalTokenClaims are the claims a personal access token stands for,
+// it carries the role of its user only with the admin scope
+func personalTokenClaims(user database.User, token database.PersonalToken) *TokenClaims {
+	claims := &TokenClaims{}
+	claims.Issuer = issuerAccess
+	claims.Subject = strconv.Itoa(user.Id)
+	if slices.Contains(token.Scopes, ScopeAdmin) {
+		claims.Role = userRole(user)
+	}
+	return claims
+}
+
+// PersonalToken is a personal access token as shown to its user
+type PersonalToken struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newPersonalTokenView(token database.PersonalToken) PersonalToken {
+	view := PersonalToken{Id: token.Id, Name: token.Name, Scopes: token.Scopes, CreatedAt: token.CreatedAt}
+	if !token.ExpiresAt.IsZero() {
+		view.ExpiresAt = &token.ExpiresAt
+	}
+	if !token.LastUsedAt.IsZero() {
+		view.LastUsedAt = &token.LastUsedAt
+	}
+	return view
+}
+
+// ApiCreatePersonalToken creates a personal access token for the caller,
+// the token is only part of this response
+func (cfg *Config) ApiCreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	type requestParameters struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := strings.TrimSpace(rqParams.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxPersonalTokenName {
+		RespondWithError(w, http.StatusBadRequest,
+			fmt.Errorf("name must be between 1 and %d characters long", maxPersonalTokenName).Error())
+		return
+	}
+	if len(rqParams.Scopes) == 0 {
+		RespondWithError(w, http.StatusBadRequest, errors.New("at least one scope is required").Error())
+		return
+	}
+	scopes := []string{}
+	for _, scope := range rqParams.Scopes {
+		if !slices.Contains(knownScopes, scope) {
+			RespondWithError(w, http.StatusBadRequest, fmt.Errorf("unknown scope %q", scope).Error())
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if slices.Contains(scopes, ScopeAdmin) && len(rolePermissions[userRole(user)]) == 0 {
+		RespondWithError(w, http.StatusForbidden, errors.New("the admin scope needs a role with permissions").Error())
+		return
+	}
+	expiresAt := time.Time{}
+	if rqParams.ExpiresAt != nil {
+		expiresAt = rqParams.ExpiresAt.UTC()
+		if !expiresAt.After(time.Now()) {
+			RespondWithError(w, http.StatusBadRequest, errors.New("expires_at must be in the future").Error())
+			return
+		}
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tokenStr := personalTokenPrefix + secret
+	token, err := cfg.db.CreatePersonalToken(tokenStr, database.PersonalToken{
+		UserId:    user.Id,
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct {
+		PersonalToken
+		Token string `json:"token"`
+	}
+	respParams := responseParameters{PersonalToken: newPersonalTokenView(token), Token: tokenStr}
+	RespondWithJSON(w, http.StatusCreated, respParams)
+}
+
+// ApiGetPersonalTokens lists the personal access tokens of the caller, newest first
+func (cfg *Config) ApiGetPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	tokens, err := cfg.db.GetPersonalTokensByUser(user.Id)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	views := make([]PersonalToken, 0, len(tokens))
+	for _, token := range tokens {
+		views = append(views, newPersonalTokenView(token))
+	}
+	RespondWithJSON(w, http.StatusOK, views)
+}
+
+// ApiDeletePersonalToken revokes a personal access token of the caller
+func (cfg *Config) ApiDeletePersonalToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	err := cfg.db.DeletePersonalToken(user.Id, r.PathValue("tokenID"))
+	if errors.Is(err, database.ErrTokenNotFound) {
+		RespondWithError(w, http.StatusNotFound, errors.New("no personal access token with such id").Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
@@ -8,27 +8,80 @@ const (
 
 func Route(cfg Config) http.Handler {
 	mux := http.NewServeMux()
+	requireAccess := cfg.MwRequireAuth(issuerAccess)
+	requireRefresh := cfg.MwRequireAuth(issuerRefresh)
+	requireMfa := cfg.MwRequireAuth(issuerMfa)
+	// these also take personal access tokens and OAuth client tokens with the scope
+	requireChirpsWrite := cfg.MwRequireScope(ScopeChirpsWrite)
+	// reading chirps needs no token, but a token presented must have the scope
+	readChirps := cfg.MwOptionalScope(ScopeChirpsRead)
+	requireProfileRead := cfg.MwRequireScope(ScopeProfileRead)
+	requireProfileWrite := cfg.MwRequireScope(ScopeProfileWrite)
+	// requirePermission also takes personal access tokens with the admin scope
+	requirePermission := func(perm Permission, h http.HandlerFunc) http.Handler {
+		return cfg.MwRequireScope(ScopeAdmin)(cfg.MwRequirePermission(perm)(h))
+	}
 
 	fsHandler := http.StripPrefix("/app", http.FileServer(http.Dir(rootDir)))
 	fsHandler = cfg.MwIncrementHits(fsHandler)
 	mux.Handle("/app/*", fsHandler)
 
 	mux.HandleFunc("GET /api/healthz", ApiCheckHealth)
-	mux.HandleFunc("GET /api/reset", cfg.ApiResetHits)
-	mux.HandleFunc("POST /api/refresh", cfg.ApiRefreshToken)
-	mux.HandleFunc("POST /api/revoke", cfg.ApiRevokeToken)
-	mux.HandleFunc("GET /admin/metrics", cfg.AdminGetHitCount)
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.ApiGetJWKS)
+	mux.Handle("GET /api/reset", requirePermission(PermResetMetrics, cfg.ApiResetHits))
+	mux.Handle("POST /api/refresh", requireRefresh(http.HandlerFunc(cfg.ApiRefreshToken)))
+	mux.Handle("POST /api/revoke", requireRefresh(http.HandlerFunc(cfg.ApiRevokeToken)))
+	mux.Handle("GET /admin/metrics", requirePermission(PermViewMetrics, cfg.AdminGetHitCount))
+	mux.Handle("GET /admin/snapshot", requirePermission(PermManageSnapshots, cfg.AdminSnapshot))
+	mux.Handle("POST /admin/restore", requirePermission(PermManageSnapshots, cfg.AdminRestore))
+	mux.Handle("PUT /admin/users/{userID}/role", requirePermission(PermManageRoles, cfg.AdminSetUserRole))
 
 	mux.HandleFunc("POST /api/users", cfg.ApiCreateUser)
-	mux.HandleFunc("PUT /api/users", cfg.ApiUpdateUser)
+	// changing the password or email takes a login, no personal access token
+	mux.Handle("PUT /api/users", requireAccess(cfg.MwRequireTwoFactor(http.HandlerFunc(cfg.ApiUpdateUser))))
+	mux.HandleFunc("POST /api/users/verify_email", cfg.ApiVerifyEmail)
+	mux.Handle("POST /api/users/verify_email/resend", requireProfileWrite(http.HandlerFunc(cfg.ApiResendVerificationEmail)))
 	mux.HandleFunc("POST /api/login", cfg.ApiLogin)
+	mux.Handle("POST /api/login/2fa", requireMfa(http.HandlerFunc(cfg.ApiLoginTwoFactor)))
+	mux.HandleFunc("POST /api/login/magic", cfg.ApiRequestMagicLink)
+	mux.HandleFunc("POST /api/login/magic/redeem", cfg.ApiRedeemMagicLink)
+	mux.HandleFunc("GET /api/login/oidc", cfg.ApiLoginOIDC)
+	mux.HandleFunc("GET /api/login/oidc/callback", cfg.ApiLoginOIDCCallback)
+	mux.HandleFunc("POST /api/login/oidc/redeem", cfg.ApiRedeemOIDCLogin)
+	mux.HandleFunc("POST /api/password_reset", cfg.ApiRequestPasswordReset)
+	mux.HandleFunc("POST /api/password_reset/confirm", cfg.ApiConfirmPasswordReset)
+
+	mux.Handle("GET /api/sessions", requireProfileRead(http.HandlerFunc(cfg.ApiGetSessions)))
+	mux.Handle("DELETE /api/sessions/{sessionID}", requireProfileWrite(http.HandlerFunc(cfg.ApiRevokeSession)))
+	mux.Handle("POST /api/sessions/revoke_all", requireProfileWrite(http.HandlerFunc(cfg.ApiRevokeAllSessions)))
+
+	mux.Handle("POST /api/tokens", requireAccess(http.HandlerFunc(cfg.ApiCreatePersonalToken)))
+	mux.Handle("GET /api/tokens", requireAccess(http.HandlerFunc(cfg.ApiGetPersonalTokens)))
+	mux.Handle("DELETE /api/tokens/{tokenID}", requireAccess(http.HandlerFunc(cfg.ApiDeletePersonalToken)))
+
+	mux.Handle("POST /api/oauth/clients", requireAccess(http.HandlerFunc(cfg.ApiCreateOAuthClient)))
+	mux.Handle("GET /api/oauth/clients", requireAccess(http.HandlerFunc(cfg.ApiGetOAuthClients)))
+	mux.Handle("DELETE /api/oauth/clients/{clientID}", requireAccess(http.HandlerFunc(cfg.ApiDeleteOAuthClient)))
+
+	mux.HandleFunc("GET /.well-known/oauth-authorization-server", cfg.OAuthMetadata)
+	mux.HandleFunc("GET /oauth/authorize", cfg.OAuthAuthorize)
+	mux.HandleFunc("GET /oauth/authorize/details", cfg.OAuthAuthorizationDetails)
+	mux.Handle("POST /oauth/authorize", requireAccess(http.HandlerFunc(cfg.OAuthDecide)))
+	mux.HandleFunc("POST /oauth/token", cfg.OAuthToken)
+	mux.HandleFunc("POST /oauth/introspect", cfg.OAuthIntrospect)
+	mux.HandleFunc("POST /oauth/revoke", cfg.OAuthRevoke)
+
+	mux.Handle("POST /api/2fa/enroll", requireAccess(http.HandlerFunc(cfg.ApiEnrollTwoFactor)))
+	mux.Handle("POST /api/2fa/confirm", requireAccess(http.HandlerFunc(cfg.ApiConfirmTwoFactor)))
+	mux.Handle("POST /api/2fa/recovery_codes", requireAccess(http.HandlerFunc(cfg.ApiRegenerateRecoveryCodes)))
+	mux.Handle("POST /api/2fa/disable", requireAccess(http.HandlerFunc(cfg.ApiDisableTwoFactor)))
 
 	mux.HandleFunc("POST /api/polka/webhooks", cfg.ApiUpgradeUser)
 
-	mux.HandleFunc("POST /api/chirps", cfg.ApiPostChirp)
-	mux.HandleFunc("GET /api/chirps", cfg.ApiGetChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", cfg.ApiGetChirpByID)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", cfg.ApiDeleteChirpByID)
+	mux.Handle("POST /api/chirps", requireChirpsWrite(cfg.MwRequireVerifiedEmail(cfg.MwRequireTwoFactor(http.HandlerFunc(cfg.ApiPostChirp)))))
+	mux.Handle("GET /api/chirps", readChirps(http.HandlerFunc(cfg.ApiGetChirps)))
+	mux.Handle("GET /api/chirps/{chirpID}", readChirps(http.HandlerFunc(cfg.ApiGetChirpByID)))
+	mux.Handle("DELETE /api/chirps/{chirpID}", requireChirpsWrite(cfg.MwRequireTwoFactor(http.HandlerFunc(cfg.ApiDeleteChirpByID))))
 
 	return MwAddCors(mux)
 }
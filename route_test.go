@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/dimadudin/web-server-go/internal/keys"
+	"github.com/dimadudin/web-server-go/internal/mail"
+	"github.com/dimadudin/web-server-go/internal/password"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// startTestServer serves chirpy backed by a new JSON store, oidcFor configures
+// signing in with a provider for the public URL of the server and may be nil
+func startTestServer(t *testing.T, oidcFor func(publicURL string) OIDCConfig) (*database.DB, *httptest.Server) {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	tokenKeys, err := keys.NewSet("", "", []byte("secret"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher, err := password.NewBcrypt(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle, err := LoadLoginThrottleConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(nil)
+	publicURL := "http://" + srv.Listener.Addr().String()
+	oidcCfg := OIDCConfig{}
+	if oidcFor != nil {
+		oidcCfg = oidcFor(publicURL)
+	}
+	mailCfg := MailConfig{Mailer: mail.NewOutbox(t.TempDir()), From: defaultMailFrom, PublicURL: publicURL}
+	cfg := NewApiConfig(db, tokenKeys, "", nil, mailCfg, AccountPolicy{}, throttle,
+		PasswordConfig{Hasher: hasher, Policy: &password.Policy{MinLength: defaultPasswordMinLength}}, oidcCfg)
+	srv.Config.Handler = Route(cfg)
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+		cfg.WaitForMail()
+	})
+	return db, srv
+}
+
+// doJSON sends body as JSON with the bearer token, if any, and decodes the response
+func doJSON(t *testing.T, method string, url string, bearer string, body any) (*http.Response, map[string]any) {
+	t.Helper()
+	dat, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody := map[string]any{}
+	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	if err != nil {
+		t.Fatalf("decoding the %s response of %s %s: %s", resp.Status, method, url, err)
+	}
+	return resp, respBody
+}
+
+// loginTestUser creates a user and returns the access token of a login
+func loginTestUser(t *testing.T, srv *httptest.Server, email string) string {
+	t.Helper()
+	credentials := map[string]string{"email": email, "password": "correct horse battery"}
+	resp, body := doJSON(t, http.MethodPost, srv.URL+"/api/users", "", credentials)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating %s responded %s: %v", email, resp.Status, body)
+	}
+	resp, body = doJSON(t, http.MethodPost, srv.URL+"/api/login", "", credentials)
+	token, _ := body["token"].(string)
+	if resp.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("logging in as %s responded %s: %v", email, resp.Status, body)
+	}
+	return token
+}
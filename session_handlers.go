@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+// Session is a login of a user, the refresh token family it started
+type Session struct {
+	Id         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	Ip         string    `json:"ip"`
+	// Current is set on the session the request was made from
+	Current bool `json:"current"`
+}
+
+// activeSessions groups the refresh tokens of a user into their sessions,
+// a session is active while its newest token is neither revoked nor expired
+func activeSessions(tokens []database.RefreshToken, now time.Time, currentId string) []Session {
+	createdAt := map[string]time.Time{}
+	for _, token := range tokens {
+		if first, ok := createdAt[token.FamilyId]; !ok || token.IssuedAt.Before(first) {
+			createdAt[token.FamilyId] = token.IssuedAt
+		}
+	}
+	sessions := []Session{}
+	for _, token := range tokens {
+		if !token.RevokedAt.IsZero() || token.ExpiresAt.Before(now) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			Id:         token.FamilyId,
+			CreatedAt:  createdAt[token.FamilyId],
+			LastUsedAt: token.IssuedAt,
+			ExpiresAt:  token.ExpiresAt,
+			UserAgent:  token.UserAgent,
+			Ip:         token.Ip,
+			Current:    token.FamilyId == currentId,
+		})
+	}
+	return sessions
+}
+
+// ApiGetSessions lists the active sessions of the caller, most recently used first
+func (cfg *Config) ApiGetSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+	token, _ := AuthTokenFrom(r.Context())
+
+	tokens, err := cfg.db.GetTokensByUser(user.Id)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, activeSessions(tokens, time.Now().UTC(), token.Claims.SessionId))
+}
+
+// ApiRevokeSession logs the caller out of one of their sessions
+func (cfg *Config) ApiRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	err := cfg.db.RevokeTokenFamily(user.Id, r.PathValue("sessionID"))
+	if errors.Is(err, database.ErrTokenNotFound) {
+		RespondWithError(w, http.StatusNotFound, errors.New("no active session with such id").Error())
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// ApiRevokeAllSessions logs the caller out everywhere,
+// access tokens already issued stay valid until they expire
+func (cfg *Config) ApiRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	revoked, err := cfg.db.RevokeUserTokens(user.Id)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type responseParameters struct {
+		Revoked int `json:"revoked"`
+	}
+	respParams := responseParameters{Revoked: revoked}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// revokeOtherSessions logs the user out of every session but currentId
+// and returns how many it ended
+func (cfg *Config) revokeOtherSessions(userID int, currentId string) (int, error) {
+	tokens, err := cfg.db.GetTokensByUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, session := range activeSessions(tokens, time.Now().UTC(), currentId) {
+		if session.Current {
+			continue
+		}
+		err := cfg.db.RevokeTokenFamily(userID, session.Id)
+		if errors.Is(err, database.ErrTokenNotFound) {
+			continue
+		}
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	snapshotTimeFormat      = "20060102T150405.000Z"
+	defaultSnapshotInterval = 6 * time.Hour
+	defaultSnapshotRetain   = 7
+)
+
+// SnapshotConfig controls scheduled snapshots,
+// they are disabled when Dir is empty
+type SnapshotConfig struct {
+	Dir      string
+	Interval time.Duration
+	// Retain is how many snapshots are kept in Dir
+	Retain int
+}
+
+// LoadSnapshotConfig reads the snapshot settings from the environment
+func LoadSnapshotConfig() (SnapshotConfig, error) {
+	sc := SnapshotConfig{
+		Dir:      os.Getenv("SNAPSHOT_DIR"),
+		Interval: defaultSnapshotInterval,
+		Retain:   defaultSnapshotRetain,
+	}
+	if interval := os.Getenv("SNAPSHOT_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return SnapshotConfig{}, fmt.Errorf("invalid SNAPSHOT_INTERVAL %q", interval)
+		}
+		sc.Interval = d
+	}
+	if retain := os.Getenv("SNAPSHOT_RETAIN"); retain != "" {
+		n, err := strconv.Atoi(retain)
+		if err != nil || n < 1 {
+			return SnapshotConfig{}, fmt.Errorf("invalid SNAPSHOT_RETAIN %q", retain)
+		}
+		sc.Retain = n
+	}
+	return sc, nil
+}
+
+// SnapshotScheduler periodically writes snapshots of the store to a directory
+// and deletes the oldest ones beyond the retention limit
+type SnapshotScheduler struct {
+	db   database.Store
+	cfg  SnapshotConfig
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewSnapshotScheduler(db database.Store, cfg SnapshotConfig) *SnapshotScheduler {
+	return &SnapshotScheduler{db: db, cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start takes a snapshot every interval until Stop is called
+func (s *SnapshotScheduler) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				path, err := s.TakeSnapshot()
+				if err != nil {
+					log.Printf("snapshot failed: %s", err)
+					continue
+				}
+				log.Printf("snapshot written to %s", path)
+			}
+		}
+	}()
+}
+
+// Stop waits for a running snapshot to finish and stops the schedule
+func (s *SnapshotScheduler) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// TakeSnapshot durably writes a new snapshot file and applies the retention limit
+func (s *SnapshotScheduler) TakeSnapshot() (string, error) {
+	err := os.MkdirAll(s.cfg.Dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("chirpy-%s.snapshot", time.Now().UTC().Format(snapshotTimeFormat))
+	path := filepath.Join(s.cfg.Dir, name)
+	f, err := os.CreateTemp(s.cfg.Dir, name+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err == nil {
+		err = syncDir(s.cfg.Dir)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return path, s.prune()
+}
+
+// syncDir flushes the entries of dir so a snapshot renamed into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// prune deletes all but the newest Retain snapshots
+func (s *SnapshotScheduler) prune() error {
+	snapshots, err := filepath.Glob(filepath.Join(s.cfg.Dir, "chirpy-*.snapshot"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(snapshots)
+	for len(snapshots) > s.cfg.Retain {
+		err := os.Remove(snapshots[0])
+		if err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
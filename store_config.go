@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	dbPath       = "./database.json"
+	sqliteDBPath = "./database.db"
+)
+
+// StoreConfig selects and configures the storage backend
+type StoreConfig struct {
+	// Backend is either "json" or "sqlite"
+	Backend string
+	Path    string
+	// Options only apply to the JSON file store
+	Options []database.Option
+}
+
+// LoadStoreConfig reads the storage settings from the environment,
+// the JSON file store is used when DB_BACKEND is not set
+func LoadStoreConfig() (StoreConfig, error) {
+	sc := StoreConfig{Backend: os.Getenv("DB_BACKEND"), Path: os.Getenv("DB_PATH")}
+	switch sc.Backend {
+	case "", "json":
+		sc.Backend = "json"
+		if sc.Path == "" {
+			sc.Path = dbPath
+		}
+	case "sqlite":
+		if sc.Path == "" {
+			sc.Path = sqliteDBPath
+		}
+	default:
+		return StoreConfig{}, fmt.Errorf("unknown DB_BACKEND %q", sc.Backend)
+	}
+
+	if interval := os.Getenv("DB_COMPACT_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return StoreConfig{}, fmt.Errorf("invalid DB_COMPACT_INTERVAL %q", interval)
+		}
+		sc.Options = append(sc.Options, database.WithCompactInterval(d))
+	}
+
+	if encoded := os.Getenv("DB_ENCRYPTION_KEY"); encoded != "" {
+		if sc.Backend != "json" {
+			return StoreConfig{}, fmt.Errorf("DB_ENCRYPTION_KEY is not supported by the %s backend", sc.Backend)
+		}
+		current, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return StoreConfig{}, fmt.Errorf("invalid DB_ENCRYPTION_KEY: %w", err)
+		}
+		previous := [][]byte{}
+		for _, encoded := range strings.Split(os.Getenv("DB_ENCRYPTION_OLD_KEYS"), ",") {
+			if encoded == "" {
+				continue
+			}
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+			if err != nil {
+				return StoreConfig{}, fmt.Errorf("invalid DB_ENCRYPTION_OLD_KEYS: %w", err)
+			}
+			previous = append(previous, key)
+		}
+		sc.Options = append(sc.Options, database.WithEncryptionKeys(current, previous...))
+	}
+	return sc, nil
+}
+
+// Open opens the configured backend, migrating it if needed
+func (sc StoreConfig) Open() (database.Store, error) {
+	if sc.Backend == "sqlite" {
+		return database.NewSQLiteDB(sc.Path)
+	}
+	return database.NewDB(sc.Path, sc.Options...)
+}
+
+// PendingMigrations lists the migrations Open would apply
+func (sc StoreConfig) PendingMigrations() ([]database.PendingMigration, error) {
+	if sc.Backend == "sqlite" {
+		return database.PendingSQLiteMigrations(sc.Path)
+	}
+	return database.PendingMigrations(sc.Path, sc.Options...)
+}
+
+// Remove deletes every file of the configured backend
+func (sc StoreConfig) Remove() {
+	os.Remove(sc.Path)
+	if sc.Backend == "sqlite" {
+		os.Remove(sc.Path + "-wal")
+		os.Remove(sc.Path + "-shm")
+		return
+	}
+	generations, _ := filepath.Glob(sc.Path + ".*")
+	for _, generation := range generations {
+		os.Remove(generation)
+	}
+}
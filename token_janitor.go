@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+)
+
+const (
+	defaultTokenGCInterval   = time.Hour
+	defaultTokenRevokedGrace = 24 * time.Hour
+)
+
+// TokenJanitorConfig controls the purging of dead refresh tokens
+type TokenJanitorConfig struct {
+	Interval time.Duration
+	// RevokedGrace is how long revoked tokens are kept before they are purged
+	RevokedGrace time.Duration
+}
+
+// LoadTokenJanitorConfig reads the token janitor settings from the environment
+func LoadTokenJanitorConfig() (TokenJanitorConfig, error) {
+	jc := TokenJanitorConfig{
+		Interval:     defaultTokenGCInterval,
+		RevokedGrace: defaultTokenRevokedGrace,
+	}
+	if interval := os.Getenv("TOKEN_GC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return TokenJanitorConfig{}, fmt.Errorf("invalid TOKEN_GC_INTERVAL %q", interval)
+		}
+		jc.Interval = d
+	}
+	if grace := os.Getenv("TOKEN_REVOKED_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil || d < 0 {
+			return TokenJanitorConfig{}, fmt.Errorf("invalid TOKEN_REVOKED_GRACE %q", grace)
+		}
+		jc.RevokedGrace = d
+	}
+	return jc, nil
+}
+
+// TokenJanitorStats is what the janitor has done since the server started
+type TokenJanitorStats struct {
+	Runs     int
+	Expired  int
+	Revoked  int
+	OneTime  int
+	Personal int
+	// OAuthCodes counts the authorization codes that ran out
+	OAuthCodes int
+	// Throttles counts the login throttle records that ran out
+	Throttles int
+	LastRun   time.Time
+	LastErr   error
+}
+
+// TokenJanitor periodically deletes expired tokens and tokens
+// revoked or used longer than the grace period ago
+type TokenJanitor struct {
+	db    database.Store
+	cfg   TokenJanitorConfig
+	mu    sync.Mutex
+	stats TokenJanitorStats
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewTokenJanitor(db database.Store, cfg TokenJanitorConfig) *TokenJanitor {
+	return &TokenJanitor{db: db, cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start purges tokens right away and then every interval until Stop is called
+func (j *TokenJanitor) Start() {
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(j.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			purge, err := j.Purge()
+			if err != nil {
+				log.Printf("token purge failed: %s", err)
+			} else if purge.Expired+purge.Revoked+purge.OneTime+purge.OAuthCodes+purge.Personal > 0 {
+				log.Printf("purged %d expired and %d revoked refresh tokens, %d one-time tokens, "+
+					"%d authorization codes and %d expired personal access tokens",
+					purge.Expired, purge.Revoked, purge.OneTime, purge.OAuthCodes, purge.Personal)
+			}
+			throttles, err := j.PurgeLoginThrottles()
+			if err != nil {
+				log.Printf("login throttle purge failed: %s", err)
+			} else if throttles > 0 {
+				log.Printf("purged %d login throttle records", throttles)
+			}
+			select {
+			case <-j.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop waits for a running purge to finish and stops the janitor
+func (j *TokenJanitor) Stop() {
+	close(j.stop)
+	<-j.done
+}
+
+// Purge deletes dead tokens once and records the result in the stats
+func (j *TokenJanitor) Purge() (database.TokenPurge, error) {
+	now := time.Now().UTC()
+	purge, err := j.db.PurgeTokens(now, now.Add(-j.cfg.RevokedGrace))
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.Runs++
+	j.stats.Expired += purge.Expired
+	j.stats.Revoked += purge.Revoked
+	j.stats.OneTime += purge.OneTime
+	j.stats.OAuthCodes += purge.OAuthCodes
+	j.stats.Personal += purge.Personal
+	j.stats.LastRun = now
+	j.stats.LastErr = err
+	return purge, err
+}
+
+// PurgeLoginThrottles deletes the login throttle records older than
+// loginThrottleRetention once and records the result in the stats
+func (j *TokenJanitor) PurgeLoginThrottles() (int, error) {
+	now := time.Now().UTC()
+	purged, err := j.db.PurgeLoginThrottles(now.Add(-loginThrottleRetention))
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.Throttles += purged
+	if err != nil {
+		j.stats.LastErr = err
+	}
+	return purged, err
+}
+
+// Stats returns a copy of the janitor stats, a nil janitor has none
+func (j *TokenJanitor) Stats() TokenJanitorStats {
+	if j == nil {
+		return TokenJanitorStats{}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/dimadudin/web-server-go/internal/totp"
+)
+
+const (
+	issuerMfa   = "chirpy-mfa"
+	mfaTokenTTL = 5 * time.Minute
+
+	totpIssuer = "Chirpy"
+	// totpSkew is how many time steps a code may be off either way
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	errTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	errTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	errTwoFactorNotEnrolled = errors.New("start the two-factor enrollment first")
+	errInvalidSecondFactor  = errors.New("invalid two-factor code")
+)
+
+// newRecoveryCodes returns fresh recovery codes and the digests to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	digests := make([]string, 0, recoveryCodeCount)
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for range recoveryCodeCount {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		digests = append(digests, database.HashToken(code))
+	}
+	return codes, digests, nil
+}
+
+// normalizeRecoveryCode drops the separators and case users may type a recovery code with
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// useSecondFactor checks a TOTP code, or else a recovery code, of the user
+// and records its use on user so that neither works twice
+func useSecondFactor(user *database.User, code string, recoveryCode string, now time.Time) error {
+	if !user.TotpEnabled {
+		return errTwoFactorNotEnabled
+	}
+	if code != "" {
+		step, ok := totp.Validate(user.TotpSecret, code, now, totpSkew, user.TotpLastStep)
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		user.TotpLastStep = step
+		return nil
+	}
+	if recoveryCode != "" {
+		i := slices.Index(user.RecoveryCodes, database.HashToken(normalizeRecoveryCode(recoveryCode)))
+		if i < 0 {
+			return errInvalidSecondFactor
+		}
+		user.RecoveryCodes = slices.Delete(user.RecoveryCodes, i, i+1)
+		return nil
+	}
+	return errInvalidSecondFactor
+}
+
+// respondSecondFactorError maps the errors of two-factor changes to responses
+func respondSecondFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTwoFactorEnabled):
+		RespondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errTwoFactorNotEnabled), errors.Is(err, errTwoFactorNotEnrolled),
+		errors.Is(err, errInvalidSecondFactor):
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+	default:
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// ApiEnrollTwoFactor starts a TOTP enrollment of the caller, the secret
+// only takes effect once ApiConfirmTwoFactor gets a code generated from it
+func (cfg *Config) ApiEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	user, err = cfg.db.ModifyUser(user.Id, func(user *database.User) error {
+		if user.TotpEnabled {
+			return errTwoFactorEnabled
+		}
+		user.TotpSecret = secret
+		user.TotpLastStep = 0
+		return nil
+	})
+	if err != nil {
+		respondSecondFactorError(w, err)
+		return
+	}
+
+	type responseParameters struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+	respParams := responseParameters{Secret: secret, URI: totp.URI(totpIssuer, user.Email, secret)}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// ApiConfirmTwoFactor enables two-factor authentication with a code from the
+// enrolled secret and returns the recovery codes, they are not shown again
+func (cfg *Config) ApiConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	type requestParameters struct {
+		Code string `json:"code"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	codes, digests, err := newRecoveryCodes()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = cfg.db.ModifyUser(user.Id, func(user *database.User) error {
+		if user.TotpEnabled {
+			return errTwoFactorEnabled
+		}
+		if user.TotpSecret == "" {
+			return errTwoFactorNotEnrolled
+		}
+		step, ok := totp.Validate(user.TotpSecret, rqParams.Code, time.Now(), totpSkew, user.TotpLastStep)
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		user.TotpEnabled = true
+		user.TotpLastStep = step
+		user.RecoveryCodes = digests
+		return nil
+	})
+	if err != nil {
+		respondSecondFactorError(w, err)
+		return
+	}
+
+	type responseParameters struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	respParams := responseParameters{RecoveryCodes: codes}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// ApiRegenerateRecoveryCodes replaces the recovery codes of the caller,
+// it takes a current TOTP code so a stolen access token alone can't do it
+func (cfg *Config) ApiRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	type requestParameters struct {
+		Code string `json:"code"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	codes, digests, err := newRecoveryCodes()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = cfg.db.ModifyUser(user.Id, func(user *database.User) error {
+		err := useSecondFactor(user, rqParams.Code, "", time.Now())
+		if err != nil {
+			return err
+		}
+		user.RecoveryCodes = digests
+		return nil
+	})
+	if err != nil {
+		respondSecondFactorError(w, err)
+		return
+	}
+
+	type responseParameters struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	respParams := responseParameters{RecoveryCodes: codes}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// ApiDisableTwoFactor turns two-factor authentication off
+// with a TOTP code or a recovery code
+func (cfg *Config) ApiDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	type requestParameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = cfg.db.ModifyUser(user.Id, func(user *database.User) error {
+		err := useSecondFactor(user, rqParams.Code, rqParams.RecoveryCode, time.Now())
+		if err != nil {
+			return err
+		}
+		user.TotpEnabled = false
+		user.TotpSecret = ""
+		user.TotpLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+	if err != nil {
+		respondSecondFactorError(w, err)
+		return
+	}
+
+	type responseParameters struct{}
+	respParams := responseParameters{}
+	RespondWithJSON(w, http.StatusOK, respParams)
+}
+
+// ApiLoginTwoFactor finishes a login of a user with two-factor authentication,
+// it takes the mfa token ApiLogin returned and a TOTP code or a recovery code
+func (cfg *Config) ApiLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := AuthUser(r.Context())
+
+	type requestParameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ip := ClientIP(r)
+	if !cfg.allowLoginAttempt(w, user.Email, ip) {
+		return
+	}
+	loggedIn, err := cfg.db.ModifyUser(user.Id, func(user *database.User) error {
+		return useSecondFactor(user, rqParams.Code, rqParams.RecoveryCode, time.Now())
+	})
+	if errors.Is(err, errInvalidSecondFactor) || errors.Is(err, errTwoFactorNotEnabled) {
+		cfg.failLogin(w, user.Email, ip, errInvalidSecondFactor)
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = cfg.recordLoginSuccess(user.Email)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	cfg.startSession(w, r, loggedIn)
+}
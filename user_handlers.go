@@ -3,13 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
-	"strconv"
 	"strings"
-	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/dimadudin/web-server-go/internal/database"
+	"github.com/dimadudin/web-server-go/internal/password"
 )
 
 func (cfg *Config) ApiCreateUser(w http.ResponseWriter, r *http.Request) {
@@ -25,24 +24,46 @@ func (cfg *Config) ApiCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(rqParams.Password), 0)
+	email, err := validateEmail(rqParams.Email)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = cfg.passwords.Policy.Check(rqParams.Password)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hashedPassword, err := cfg.passwords.Hasher.Hash(rqParams.Password)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	newUser, err := cfg.db.CreateUser(rqParams.Email, string(hashedPassword))
+	newUser, err := cfg.db.CreateUser(email, hashedPassword)
+	if errors.Is(err, database.ErrEmailTaken) {
+		RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	err = cfg.sendVerificationEmail(newUser, newUser.Email)
+	if err != nil {
+		log.Printf("sending verification email to user %d failed: %s", newUser.Id, err)
+	}
+
 	type responseParameters struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
 	}
-	respParams := responseParameters{Id: newUser.Id, Email: newUser.Email, IsChirpyRed: newUser.IsChirpyRed}
+	respParams := responseParameters{Id: newUser.Id, Email: newUser.Email, IsChirpyRed: newUser.IsChirpyRed,
+		EmailVerified: newUser.EmailVerified}
 	RespondWithJSON(w, http.StatusCreated, respParams)
 }
 
@@ -59,140 +80,229 @@ func (cfg *Config) ApiLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := ClientIP(r)
+	if !cfg.allowLoginAttempt(w, rqParams.Email, ip) {
+		return
+	}
+
+	// unknown emails and wrong passwords get the same response after the same work,
+	// so do accounts that only ever signed in with an identity provider
+	passwordHash := cfg.passwords.dummyHash
 	user, err := cfg.db.GetUserByEmail(rqParams.Email)
+	if err == nil && user.Password != "" {
+		passwordHash = user.Password
+	} else if err != nil && !errors.Is(err, database.ErrEmailNotFound) {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = password.Verify(passwordHash, rqParams.Password)
+	if errors.Is(err, password.ErrMismatch) || (err == nil && passwordHash == cfg.passwords.dummyHash) {
+		cfg.failLogin(w, rqParams.Email, ip, errInvalidCredentials)
+		return
+	}
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !cfg.passwords.Hasher.Current(user.Password) {
+		user = cfg.rehashPassword(user, rqParams.Password)
+	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(rqParams.Password))
-	if err != nil {
-		RespondWithError(w, http.StatusUnauthorized, err.Error())
+	cfg.completeLogin(w, r, user, rqParams.Email)
+}
+
+// completeLogin finishes a login whose first factor passed, under throttle key
+// email, it asks for the second factor if the user has one
+// and otherwise starts the session
+func (cfg *Config) completeLogin(w http.ResponseWriter, r *http.Request, user database.User, email string) {
+	if user.TotpEnabled {
+		mfaTokenStr, _, err := cfg.issueToken(issuerMfa, user, mfaTokenTTL, "")
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		type responseParameters struct {
+			MfaRequired bool   `json:"mfa_required"`
+			MfaToken    string `json:"mfa_token"`
+		}
+		respParams := responseParameters{MfaRequired: true, MfaToken: mfaTokenStr}
+		RespondWithJSON(w, http.StatusOK, respParams)
 		return
 	}
 
-	refreshExpTime := time.Hour * 24 * 60
-	refreshClaims := &jwt.RegisteredClaims{
-		Issuer:    "chirpy-refresh",
-		Subject:   strconv.Itoa(user.Id),
-		ExpiresAt: &jwt.NumericDate{Time: time.Now().UTC().Add(refreshExpTime)},
-		IssuedAt:  &jwt.NumericDate{Time: time.Now().UTC()},
+	// with two-factor authentication the failures only clear once the second step passes
+	err := cfg.recordLoginSuccess(email)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	cfg.startSession(w, r, user)
+}
 
-	accessExpTime := time.Hour
-	accessClaims := &jwt.RegisteredClaims{
-		Issuer:    "chirpy-access",
-		Subject:   strconv.Itoa(user.Id),
-		ExpiresAt: &jwt.NumericDate{Time: time.Now().UTC().Add(accessExpTime)},
-		IssuedAt:  &jwt.NumericDate{Time: time.Now().UTC()},
+// rehashPassword stores password, which was just verified, hashed with the
+// current hasher, failures are only logged since the old hash still works
+func (cfg *Config) rehashPassword(user database.User, plain string) database.User {
+	hashedPassword, err := cfg.passwords.Hasher.Hash(plain)
+	if err != nil {
+		log.Printf("rehashing the password of user %d failed: %s", user.Id, err)
+		return user
+	}
+	oldHash := user.Password
+	updated, err := cfg.db.ModifyUser(user.Id, func(user *database.User) error {
+		// a password changed in the meantime is left alone
+		if user.Password == oldHash {
+			user.Password = hashedPassword
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("rehashing the password of user %d failed: %s", user.Id, err)
+		return user
 	}
+	return updated
+}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenStr, err := refreshToken.SignedString([]byte(cfg.jwtSecret))
+// startSession completes a login, it starts a new refresh token family
+// and responds with the user and both of its tokens
+func (cfg *Config) startSession(w http.ResponseWriter, r *http.Request, user database.User) {
+	refreshTokenStr, refreshClaims, err := cfg.issueToken(issuerRefresh, user, refreshTokenTTL, "")
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenStr, err := accessToken.SignedString([]byte(cfg.jwtSecret))
+	session, err := cfg.db.CreateToken(refreshTokenStr, database.RefreshToken{
+		UserId:    user.Id,
+		IssuedAt:  refreshClaims.IssuedAt.Time,
+		ExpiresAt: refreshClaims.ExpiresAt.Time,
+		UserAgent: r.UserAgent(),
+		Ip:        ClientIP(r),
+	})
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	_, err = cfg.db.CreateToken(refreshTokenStr)
+	accessTokenStr, _, err := cfg.issueToken(issuerAccess, user, accessTokenTTL, session.FamilyId)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	type responseParameters struct {
-		Id           int    `json:"id"`
-		Email        string `json:"email"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
-		AccessToken  string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
+		AccessToken   string `json:"token"`
+		RefreshToken  string `json:"refresh_token"`
 	}
 	respParams := responseParameters{
-		Id:           user.Id,
-		Email:        user.Email,
-		IsChirpyRed:  user.IsChirpyRed,
-		AccessToken:  accessTokenStr,
-		RefreshToken: refreshTokenStr,
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		AccessToken:   accessTokenStr,
+		RefreshToken:  refreshTokenStr,
 	}
 	RespondWithJSON(w, http.StatusOK, respParams)
 }
 
 func (cfg *Config) ApiUpdateUser(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("no auth").Error())
-		return
-	}
+	user, _ := AuthUser(r.Context())
 
-	tokenStr := strings.TrimPrefix(auth, "Bearer ")
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.jwtSecret), nil
-		})
+	type requestParameters struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	rqParams := requestParameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rqParams)
 	if err != nil {
-		RespondWithError(w, http.StatusUnauthorized, err.Error())
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	email, err := validateEmail(rqParams.Email)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if issuer != "chirpy-access" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("invalid token issuer").Error())
-		return
+	// a new address only replaces the current one once it is verified
+	changeEmail := !strings.EqualFold(email, user.Email)
+	if changeEmail {
+		other, err := cfg.db.GetUserByEmail(email)
+		if err == nil && other.Id != user.Id {
+			RespondWithError(w, http.StatusConflict, database.ErrEmailTaken.Error())
+			return
+		}
+		if err != nil && !errors.Is(err, database.ErrEmailNotFound) {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 	}
 
-	userIDStr, err := token.Claims.GetSubject()
+	err = cfg.passwords.Policy.Check(rqParams.Password)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	userID, err := strconv.Atoi(userIDStr)
+	hashedPassword, err := cfg.passwords.Hasher.Hash(rqParams.Password)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	changePassword := password.Verify(user.Password, rqParams.Password) != nil
 
-	type requestParameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-	rqParams := requestParameters{}
-	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&rqParams)
+	user, err = cfg.db.ModifyUser(user.Id, func(user *database.User) error {
+		user.Password = hashedPassword
+		if changeEmail {
+			user.PendingEmail = email
+		} else {
+			user.Email = email
+			user.PendingEmail = ""
+		}
+		return nil
+	})
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(rqParams.Password), 0)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	if changePassword {
+		// whoever knew the old password may have logged in with it
+		token, _ := AuthTokenFrom(r.Context())
+		revoked, err := cfg.revokeOtherSessions(user.Id, token.Claims.SessionId)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		deleted, err := cfg.db.DeletePersonalTokensByUser(user.Id)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("password of user %d changed, %d other sessions revoked and %d personal access tokens deleted",
+			user.Id, revoked, deleted)
 	}
 
-	user, err := cfg.db.UpdateUser(userID, rqParams.Email, string(hashedPassword))
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	if changeEmail {
+		err = cfg.sendVerificationEmail(user, email)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 	}
 
 	type responseParameters struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
-	}
-	respParams := responseParameters{Id: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed}
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
+		PendingEmail  string `json:"pending_email,omitempty"`
+	}
+	respParams := responseParameters{Id: user.Id, Email: user.Email, IsChirpyRed: user.IsChirpyRed,
+		EmailVerified: user.EmailVerified, PendingEmail: user.PendingEmail}
 	RespondWithJSON(w, http.StatusOK, respParams)
 }
 
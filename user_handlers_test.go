@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateUserEmailTaken(t *testing.T) {
+	_, srv := startTestServer(t, nil)
+	loginTestUser(t, srv, "a@x.com")
+	resp, body := doJSON(t, http.MethodPost, srv.URL+"/api/users", "", map[string]string{
+		"email":    "A@X.com",
+		"password": "correct horse battery",
+	})
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("signing up with a taken email responded %s: %v", resp.Status, body)
+	}
+}
+
+// TestUpdateUserPasswordEndsOtherSessions changes the password and checks
+// that only the login it was changed from keeps working
+func TestUpdateUserPasswordEndsOtherSessions(t *testing.T) {
+	_, srv := startTestServer(t, nil)
+	accessToken := loginTestUser(t, srv, "a@x.com")
+	credentials := map[string]string{"email": "a@x.com", "password": "correct horse battery"}
+	resp, body := doJSON(t, http.MethodPost, srv.URL+"/api/login", "", credentials)
+	otherRefresh, _ := body["refresh_token"].(string)
+	if resp.StatusCode != http.StatusOK || otherRefresh == "" {
+		t.Fatalf("logging in again responded %s: %v", resp.Status, body)
+	}
+	resp, body = doJSON(t, http.MethodPost, srv.URL+"/api/tokens", accessToken, map[string]any{
+		"name":   "automation",
+		"scopes": []string{ScopeProfileWrite},
+	})
+	personalToken, _ := body["token"].(string)
+	if resp.StatusCode != http.StatusCreated || personalToken == "" {
+		t.Fatalf("creating a personal access token responded %s: %v", resp.Status, body)
+	}
+
+	changed := map[string]string{"email": "a@x.com", "password": "battery staple horse"}
+	resp, body = doJSON(t, http.MethodPut, srv.URL+"/api/users", personalToken, changed)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("changing the password with a personal access token responded %s: %v", resp.Status, body)
+	}
+	resp, body = doJSON(t, http.MethodPut, srv.URL+"/api/users", accessToken, changed)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("changing the password responded %s: %v", resp.Status, body)
+	}
+
+	resp, body = doJSON(t, http.MethodPost, srv.URL+"/api/refresh", otherRefresh, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refreshing the other session responded %s: %v", resp.Status, body)
+	}
+	resp, body = doJSON(t, http.MethodPost, srv.URL+"/api/users/verify_email/resend", personalToken, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("the personal access token still authenticates: %s %v", resp.Status, body)
+	}
+	resp, body = doJSON(t, http.MethodPut, srv.URL+"/api/users", accessToken, changed)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("the session the password was changed from responded %s: %v", resp.Status, body)
+	}
+}
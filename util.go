@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"slices"
 	"strings"
@@ -43,3 +44,12 @@ func CensorChirp(chirp string) string {
 	}
 	return strings.Join(words, " ")
 }
+
+// ClientIP returns the address of the peer that sent r
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
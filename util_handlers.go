@@ -3,11 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/dimadudin/web-server-go/internal/database"
 )
 
 func (cfg *Config) AdminGetHitCount(w http.ResponseWriter, r *http.Request) {
@@ -18,103 +18,75 @@ func (cfg *Config) AdminGetHitCount(w http.ResponseWriter, r *http.Request) {
 <body>
     <h1>Welcome, Chirpy Admin</h1>
     <p>Chirpy has been visited %d times!</p>
+    <p>The token janitor has purged %d expired and %d revoked refresh tokens, %d one-time tokens,
+    %d authorization codes and %d personal access tokens in %d runs.</p>
+    <p>It has forgotten %d login throttle records.</p>
 </body>
 </html>
 `
-	fmt.Fprintf(w, body, cfg.GetHitCount())
+	stats := cfg.janitor.Stats()
+	fmt.Fprintf(w, body, cfg.GetHitCount(), stats.Expired, stats.Revoked, stats.OneTime,
+		stats.OAuthCodes, stats.Personal, stats.Runs, stats.Throttles)
 }
 
+// ApiRefreshToken trades a refresh token for a new access token and a new refresh token,
+// the presented refresh token is revoked and the new one keeps its expiry
 func (cfg *Config) ApiRefreshToken(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("no auth").Error())
+	user, _ := AuthUser(r.Context())
+	token, _ := AuthTokenFrom(r.Context())
+	if token.Claims.ClientId != "" {
+		RespondWithError(w, http.StatusForbidden,
+			errors.New("refresh tokens of third-party apps are refreshed at /oauth/token").Error())
 		return
 	}
 
-	tokenStr := strings.TrimPrefix(auth, "Bearer ")
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.jwtSecret), nil
-		})
-	if err != nil {
-		RespondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	issuer, err := token.Claims.GetIssuer()
+	refreshTokenStr, refreshClaims, err := cfg.issueToken(issuerRefresh, user, time.Until(token.Claims.ExpiresAt.Time), "")
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if issuer != "chirpy-refresh" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("invalid token issuer").Error())
-		return
-	}
-
-	db_token, err := cfg.db.GetToken(tokenStr)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
+	session, err := cfg.db.RotateToken(token.Raw, refreshTokenStr, database.RefreshToken{
+		IssuedAt:  refreshClaims.IssuedAt.Time,
+		ExpiresAt: refreshClaims.ExpiresAt.Time,
+		UserAgent: r.UserAgent(),
+		Ip:        ClientIP(r),
+	})
+	if errors.Is(err, database.ErrTokenReused) {
+		log.Printf("refresh token reuse for user %d from %s, session revoked", user.Id, ClientIP(r))
+		RespondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	if !db_token.RevokedAt.IsZero() {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("this token has been revoked").Error())
+	if errors.Is(err, database.ErrTokenNotFound) {
+		RespondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-
-	userIDStr, err := token.Claims.GetSubject()
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	accessExpTime := time.Hour
-	accessClaims := &jwt.RegisteredClaims{
-		Issuer:    "chirpy-access",
-		Subject:   userIDStr,
-		ExpiresAt: &jwt.NumericDate{Time: time.Now().UTC().Add(accessExpTime)},
-		IssuedAt:  &jwt.NumericDate{Time: time.Now().UTC()},
-	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenStr, err := accessToken.SignedString([]byte(cfg.jwtSecret))
+
+	accessTokenStr, _, err := cfg.issueToken(issuerAccess, user, accessTokenTTL, session.FamilyId)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	type responseParameters struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
-	respParams := responseParameters{Token: accessTokenStr}
+	respParams := responseParameters{Token: accessTokenStr, RefreshToken: refreshTokenStr}
 	RespondWithJSON(w, http.StatusOK, respParams)
 }
 
 func (cfg *Config) ApiRevokeToken(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("no auth").Error())
-		return
-	}
+	token, _ := AuthTokenFrom(r.Context())
 
-	tokenStr := strings.TrimPrefix(auth, "Bearer ")
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.jwtSecret), nil
-		})
-	if err != nil {
+	_, err := cfg.db.RevokeToken(token.Raw)
+	if errors.Is(err, database.ErrTokenNotFound) {
 		RespondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	if issuer != "chirpy-refresh" {
-		RespondWithError(w, http.StatusUnauthorized, errors.New("invalid token issuer").Error())
-		return
-	}
-
-	_, err = cfg.db.RevokeToken(tokenStr)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -125,6 +97,12 @@ func (cfg *Config) ApiRevokeToken(w http.ResponseWriter, r *http.Request) {
 	RespondWithJSON(w, http.StatusOK, respParams)
 }
 
+// ApiGetJWKS publishes the public keys chirpy tokens are signed with
+func (cfg *Config) ApiGetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	RespondWithJSON(w, http.StatusOK, cfg.tokenKeys.JWKS())
+}
+
 func (cfg *Config) ApiResetHits(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)